@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog is where requests are logged by withAccessLog, nothing when
+// nil. It is set up with setupAccessLog.
+var accessLog io.Writer
+
+// setupAccessLog points accessLog at the destination in cfg.AccessLog.
+func setupAccessLog(cfg *Config) error {
+	switch cfg.AccessLog {
+	case "":
+		accessLog = nil
+	case "-":
+		accessLog = &lockedWriter{w: os.Stdout}
+	default:
+		f, err := os.OpenFile(cfg.AccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("cannot open access log: %v", err)
+		}
+		accessLog = &lockedWriter{w: f}
+	}
+	return nil
+}
+
+// withAccessLog wraps h so that every response is logged to accessLog,
+// when set, once written. Requests taking longer than
+// config.SlowRequestThreshold are also logged as slow, off the same
+// timing.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, slow := accessLog, config().SlowRequestThreshold
+		if out == nil && slow <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		note := &repoNote{}
+		r = r.WithContext(context.WithValue(r.Context(), repoNoteKey{}, note))
+		h.ServeHTTP(sw, r)
+		took := time.Since(start)
+		if out != nil {
+			_, _ = io.WriteString(out, accessLogLine(r, sw.status(), sw.written, start, took))
+		}
+		if slow > 0 && took > slow {
+			logger.WarnContext(r.Context(), "slow request", "method", r.Method, "path", r.URL.Path,
+				"repo", note.get(), "duration", took, "status", sw.status(), "bytes", sw.written)
+		}
+	})
+}
+
+// repoNote holds the repository a request is about, once known to the
+// handler, for withAccessLog to log it.
+type repoNote struct {
+	mu   sync.Mutex
+	repo string
+}
+
+type repoNoteKey struct{}
+
+// noteRepo records repo, as given by Repo.GitHubRoot, in the note of the
+// request of ctx, if any.
+func noteRepo(ctx context.Context, repo string) {
+	if n, ok := ctx.Value(repoNoteKey{}).(*repoNote); ok {
+		n.mu.Lock()
+		n.repo = repo
+		n.mu.Unlock()
+	}
+}
+
+func (n *repoNote) get() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.repo
+}
+
+// accessLogLine returns the line logged for r, answered with status and
+// a body of the given size, in the Apache combined log format followed
+// by the time taken in microseconds:
+//
+//	203.0.113.7 - - [14/Oct/2026:10:00:00 +0000] "GET /config.v1?go-get=1 HTTP/1.1" 200 312 "-" "Go-http-client/1.1" 1520
+//
+// The user field is always "-", as the credentials of pushes are GitHub's
+// business and not something to log.
+func accessLogLine(r *http.Request, status int, size int64, start time.Time, took time.Duration) string {
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %d\n",
+		clientIP(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogField(r.Method), escapeLogField(redactString(r.RequestURI)), escapeLogField(r.Proto),
+		status, bytes, logFieldOrDash(redactString(r.Referer())), logFieldOrDash(r.UserAgent()),
+		took.Microseconds())
+}
+
+func logFieldOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return escapeLogField(s)
+}
+
+// escapeLogField escapes quotes, backslashes and non-printable bytes in
+// s, which would otherwise let clients forge access log lines.
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// lockedWriter serializes the writes to w, so that the lines of
+// concurrent requests don't interleave.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
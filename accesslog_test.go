@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AccessLogSuite{})
+
+type AccessLogSuite struct {
+	restore func()
+}
+
+func (s *AccessLogSuite) SetUpTest(c *C) {
+	w := accessLog
+	s.restore = func() { accessLog = w }
+}
+
+func (s *AccessLogSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *AccessLogSuite) TestLine(c *C) {
+	req := httptest.NewRequest("GET", "/config.v1?go-get=1", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set("User-Agent", "Go-http-client/1.1")
+	start := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+
+	line := accessLogLine(req, 200, 312, start, 1520*time.Microsecond)
+	c.Assert(line, Equals, `203.0.113.7 - - [14/Oct/2026:10:00:00 +0000] "GET /config.v1?go-get=1 HTTP/1.1" 200 312 "-" "Go-http-client/1.1" 1520`+"\n")
+
+	req.Header.Set("Referer", "https://aahframework.org/")
+	req.Header.Set("User-Agent", "evil\" 200 1\n\\")
+	line = accessLogLine(req, 404, 0, start, 0)
+	c.Assert(line, Equals, `203.0.113.7 - - [14/Oct/2026:10:00:00 +0000] "GET /config.v1?go-get=1 HTTP/1.1" 404 - "https://aahframework.org/" "evil\" 200 1\x0a\\" 0`+"\n")
+}
+
+func (s *AccessLogSuite) TestMiddleware(c *C) {
+	var buf bytes.Buffer
+	accessLog = &buf
+
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, "not found")
+	}))
+	req := httptest.NewRequest("HEAD", "/nothing", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(buf.String(), Matches, `192.0.2.1 - - \[.*\] "HEAD /nothing HTTP/1.1" 404 9 "-" "-" \d+`+"\n")
+
+	buf.Reset()
+	accessLog = nil
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(buf.Len(), Equals, 0)
+}
+
+func (s *AccessLogSuite) TestSlowRequest(c *C) {
+	defer func(l *slog.Logger, slow time.Duration) {
+		logger, config().SlowRequestThreshold = l, slow
+	}(logger, config().SlowRequestThreshold)
+	var log bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+	accessLog = nil
+	config().SlowRequestThreshold = 10 * time.Millisecond
+
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceRepo(r.Context(), &Repo{User: "go-aah", Name: "config"})
+		if r.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		_, _ = io.WriteString(w, "0008NAK\n")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/fast", nil))
+	c.Assert(log.String(), Equals, "")
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/slow", nil))
+	c.Assert(log.String(), Matches, `.*level=WARN msg="slow request" method=POST path=/slow repo=github.com/go-aah/config duration=.* status=200 bytes=8\n`)
+
+	log.Reset()
+	config().SlowRequestThreshold = 0
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/slow", nil))
+	c.Assert(log.String(), Equals, "")
+}
+
+func (s *AccessLogSuite) TestSetup(c *C) {
+	cfg := newConfig()
+	c.Assert(setupAccessLog(cfg), IsNil)
+	c.Assert(accessLog, IsNil)
+
+	cfg.AccessLog = filepath.Join(c.MkDir(), "access.log")
+	c.Assert(setupAccessLog(cfg), IsNil)
+	_, err := accessLog.Write([]byte("line\n"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(cfg.AccessLog)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "line\n")
+
+	cfg.AccessLog = filepath.Join(c.MkDir(), "missing", "access.log")
+	c.Assert(setupAccessLog(cfg), ErrorMatches, "cannot open access log: .*")
+}
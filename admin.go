@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// newAdminHandler returns the handler of the admin listener at
+// config.AdminAddr, kept apart from the public one. When
+// config.EnablePprof is set, it serves the debug endpoints: the expvar
+// JSON at /debug/vars, the requests being proxied and expvarStats among
+// them, the profiles of net/http/pprof under /debug/pprof/ and the
+// configuration in use at /debug/config.
+func newAdminHandler(cfg *Config) http.Handler {
+	mux := http.NewServeMux()
+	if cfg.EnablePprof {
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/config", serveConfig)
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// secretSettings are the Config fields masked by serveConfig, the paths
+// of the files with the credentials and keys of the proxy, and the
+// upstream proxy URL, which may hold a password.
+var secretSettings = []string{"TLSCertFile", "TLSKeyFile", "PushClientCAFile", "GitHubTokenFile", "UpstreamProxy"}
+
+// serveConfig replies with the configuration in use, as reloaded last,
+// in JSON under the names of the config file, secretSettings masked.
+func serveConfig(resp http.ResponseWriter, req *http.Request) {
+	cfg := *config()
+	v := reflect.ValueOf(&cfg).Elem()
+	for _, name := range secretSettings {
+		if f := v.FieldByName(name); f.String() != "" {
+			f.SetString(redacted)
+		}
+	}
+	// The token files of the backends too, in a copy of their slice.
+	cfg.Backends = append([]Backend(nil), cfg.Backends...)
+	for i := range cfg.Backends {
+		if cfg.Backends[i].TokenFile != "" {
+			cfg.Backends[i].TokenFile = redacted
+		}
+	}
+	// Through YAML for the names, durations and prefixes of the file.
+	data, err := yaml.Marshal(&cfg)
+	var settings map[string]interface{}
+	if err == nil {
+		err = yaml.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		logger.ErrorContext(req.Context(), "cannot encode configuration", "err", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(resp)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(settings)
+}
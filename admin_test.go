@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AdminSuite{})
+
+type AdminSuite struct{}
+
+func (s *AdminSuite) TestPprof(c *C) {
+	cfg := newConfig()
+	cfg.AdminAddr = "localhost:6060"
+	cfg.EnablePprof = true
+	h := newAdminHandler(cfg)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Matches, "(?s).*goroutine.*")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Matches, "(?s)goroutine profile: total .*")
+}
+
+func (s *AdminSuite) TestPprofDisabled(c *C) {
+	cfg := newConfig()
+	cfg.AdminAddr = "localhost:6060"
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		rec := httptest.NewRecorder()
+		newAdminHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		c.Assert(rec.Code, Equals, http.StatusNotFound)
+	}
+}
+
+func (s *AdminSuite) TestVars(c *C) {
+	defer func(ps *proxySlots) { slots = ps }(slots)
+	slots = &proxySlots{}
+	c.Assert(slots.acquire(), Equals, true)
+	c.Assert(slots.acquire(), Equals, true)
+
+	cfg := newConfig()
+	cfg.EnablePprof = true
+	rec := httptest.NewRecorder()
+	newAdminHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	var vars struct {
+		InFlight int `json:"proxy_requests_in_flight"`
+		Max      int `json:"proxy_requests_max"`
+	}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &vars), IsNil)
+	c.Assert(vars.InFlight, Equals, 2)
+	c.Assert(vars.Max, Equals, config().MaxConcurrentProxies)
+}
+
+func (s *AdminSuite) TestConfig(c *C) {
+	defer liveConfig.Store(config())
+	live := newConfig()
+	live.TLSCertFile, live.TLSKeyFile = "/etc/gopkg/cert.pem", "/etc/gopkg/key.pem"
+	live.ProxyTimeout = 5 * time.Minute
+	live.RateLimitExempt = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	liveConfig.Store(live)
+
+	cfg := newConfig()
+	cfg.AdminAddr = "localhost:6060"
+	cfg.EnablePprof = true
+	rec := httptest.NewRecorder()
+	newAdminHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/config", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(rec.Body.String(), Not(Matches), "(?s).*pem.*")
+
+	var settings map[string]interface{}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &settings), IsNil)
+	c.Assert(settings["tls_cert_file"], Equals, "***")
+	c.Assert(settings["tls_key_file"], Equals, "***")
+	c.Assert(settings["github_token_file"], Equals, "")
+	c.Assert(settings["proxy_timeout"], Equals, "5m0s")
+	c.Assert(settings["rate_limit_exempt"], DeepEquals, []interface{}{"10.0.0.0/8"})
+	// The live configuration is left alone.
+	c.Assert(live.TLSCertFile, Equals, "/etc/gopkg/cert.pem")
+
+	rec = httptest.NewRecorder()
+	cfg.EnablePprof = false
+	newAdminHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/config", nil))
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	repoPolicyAllowAll = "allow-all"
+	repoPolicyDenyAll  = "deny-all"
+)
+
+// repoAllowed reports whether repo may be proxied under config.RepoPolicy:
+// any repository with allow-all, and only those matching one of
+// config.AllowedRepos with deny-all.
+func repoAllowed(repo *Repo) bool {
+	if config().RepoPolicy != repoPolicyDenyAll {
+		return true
+	}
+	name := strings.ToLower(strings.TrimPrefix(repo.GitHubRoot(), "github.com/"))
+	for _, pattern := range config().AllowedRepos {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sendForbidden tells the client that repo isn't proxied.
+func sendForbidden(resp http.ResponseWriter, req *http.Request, repo *Repo) {
+	logger.InfoContext(req.Context(), "repository not allowed", "repo", repo.GitHubRoot())
+	resp.WriteHeader(http.StatusForbidden)
+	_, _ = resp.Write([]byte("Repository not served here."))
+}
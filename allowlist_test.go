@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AllowlistSuite{})
+
+type AllowlistSuite struct{}
+
+var repoAllowedTests = []struct {
+	path string
+	ok   bool
+}{
+	{"/config.v1", true},
+	{"/aah.v0", true},
+	{"/go-aah/log.v1", true},
+	{"/Go-Aah/Log.v1", true},
+	{"/labix/mgo.v2", false},
+	{"/other/config.v1", false},
+	{"/jeevatkm/go-model.v1", true},
+	{"/jeevatkm/echo.v1", false},
+}
+
+func (s *AllowlistSuite) TestRepoAllowed(c *C) {
+	defer func(policy string, allowed []string) {
+		config().RepoPolicy, config().AllowedRepos = policy, allowed
+	}(config().RepoPolicy, config().AllowedRepos)
+
+	config().AllowedRepos = []string{"go-aah/*", "jeevatkm/go-*"}
+	config().RepoPolicy = repoPolicyDenyAll
+	for _, t := range repoAllowedTests {
+		repo, _ := parseRepoPath(t.path)
+		c.Check(repoAllowed(repo), Equals, t.ok, Commentf("path %s", t.path))
+	}
+
+	config().RepoPolicy = repoPolicyAllowAll
+	for _, t := range repoAllowedTests {
+		repo, _ := parseRepoPath(t.path)
+		c.Check(repoAllowed(repo), Equals, true, Commentf("path %s", t.path))
+	}
+}
+
+func (s *HandlerSuite) TestRepoNotAllowed(c *C) {
+	defer func(policy string) { config().RepoPolicy = policy }(config().RepoPolicy)
+	config().RepoPolicy = repoPolicyDenyAll
+
+	rec := s.serve("POST", "/config.v1/git-upload-pack", "0000")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(rec.Body.String(), Equals, "Repository not served here.")
+	c.Assert(s.refsHits, Equals, 0)
+}
+
+func (s *ModuleSuite) TestRepoNotAllowed(c *C) {
+	defer func(policy string) { config().RepoPolicy = policy }(config().RepoPolicy)
+	config().RepoPolicy = repoPolicyDenyAll
+
+	rec := s.get("/aahframe.work/config.v1/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+}
+
+func (s *ConfigSuite) TestRepoPolicy(c *C) {
+	cfg := newConfig()
+	cfg.AllowedRepos = []string{"go-aah/*"}
+	c.Assert(cfg.validate(), ErrorMatches, "allowed repositories need the deny-all repo policy")
+	cfg.RepoPolicy = repoPolicyDenyAll
+	c.Assert(cfg.validate(), IsNil)
+	cfg.AllowedRepos = []string{"go-aah/[*"}
+	c.Assert(cfg.validate(), ErrorMatches, `allowed repository must be given as a user/name pattern, got "go-aah/\[\*"`)
+	cfg.AllowedRepos = []string{"*"}
+	c.Assert(cfg.validate(), ErrorMatches, `allowed repository must be given as a user/name pattern, got "\*"`)
+	cfg.RepoPolicy = "some"
+	c.Assert(cfg.validate(), ErrorMatches, `invalid repo policy "some"`)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// auditLog is where push attempts are logged by auditPush, nothing when
+// nil. It is set up with setupAuditLog.
+var auditLog io.Writer
+
+// setupAuditLog points auditLog at the destination in cfg.PushAuditLog.
+func setupAuditLog(cfg *Config) error {
+	switch cfg.PushAuditLog {
+	case "":
+		auditLog = nil
+	case "-":
+		auditLog = &lockedWriter{w: os.Stdout}
+	default:
+		f, err := os.OpenFile(cfg.PushAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot open push audit log: %v", err)
+		}
+		auditLog = &lockedWriter{w: f}
+	}
+	return nil
+}
+
+// Outcomes of the push attempts in the audit log.
+const (
+	auditAccepted     = "accepted"
+	auditDenied       = "denied"
+	auditBackendError = "backend-error"
+)
+
+// auditEntry is a line of the push audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	Identity  string    `json:"identity,omitempty"`
+	Repo      string    `json:"repo"`
+	Service   string    `json:"service"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// isPush reports whether r, for the repository file or service at
+// subPath, is part of a push: the receive-pack advertisement or the push
+// itself.
+func isPush(r *http.Request, subPath string) bool {
+	return subPath == "/git-receive-pack" || subPath == "/info/refs" && r.URL.Query().Get("service") == "git-receive-pack"
+}
+
+// auditPush returns w wrapped to record the response to the push request
+// r for repo, and the function writing its entry to auditLog once the
+// response is written, whoever refused or answered it. The identity is
+// that of the client certificate, as mapped by config.PushClients, or
+// else the user of the Basic credentials; passwords and tokens are never
+// logged.
+func auditPush(w http.ResponseWriter, r *http.Request, repo *Repo) (http.ResponseWriter, func()) {
+	out := auditLog
+	if out == nil {
+		return w, func() {}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, func() {
+		e := auditEntry{
+			Time:      time.Now().UTC(),
+			IP:        clientIP(r),
+			Repo:      strings.TrimPrefix(repo.GitHubRoot(), "github.com/"),
+			Service:   serviceReceivePack,
+			Status:    sw.status(),
+			RequestID: requestID(r.Context()),
+		}
+		if repo.SubPath == "/info/refs" {
+			e.Service = serviceInfoRefs
+		}
+		if id, ok := pushIdentity(r); ok {
+			e.Identity = id
+		} else if user, _, ok := r.BasicAuth(); ok {
+			e.Identity = user
+		}
+		switch {
+		case e.Status < 400:
+			e.Outcome = auditAccepted
+		case e.Status < 500:
+			e.Outcome = auditDenied
+		default:
+			e.Outcome = auditBackendError
+		}
+		line, _ := json.Marshal(e)
+		_, _ = out.Write(append(line, '\n'))
+	}
+}
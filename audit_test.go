@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) TestAuditPush(c *C) {
+	defer func() { auditLog = nil }()
+	var log bytes.Buffer
+	auditLog = &log
+	status := http.StatusOK
+	s.mux.HandleFunc("/go-aah/config/git-receive-pack", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	s.mux.HandleFunc("/go-aah/config.git/git-receive-pack", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	// The advertisement, refused without credentials.
+	rec := s.serve("GET", "/config.v1.git/info/refs?service=git-receive-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusUnauthorized)
+
+	push := func() {
+		req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+		req.RemoteAddr = "192.0.2.1:41234"
+		req.SetBasicAuth("ci", "token")
+		handler(httptest.NewRecorder(), req)
+	}
+	push()
+	status = http.StatusBadGateway
+	push()
+
+	// Fetches aren't pushes.
+	c.Assert(s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "").Code, Equals, http.StatusOK)
+
+	var entries []auditEntry
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(log.String(), "\n"), "\n") {
+		var e auditEntry
+		c.Assert(json.Unmarshal([]byte(line), &e), IsNil)
+		c.Assert(time.Since(e.Time) < time.Minute, Equals, true)
+		e.Time = time.Time{}
+		entries = append(entries, e)
+	}
+	c.Assert(entries, DeepEquals, []auditEntry{
+		{IP: "192.0.2.1", Repo: "go-aah/config", Service: serviceInfoRefs, Status: 401, Outcome: auditDenied},
+		{IP: "192.0.2.1", Identity: "ci", Repo: "go-aah/config", Service: serviceReceivePack, Status: 200, Outcome: auditAccepted},
+		{IP: "192.0.2.1", Identity: "ci", Repo: "go-aah/config", Service: serviceReceivePack, Status: 502, Outcome: auditBackendError},
+	})
+	c.Assert(log.String(), Not(Matches), "(?s).*token.*")
+}
+
+func (s *HandlerSuite) TestAuditPushForbidden(c *C) {
+	defer func() { auditLog = nil }()
+	defer func(policy string) { config().RepoPolicy = policy }(config().RepoPolicy)
+	var log bytes.Buffer
+	auditLog = &log
+	config().RepoPolicy = repoPolicyDenyAll
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+	req.SetBasicAuth("ci", "token")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(log.String(), Matches, `\{"time":".*","ip":"192.0.2.1","identity":"ci","repo":"go-aah/config","service":"receive-pack","status":403,"outcome":"denied"\}`+"\n")
+}
+
+func (s *AccessLogSuite) TestSetupAuditLog(c *C) {
+	defer func() { auditLog = nil }()
+	cfg := newConfig()
+	c.Assert(setupAuditLog(cfg), IsNil)
+	c.Assert(auditLog, IsNil)
+
+	cfg.PushAuditLog = filepath.Join(c.MkDir(), "audit.log")
+	c.Assert(setupAuditLog(cfg), IsNil)
+	_, err := auditLog.Write([]byte("line\n"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(cfg.PushAuditLog)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "line\n")
+
+	cfg.PushAuditLog = filepath.Join(c.MkDir(), "missing", "audit.log")
+	c.Assert(setupAuditLog(cfg), ErrorMatches, "cannot open push audit log: .*")
+}
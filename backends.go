@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Backend is a host other than config.BackendBaseURL that some of the
+// repositories are fetched from, a mirror or an internal GitHub
+// Enterprise host say.
+type Backend struct {
+	// Prefix selects the repositories of the backend: those whose
+	// "user/name" path starts with it, whatever the case, "corp/" for all
+	// of corp's or "go-aah/config" for a single one.
+	Prefix string `yaml:"prefix"`
+
+	// BaseURL is the absolute https URL of the backend, standing for
+	// https://github.com in the URLs of its repositories.
+	BaseURL string `yaml:"base_url"`
+
+	// TokenFile is the file holding the token the requests to the backend
+	// are authorized with, if any.
+	TokenFile string `yaml:"token_file"`
+}
+
+// backendTokens maps the backends of config.Backends with a TokenFile to
+// their token, as loaded by loadBackendTokens. They must never be logged.
+// Being keyed by the whole backend, base URL included, a token is only
+// ever sent to the host it was loaded for.
+var backendTokens map[Backend]string
+
+// loadBackendTokens returns the tokens of cfg.Backends, read from their
+// TokenFile, keyed by backend.
+func loadBackendTokens(cfg *Config) (map[Backend]string, error) {
+	tokens := make(map[Backend]string)
+	for _, b := range cfg.Backends {
+		if b.TokenFile == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(b.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read token of backend %q: %v", b.Prefix, err)
+		}
+		tokens[b] = strings.TrimSpace(string(data))
+	}
+	return tokens, nil
+}
+
+// backendFor returns the backend of config.Backends the "user/name"
+// repository is fetched from, the one with the longest matching prefix,
+// or nil if it is fetched from config.BackendBaseURL.
+func backendFor(repo string) *Backend {
+	var found *Backend
+	backends := config().Backends
+	for i, b := range backends {
+		if len(repo) >= len(b.Prefix) && strings.EqualFold(repo[:len(b.Prefix)], b.Prefix) {
+			if found == nil || len(b.Prefix) > len(found.Prefix) {
+				found = &backends[i]
+			}
+		}
+	}
+	return found
+}
+
+// baseURLFor returns the base URL of the backend the "user/name"
+// repository is fetched from.
+func baseURLFor(repo string) string {
+	if b := backendFor(repo); b != nil {
+		return b.BaseURL
+	}
+	return config().BackendBaseURL
+}
+
+// backendToken returns the token of the backend of config.Backends the
+// "user/name" repository is fetched from, if it has one.
+func backendToken(repo string) string {
+	if b := backendFor(repo); b != nil {
+		return backendTokens[*b]
+	}
+	return ""
+}
+
+// isBackendHost reports whether host is that of config.BackendBaseURL or
+// of one of config.Backends.
+func isBackendHost(host string) bool {
+	if u, err := url.Parse(config().BackendBaseURL); err == nil && strings.EqualFold(host, u.Host) {
+		return true
+	}
+	for _, b := range config().Backends {
+		if u, err := url.Parse(b.BaseURL); err == nil && strings.EqualFold(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// setBackendToken sets h, the headers of a request to target, to
+// authorize it with the token of the backend of config.Backends target
+// is within, if it has one. It reports whether target is within one of
+// config.Backends, whose requests never get the GitHub token.
+func setBackendToken(h http.Header, target string) bool {
+	for _, b := range config().Backends {
+		repo, ok := targetRepo(target, b.BaseURL)
+		if !ok {
+			continue
+		}
+		if rb := backendFor(repo); rb == nil || rb.Prefix != b.Prefix {
+			continue
+		}
+		if token := backendTokens[b]; token != "" {
+			h.Set("Authorization", "token "+token)
+		}
+		return true
+	}
+	return false
+}
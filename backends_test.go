@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) TestBackends(c *C) {
+	var mirrorAuth []string
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorAuth = append(mirrorAuth, r.URL.Path+" "+r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/go-aah/errors.git/info/refs":
+			_, _ = w.Write([]byte(reflines(
+				"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+				"00000000000000000000000000000000000hash1 refs/heads/master",
+				"00000000000000000000000000000000000hash2 refs/heads/v1",
+			)))
+		case "/go-aah/errors/git-upload-pack":
+			_, _ = w.Write([]byte("0008NAK\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer mirror.Close()
+	defer func(backends []Backend, tokens map[Backend]string, token string, repos []string) {
+		config().Backends, backendTokens, githubToken, config().PrivateRepos = backends, tokens, token, repos
+	}(config().Backends, backendTokens, githubToken, config().PrivateRepos)
+	config().Backends = []Backend{
+		{Prefix: "go-aah/err", BaseURL: mirror.URL},
+		{Prefix: "Go-Aah/Errors", BaseURL: mirror.URL + "/"},
+	}
+	backendTokens = map[Backend]string{config().Backends[1]: "mirror-secret"}
+	// Not sent to other backends.
+	githubToken = "secret"
+	config().PrivateRepos = []string{"go-aah/errors"}
+
+	rec := s.serve("POST", "/errors.v1/git-upload-pack", "0000")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(mirrorAuth, DeepEquals, []string{
+		"/go-aah/errors.git/info/refs token mirror-secret",
+		"/go-aah/errors/git-upload-pack token mirror-secret",
+	})
+
+	// Others stay with BackendBaseURL.
+	rec = s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 1)
+	c.Assert(mirrorAuth, HasLen, 2)
+}
+
+func (s *ConfigSuite) TestBackendFor(c *C) {
+	defer func(backends []Backend) { config().Backends = backends }(config().Backends)
+	config().Backends = []Backend{
+		{Prefix: "corp/", BaseURL: "https://git.corp.example.com"},
+		{Prefix: "corp/public-", BaseURL: "https://mirror.example.com"},
+	}
+	c.Assert(backendFor("go-aah/config"), IsNil)
+	c.Assert(baseURLFor("go-aah/config"), Equals, config().BackendBaseURL)
+	c.Assert(baseURLFor("Corp/tools"), Equals, "https://git.corp.example.com")
+	c.Assert(baseURLFor("corp/public-tools"), Equals, "https://mirror.example.com")
+	c.Assert(baseURLFor("corp"), Equals, config().BackendBaseURL)
+
+	c.Assert(isBackendHost("github.com"), Equals, true)
+	c.Assert(isBackendHost("GIT.corp.example.com"), Equals, true)
+	c.Assert(isBackendHost("evil.example.com"), Equals, false)
+	c.Assert(validateTarget("https://mirror.example.com/corp/public-tools"), IsNil)
+}
+
+func (s *ConfigSuite) TestLoadBackendTokens(c *C) {
+	cfg := newConfig()
+	cfg.Backends = []Backend{
+		{Prefix: "corp/", BaseURL: "https://git.corp.example.com", TokenFile: filepath.Join(c.MkDir(), "token")},
+		{Prefix: "mirror/", BaseURL: "https://mirror.example.com"},
+	}
+	_, err := loadBackendTokens(cfg)
+	c.Assert(err, ErrorMatches, `cannot read token of backend "corp/": .*`)
+	c.Assert(os.WriteFile(cfg.Backends[0].TokenFile, []byte("corp-token\n"), 0600), IsNil)
+	tokens, err := loadBackendTokens(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(tokens, DeepEquals, map[Backend]string{cfg.Backends[0]: "corp-token"})
+}
+
+func (s *ConfigSuite) TestBackendTokenPinned(c *C) {
+	defer func(backends []Backend, tokens map[Backend]string) {
+		config().Backends, backendTokens = backends, tokens
+	}(config().Backends, backendTokens)
+	loaded := Backend{Prefix: "corp/", BaseURL: "https://git.corp.example.com", TokenFile: "token"}
+	backendTokens = map[Backend]string{loaded: "corp-token"}
+
+	config().Backends = []Backend{loaded}
+	h := http.Header{}
+	c.Assert(setBackendToken(h, "https://git.corp.example.com/corp/tools/info/refs"), Equals, true)
+	c.Assert(h.Get("Authorization"), Equals, "token corp-token")
+
+	// The prefix moved to another host: the token stays with its own.
+	config().Backends = []Backend{{Prefix: "corp/", BaseURL: "https://evil.example.com", TokenFile: "token"}}
+	h = http.Header{}
+	c.Assert(setBackendToken(h, "https://evil.example.com/corp/tools/info/refs"), Equals, true)
+	c.Assert(h.Get("Authorization"), Equals, "")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of talking to GitHub while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("GitHub is failing, circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker stops requests to GitHub while it is down.
+//
+// It trips open after config.BreakerThreshold consecutive failures
+// happening within config.BreakerWindow. Requests are then rejected
+// until config.BreakerCooldown has passed, when a single probe request
+// is let through: the breaker closes again if it succeeds and reopens
+// otherwise.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failures
+	first    time.Time // time of the first of them
+	openedAt time.Time
+
+	now func() time.Time
+}
+
+var breaker = &circuitBreaker{now: time.Now}
+
+// allow reports whether a request may be sent to GitHub.
+func (b *circuitBreaker) allow() bool {
+	if config().BreakerThreshold == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Before(b.openedAt.Add(config().BreakerCooldown)) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A probe is in flight already.
+		return false
+	}
+	return true
+}
+
+// retryAfter returns how long until the breaker lets a request through.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(config().BreakerCooldown).Sub(b.now()); wait > 0 {
+			return wait
+		}
+	case breakerHalfOpen:
+		return config().BreakerCooldown
+	}
+	return 0
+}
+
+// record registers the outcome of a request allowed through.
+func (b *circuitBreaker) record(ok bool) {
+	if config().BreakerThreshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if ok {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = now
+		return
+	}
+	if b.failures == 0 || now.Sub(b.first) > config().BreakerWindow {
+		b.failures = 0
+		b.first = now
+	}
+	b.failures++
+	if b.failures >= config().BreakerThreshold {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = 0
+	}
+}
+
+// abandon registers that a request allowed through was given up before
+// GitHub answered, which tells nothing about GitHub: a probe then leaves
+// room for another one.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// sendCircuitOpen replies 503 to a request rejected by the breaker.
+func sendCircuitOpen(resp http.ResponseWriter) {
+	secs := int((breaker.retryAfter() + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(secs))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = resp.Write([]byte("GitHub is currently unavailable, try again later."))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BreakerSuite{})
+
+type BreakerSuite struct {
+	now time.Time
+	b   *circuitBreaker
+}
+
+func (s *BreakerSuite) SetUpTest(c *C) {
+	s.now = time.Date(2018, 3, 29, 0, 0, 0, 0, time.UTC)
+	s.b = &circuitBreaker{now: func() time.Time { return s.now }}
+}
+
+func (s *BreakerSuite) fail(n int) {
+	for i := 0; i < n; i++ {
+		if s.b.allow() {
+			s.b.record(false)
+		}
+	}
+}
+
+func (s *BreakerSuite) TestTrip(c *C) {
+	s.fail(config().BreakerThreshold - 1)
+	c.Assert(s.b.State(), Equals, breakerClosed)
+	c.Assert(s.b.allow(), Equals, true)
+	s.b.record(false)
+	c.Assert(s.b.State(), Equals, breakerOpen)
+	c.Assert(s.b.allow(), Equals, false)
+	c.Assert(s.b.retryAfter(), Equals, config().BreakerCooldown)
+}
+
+func (s *BreakerSuite) TestSuccessResets(c *C) {
+	s.fail(config().BreakerThreshold - 1)
+	c.Assert(s.b.allow(), Equals, true)
+	s.b.record(true)
+	s.fail(config().BreakerThreshold - 1)
+	c.Assert(s.b.State(), Equals, breakerClosed)
+}
+
+func (s *BreakerSuite) TestWindow(c *C) {
+	s.fail(config().BreakerThreshold - 1)
+	s.now = s.now.Add(config().BreakerWindow + time.Second)
+	s.fail(1)
+	c.Assert(s.b.State(), Equals, breakerClosed)
+}
+
+func (s *BreakerSuite) TestHalfOpen(c *C) {
+	s.fail(config().BreakerThreshold)
+	c.Assert(s.b.State(), Equals, breakerOpen)
+
+	s.now = s.now.Add(config().BreakerCooldown)
+	c.Assert(s.b.allow(), Equals, true)
+	c.Assert(s.b.State(), Equals, breakerHalfOpen)
+	c.Assert(s.b.allow(), Equals, false)
+
+	// Failed probe.
+	s.b.record(false)
+	c.Assert(s.b.State(), Equals, breakerOpen)
+	c.Assert(s.b.allow(), Equals, false)
+
+	// Successful probe.
+	s.now = s.now.Add(config().BreakerCooldown)
+	c.Assert(s.b.allow(), Equals, true)
+	s.b.record(true)
+	c.Assert(s.b.State(), Equals, breakerClosed)
+	c.Assert(s.b.allow(), Equals, true)
+}
+
+func (s *BreakerSuite) TestAbandonedProbe(c *C) {
+	s.fail(config().BreakerThreshold)
+	s.now = s.now.Add(config().BreakerCooldown)
+	c.Assert(s.b.allow(), Equals, true)
+	s.b.abandon()
+	c.Assert(s.b.State(), Equals, breakerOpen)
+	// Another probe goes right away.
+	c.Assert(s.b.allow(), Equals, true)
+	c.Assert(s.b.State(), Equals, breakerHalfOpen)
+}
+
+func (s *BreakerSuite) TestCanceledNotRecorded(c *C) {
+	defer func(b *circuitBreaker) { breaker = b }(breaker)
+	breaker = s.b
+	s.fail(config().BreakerThreshold - 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	req, err := http.NewRequestWithContext(ctx, "GET", backend.URL, nil)
+	c.Assert(err, IsNil)
+	_, err = doRetry(req)
+	c.Assert(err, NotNil)
+
+	// Not counted as a success resetting the failures: one more trips it.
+	s.fail(1)
+	c.Assert(s.b.State(), Equals, breakerOpen)
+}
+
+func (s *BreakerSuite) TestRedirectRefusedNotFailure(c *C) {
+	defer func(b *circuitBreaker) { breaker = b }(breaker)
+	breaker = s.b
+	defer func() { config().SameHostRedirects = false }()
+	config().SameHostRedirects = true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/aah/config/info/refs", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	for i := 0; i < config().BreakerThreshold; i++ {
+		req, err := http.NewRequest("GET", backend.URL+"/go-aah/config/info/refs", nil)
+		c.Assert(err, IsNil)
+		_, err = doRetry(req)
+		var moved *movedError
+		c.Assert(errors.As(err, &moved), Equals, true)
+	}
+	c.Assert(s.b.State(), Equals, breakerClosed)
+}
+
+func (s *BreakerSuite) TestDisabled(c *C) {
+	defer func(n int) { config().BreakerThreshold = n }(config().BreakerThreshold)
+	config().BreakerThreshold = 0
+	s.fail(100)
+	c.Assert(s.b.State(), Equals, breakerClosed)
+	c.Assert(s.b.allow(), Equals, true)
+}
+
+func (s *BreakerSuite) TestProxyWhileOpen(c *C) {
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backend.Close()
+
+	defer func(b *circuitBreaker) { breaker = b }(breaker)
+	breaker = s.b
+	s.fail(config().BreakerThreshold)
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(called, Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "10")
+}
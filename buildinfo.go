@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Details of the running build, set at link time with
+// -ldflags "-X main.buildVersion=... -X main.buildCommit=... -X main.buildDate=...".
+// The commit and date default to what the go command recorded from the
+// VCS when built within a checkout.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// BuildInfo is the build metadata served at /version.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go"`
+}
+
+// readBuildInfo returns the metadata of the running build.
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// serveVersion answers with the build metadata as JSON. Nothing else,
+// settings included, is disclosed.
+func serveVersion(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("Cache-Control", "no-cache")
+	_ = json.NewEncoder(resp).Encode(readBuildInfo())
+}
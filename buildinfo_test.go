@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BuildInfoSuite{})
+
+type BuildInfoSuite struct{}
+
+func (s *BuildInfoSuite) TestVersion(c *C) {
+	defer func(v, commit, date string) {
+		buildVersion, buildCommit, buildDate = v, commit, date
+	}(buildVersion, buildCommit, buildDate)
+	buildVersion, buildCommit, buildDate = "v1.2.3", "0123abc", "2026-10-14T10:00:00Z"
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/version", nil))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+
+	var info map[string]string
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &info), IsNil)
+	c.Assert(info, DeepEquals, map[string]string{
+		"version": "v1.2.3",
+		"commit":  "0123abc",
+		"date":    "2026-10-14T10:00:00Z",
+		"go":      runtime.Version(),
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Endpoints the caching headers of config.CacheHeaders are set for,
+// besides the git services proxied to GitHub.
+const (
+	endpointGoGet        = "go-get"
+	endpointModuleList   = "module-list"
+	endpointModuleLatest = "module-latest"
+	endpointModuleInfo   = "module-info"
+	endpointModuleMod    = "module-mod"
+	endpointModuleZip    = "module-zip"
+)
+
+var cacheEndpoints = []string{
+	serviceUploadPack, serviceReceivePack, serviceInfoRefs, serviceDumb,
+	endpointGoGet, endpointModuleList, endpointModuleLatest,
+	endpointModuleInfo, endpointModuleMod, endpointModuleZip,
+}
+
+// CacheHeaders holds the caching headers set on the successful responses
+// of an endpoint, for CDNs and other intermediaries. Empty headers are
+// left alone.
+type CacheHeaders struct {
+	CacheControl string `yaml:"cache_control"`
+	Vary         string `yaml:"vary"`
+
+	// Override replaces the headers coming with GitHub's responses,
+	// which are otherwise kept and only completed.
+	Override bool `yaml:"override"`
+}
+
+// immutable is the Cache-Control of module files, which never change
+// for a given version.
+const immutable = "public, max-age=31536000, immutable"
+
+// setCacheHeaders sets on h the caching headers configured for the
+// endpoint. Headers already in h, as copied from GitHub, are kept unless
+// configured to be overridden.
+func setCacheHeaders(h http.Header, endpoint string) {
+	ch, ok := config().CacheHeaders[endpoint]
+	if !ok {
+		return
+	}
+	set := func(key, value string) {
+		if value != "" && (ch.Override || h.Get(key) == "") {
+			h.Set(key, value)
+		}
+	}
+	set("Cache-Control", ch.CacheControl)
+	set("Vary", ch.Vary)
+}
+
+// checkNotModified sets the Last-Modified of the response to w to
+// modified, unless it is zero, and replies 304 Not Modified when r asks
+// with If-Modified-Since for changes after a time no earlier than it. It
+// reports whether it did. Requests with If-None-Match are left to the
+// ETag, as RFC 7232 wants.
+func checkNotModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if r.Method != "GET" && r.Method != "HEAD" || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
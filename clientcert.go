@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+)
+
+// pushIdentity returns the identity config.PushClients maps the common
+// name of the verified client certificate of r to, if any.
+func pushIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	id, ok := config().PushClients[cn]
+	return id, ok
+}
+
+// pushCertRequired is set at startup once the CAs of
+// config.PushClientCAFile are loaded into the HTTPS server, so that no
+// reload may turn the check off while it runs.
+var pushCertRequired bool
+
+// requirePushCert replies 403 when client certificates are required of
+// pushes, see pushCertRequired, and r brings none known to
+// config.PushClients, and reports whether the push may go on.
+func requirePushCert(w http.ResponseWriter, r *http.Request) bool {
+	if !pushCertRequired {
+		return true
+	}
+	id, ok := pushIdentity(r)
+	if !ok {
+		logger.WarnContext(r.Context(), "push refused without a known client certificate", "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("Pushes require a client certificate signed by the configured CA."))
+		return false
+	}
+	logger.InfoContext(r.Context(), "push by client certificate", "identity", id, "path", r.URL.Path)
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ClientCertSuite{})
+
+type ClientCertSuite struct{}
+
+func (s *ClientCertSuite) TearDownTest(c *C) {
+	pushCertRequired, config().PushClients = false, nil
+}
+
+// withClientCert returns r as received over TLS with a verified client
+// certificate of common name cn.
+func withClientCert(r *http.Request, cn string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func (s *ClientCertSuite) TestNotRequired(c *C) {
+	rec := httptest.NewRecorder()
+	c.Assert(requirePushCert(rec, httptest.NewRequest("GET", "/", nil)), Equals, true)
+}
+
+func (s *ClientCertSuite) TestRequirePushCert(c *C) {
+	pushCertRequired = true
+	config().PushClients = map[string]string{"ci.example.com": "ci"}
+
+	rec := httptest.NewRecorder()
+	c.Assert(requirePushCert(rec, httptest.NewRequest("POST", "/config.v1/git-receive-pack", nil)), Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+
+	rec = httptest.NewRecorder()
+	req := withClientCert(httptest.NewRequest("POST", "/config.v1/git-receive-pack", nil), "other.example.com")
+	c.Assert(requirePushCert(rec, req), Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+
+	req = withClientCert(httptest.NewRequest("POST", "/config.v1/git-receive-pack", nil), "ci.example.com")
+	id, ok := pushIdentity(req)
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, "ci")
+	c.Assert(requirePushCert(httptest.NewRecorder(), req), Equals, true)
+}
+
+func (s *ClientCertSuite) TestRequiredAfterReload(c *C) {
+	// The CA file going from the config doesn't turn the check off.
+	pushCertRequired = true
+	config().PushClientCAFile = ""
+	rec := httptest.NewRecorder()
+	c.Assert(requirePushCert(rec, httptest.NewRequest("POST", "/config.v1/git-receive-pack", nil)), Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+}
+
+func (s *ClientCertSuite) TestReceivePackRefused(c *C) {
+	pushCertRequired = true
+	config().PushClients = map[string]string{"ci.example.com": "ci"}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("push forwarded to GitHub")
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+	req.Header.Set("Authorization", "Basic dXNlcjp0b2tlbg==")
+	rec := httptest.NewRecorder()
+	proxyGitReceivePack(rec, req, backend.URL+"/go-aah/config/git-receive-pack")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+}
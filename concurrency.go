@@ -0,0 +1,64 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// busyRetryAfter is the Retry-After of requests refused for lack of a
+// proxy slot.
+const busyRetryAfter = 5 * time.Second
+
+// proxySlots bounds the number of requests proxied to GitHub at once to
+// config.MaxConcurrentProxies. The requests in progress are also what
+// the gopkg_proxy_requests_in_flight gauge reports.
+type proxySlots struct {
+	mu    sync.Mutex
+	inUse int
+}
+
+var slots = &proxySlots{}
+
+// acquire takes a slot and reports whether there was any left. Every
+// successful acquire must be followed by a release.
+func (ps *proxySlots) acquire() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if max := config().MaxConcurrentProxies; max > 0 && ps.inUse >= max {
+		return false
+	}
+	ps.inUse++
+	return true
+}
+
+// release gives back a slot taken with acquire.
+func (ps *proxySlots) release() {
+	ps.mu.Lock()
+	ps.inUse--
+	ps.mu.Unlock()
+}
+
+// inFlight returns the number of slots in use, that is of requests being
+// proxied to GitHub.
+func (ps *proxySlots) inFlight() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.inUse
+}
+
+func init() {
+	// Served at /debug/vars on the admin listener, next to the limit,
+	// to help tune it.
+	expvar.Publish("proxy_requests_in_flight", expvar.Func(func() interface{} { return slots.inFlight() }))
+	expvar.Publish("proxy_requests_max", expvar.Func(func() interface{} { return config().MaxConcurrentProxies }))
+}
+
+// sendBusy replies 503 to a request refused for lack of a proxy slot.
+func sendBusy(resp http.ResponseWriter) {
+	resp.Header().Set("Retry-After", strconv.Itoa(int(busyRetryAfter/time.Second)))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = resp.Write([]byte("Too many requests in progress, try again later."))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ConcurrencySuite{})
+
+type ConcurrencySuite struct{}
+
+func (s *ConcurrencySuite) TestSlots(c *C) {
+	defer func(max int) { config().MaxConcurrentProxies = max }(config().MaxConcurrentProxies)
+	ps := &proxySlots{}
+
+	config().MaxConcurrentProxies = 0
+	for i := 0; i < 100; i++ {
+		c.Assert(ps.acquire(), Equals, true)
+	}
+
+	ps = &proxySlots{}
+	config().MaxConcurrentProxies = 2
+	c.Assert(ps.acquire(), Equals, true)
+	c.Assert(ps.acquire(), Equals, true)
+	c.Assert(ps.acquire(), Equals, false)
+	ps.release()
+	c.Assert(ps.acquire(), Equals, true)
+}
+
+// panicWriter panics when the response headers are written.
+type panicWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (panicWriter) WriteHeader(int) { panic("write failed") }
+
+func (s *ProxySuite) TestProxyBusy(c *C) {
+	defer func(max int) { config().MaxConcurrentProxies = max }(config().MaxConcurrentProxies)
+	defer func(ps *proxySlots) { slots = ps }(slots)
+	slots = &proxySlots{}
+	config().MaxConcurrentProxies = 1
+
+	started, done := make(chan bool), make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- true:
+		default:
+		}
+		<-done
+		_, _ = w.Write([]byte("0008NAK\n"))
+	}))
+	defer backend.Close()
+
+	first := httptest.NewRecorder()
+	finished := make(chan bool)
+	go func() {
+		req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+		proxyGitUploadPack(first, req, backend.URL+"/go-aah/config/git-upload-pack")
+		finished <- true
+	}()
+	<-started
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "5")
+
+	close(done)
+	<-finished
+	c.Assert(first.Code, Equals, http.StatusOK)
+
+	// The slot is back, even after a panic.
+	req = httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	c.Assert(func() {
+		proxyGitUploadPack(panicWriter{httptest.NewRecorder()}, req, backend.URL+"/go-aah/config/git-upload-pack")
+	}, PanicMatches, "write failed")
+	c.Assert(slots.inUse, Equals, 0)
+}
+
+// brokenWriter fails every write of the response body, as when the
+// client went away.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write([]byte) (int, error) { return 0, syscall.EPIPE }
+
+func (s *ProxySuite) TestProxyInFlight(c *C) {
+	defer func(m Metrics, ps *proxySlots) { metrics, slots = m, ps }(metrics, slots)
+	m := newPromMetrics(prometheus.NewRegistry())
+	metrics, slots = m, &proxySlots{}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(slots.inFlight(), Equals, 1)
+		c.Check(testutil.ToFloat64(m.inFlight.WithLabelValues(serviceUploadPack)), Equals, 1.0)
+		_, _ = w.Write([]byte(strings.Repeat("PACK", 1000)))
+	}))
+	defer backend.Close()
+
+	// Back to zero even when the copy to the client fails.
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	proxyGitUploadPack(brokenWriter{httptest.NewRecorder()}, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(slots.inFlight(), Equals, 0)
+	c.Assert(testutil.ToFloat64(m.inFlight.WithLabelValues(serviceUploadPack)), Equals, 0.0)
+	c.Assert(testutil.ToFloat64(m.requests.WithLabelValues(serviceUploadPack)), Equals, 1.0)
+}
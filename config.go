@@ -0,0 +1,904 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultCopyBufferSize = 32 * 1024
+	minCopyBufferSize     = 4 * 1024
+	defaultProxyTimeout   = 60 * time.Second
+	defaultRetryAttempts  = 3
+	defaultMaxRedirects   = 2
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRefsCacheTTL   = 10 * time.Second
+	defaultRefsCacheSize  = 32 << 20
+
+	defaultNotFoundCacheTTL = 60 * time.Second
+	defaultGitHubQuotaWarn  = 100
+
+	defaultLogSampleFirst    = 100
+	defaultLogSampleInterval = time.Second
+
+	defaultBreakerThreshold = 5
+	defaultBreakerWindow    = 30 * time.Second
+	defaultBreakerCooldown  = 10 * time.Second
+
+	defaultMaxRequestBodySize = 50 << 20
+	defaultFlushInterval      = time.Second
+	defaultWriteIdleTimeout   = 60 * time.Second
+	defaultMaxResponseHeader  = 1 << 20
+	defaultShutdownTimeout    = 30 * time.Second
+	defaultRateBurst          = 20
+	defaultModuleCacheMaxSize = 10 << 30
+
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	defaultMaintenanceMessage    = "Down for maintenance, try again later."
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+
+	defaultRefsDiskCacheTTL     = time.Hour
+	defaultRefsDiskCacheMaxSize = 256 << 20
+
+	defaultWarmTimeout = 30 * time.Second
+	defaultWarmWorkers = 4
+
+	defaultStatsDAddr       = "localhost:8125"
+	defaultStatsDSampleRate = 1.0
+)
+
+// Config holds the tunables of the GitHub proxy.
+type Config struct {
+	// LogFormat is the format of the log, "text" (default) or "json".
+	LogFormat string `yaml:"log_format"`
+
+	// LogLevel is the lowest level logged, one of "debug", "info"
+	// (default), "warn" and "error".
+	LogLevel string `yaml:"log_level"`
+
+	// AccessLog is where requests are logged once answered, in the
+	// Apache combined log format with the time taken appended: "-" for
+	// standard output, or else the path of a file appended to. Access
+	// logging is disabled when empty, the default.
+	AccessLog string `yaml:"access_log"`
+
+	// PushAuditLog is where push attempts are logged, one JSON object per
+	// line with the time, client IP, identity, repository, status and
+	// outcome, "accepted", "denied" or "backend-error", of each
+	// receive-pack advertisement and push, refused ones included: "-" for
+	// standard output, or else the path of a file appended to. It is
+	// disabled when empty, the default.
+	PushAuditLog string `yaml:"push_audit_log"`
+
+	// SlowRequestThreshold, when positive, is how long a request may take
+	// before it is logged as slow, with a warning giving its repository,
+	// duration, status and response size, whether access logging is on or
+	// off. It is zero, disabled, by default.
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"`
+
+	// LogSampleFirst and LogSampleInterval bound how often the errors
+	// repeated on every request while GitHub fails, those of proxied
+	// requests and response copies, are logged: only the first
+	// LogSampleFirst of each per LogSampleInterval are, followed by a
+	// warning counting those left out once the interval is over. They
+	// default to 100 per second; zero for either logs them all.
+	LogSampleFirst    int           `yaml:"log_sample_first"`
+	LogSampleInterval time.Duration `yaml:"log_sample_interval"`
+
+	// RedactHeaders and RedactParams are the headers and query parameters
+	// whose values are replaced by "***" in the logs and access log, so
+	// that credentials don't end up there. They default to Authorization,
+	// Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key, and to
+	// access_token and token.
+	RedactHeaders []string `yaml:"redact_headers"`
+	RedactParams  []string `yaml:"redact_params"`
+
+	// TracingExporter is where OpenTelemetry traces of the requests
+	// served go: "stdout" prints them to standard error and "otlp" sends
+	// them to the collector set in the standard OTEL_EXPORTER_OTLP_*
+	// environment variables. Tracing is disabled when empty, the default.
+	TracingExporter string `yaml:"tracing_exporter"`
+
+	// MetricsBackend is where metrics go: "prometheus", the default,
+	// serves them at /metrics, "statsd" sends them to StatsDAddr in the
+	// DogStatsD format, and "none" drops them.
+	MetricsBackend string `yaml:"metrics_backend"`
+
+	// StatsDAddr is the UDP address of the StatsD agent, localhost:8125
+	// by default. StatsDSampleRate is the fraction of the counts and
+	// timings sent, 1 by default, for the agent to scale back up; gauges
+	// are always sent.
+	StatsDAddr       string  `yaml:"statsd_addr"`
+	StatsDSampleRate float64 `yaml:"statsd_sample_rate"`
+
+	// ShutdownTimeout is how long requests in progress are waited for on
+	// SIGTERM or SIGINT before they are cut off. It defaults to 30s.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// TLSCertFile and TLSKeyFile are the PEM files with the certificate,
+	// chain included, and the private key the HTTPS server is run with.
+	// They are set with -cert and -key.
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+
+	// ACMECacheDir, set with -acme, is the directory certificates
+	// requested from Let's Encrypt are kept in, for the HTTPS server to
+	// get them there instead of from TLSCertFile and TLSKeyFile. They are
+	// only requested for ACMEHosts, with ACMEEmail as the contact address
+	// of the account.
+	ACMECacheDir string   `yaml:"acme_cache_dir"`
+	ACMEHosts    []string `yaml:"acme_hosts"`
+	ACMEEmail    string   `yaml:"acme_email"`
+
+	// HSTSMaxAge, when positive, is the max-age of the
+	// Strict-Transport-Security header set on responses to requests made
+	// over HTTPS, asking browsers and other clients to only use HTTPS for
+	// that long. HSTSIncludeSubDomains and HSTSPreload add the directives
+	// of the same names. It is zero by default, as a policy once seen
+	// can't be taken back until it expires.
+	HSTSMaxAge            time.Duration `yaml:"hsts_max_age"`
+	HSTSIncludeSubDomains bool          `yaml:"hsts_include_subdomains"`
+	HSTSPreload           bool          `yaml:"hsts_preload"`
+
+	// PushClientCAFile, when set, is the PEM file of the CA certificates
+	// signing the client certificates pushes must be made with over
+	// HTTPS. Pushes, and their ref advertisements, are then refused with
+	// 403 Forbidden unless they come with such a certificate whose common
+	// name is one of PushClients, which maps it to the identity the push
+	// is logged under. The GitHub credentials of the push are still
+	// required. Fetches stay anonymous, and certificates are asked for but
+	// not required from their clients; pushes over plain HTTP, from
+	// behind a TLS terminating proxy among others, are always refused.
+	PushClientCAFile string            `yaml:"push_client_ca_file"`
+	PushClients      map[string]string `yaml:"push_clients"`
+
+	// PushNetworks, when set, lists the only networks pushes are accepted
+	// from, those of the CI runners and offices say, whatever their
+	// credentials; others are refused with 403 Forbidden. The client IP is
+	// found as described for TrustedHops. Fetches are left open.
+	PushNetworks []netip.Prefix `yaml:"push_networks"`
+
+	// BackendBaseURL is the absolute HTTPS URL of the GitHub instance
+	// repositories are fetched from, https://github.com by default. It is
+	// meant to point the proxy at a GitHub Enterprise host. As the GitHub
+	// token read on startup is sent there, changes need a restart.
+	BackendBaseURL string `yaml:"backend_base_url"`
+
+	// AllowPrivateBackend lets BackendBaseURL be localhost or a loopback,
+	// private or link-local address, as may be the case of a GitHub
+	// Enterprise host on an internal network. It is unset by default so
+	// that no request can be proxied to internal services.
+	AllowPrivateBackend bool `yaml:"allow_private_backend"`
+
+	// MaxRedirects bounds the redirects of GitHub followed for a request,
+	// renamed repositories mostly, so that loops fail fast with 502 Bad
+	// Gateway. It defaults to 2; zero follows none. SameHostRedirects
+	// refuses redirects of GET and HEAD requests to hosts other than the
+	// one they were sent to, as is always done for other requests.
+	MaxRedirects      int  `yaml:"max_redirects"`
+	SameHostRedirects bool `yaml:"same_host_redirects"`
+
+	// Backends routes some repositories to hosts other than
+	// BackendBaseURL, each with their own token, by prefix of their
+	// "user/name" path; the longest matching prefix wins. Repositories
+	// matching none are fetched from BackendBaseURL. As the tokens are
+	// read on startup, changes need a restart.
+	Backends []Backend `yaml:"backends"`
+
+	// RepoPolicy decides which GitHub repositories are proxied: with
+	// "allow-all", the default, any of them; with "deny-all", only those
+	// matching one of AllowedRepos, and requests for others are refused
+	// with 403 Forbidden. AllowedRepos holds "user/name" repositories or
+	// path.Match patterns of them, "go-aah/*" for all of aah's.
+	RepoPolicy   string   `yaml:"repo_policy"`
+	AllowedRepos []string `yaml:"allowed_repos"`
+
+	// PrivateRepos lists the GitHub repositories, as "user/name", that
+	// are fetched with the GitHub token read from GitHubTokenFile, or from
+	// the GITHUB_TOKEN environment variable when that's unset. The token
+	// is sent along with the refs and upload-pack requests for them, so
+	// anyone able to reach the proxy may clone these repositories.
+	PrivateRepos    []string `yaml:"private_repos"`
+	GitHubTokenFile string   `yaml:"github_token_file"`
+
+	// CopyBufferSize is the size in bytes of the buffer used to stream
+	// response bodies from GitHub to the client. Larger buffers mean fewer
+	// read and write calls on fast links at the cost of memory held by
+	// every transfer in progress; smaller ones suit memory constrained
+	// deployments. It must be at least 4KB and defaults to 32KB.
+	CopyBufferSize int `yaml:"copy_buffer_size"`
+
+	// FlushInterval is the longest data streamed from GitHub may wait in
+	// the response buffers before it is flushed to the client, so that git
+	// shows progress and idle connections aren't dropped by intermediaries
+	// during long clones. It defaults to 1s; a negative value flushes after
+	// every write and zero leaves flushing to net/http.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// WriteIdleTimeout cuts off clients that stop reading the responses
+	// streamed from GitHub, a packfile mostly: every write to the client
+	// must complete within it, or the connection is closed, freeing the
+	// GitHub connection too. Clients reading slowly but steadily are never
+	// cut off, however long the transfer, as the deadline moves with each
+	// write. It defaults to 60s; zero leaves streamed responses to the
+	// 20s write timeout of the server.
+	WriteIdleTimeout time.Duration `yaml:"write_idle_timeout"`
+
+	// MaxResponseHeaderBytes bounds the size in bytes of the headers of a
+	// GitHub response, status line included, as read by the HTTP client.
+	// Responses with more are cut off and answered 502 Bad Gateway. It
+	// defaults to 1MB, far beyond the few KB GitHub sends; zero leaves the
+	// 10MB limit of net/http.
+	MaxResponseHeaderBytes int `yaml:"max_response_header_bytes"`
+
+	// ProxyTimeout bounds a whole proxied exchange with GitHub, from
+	// sending the request to streaming the last byte of the response.
+	// Requests that don't get the response headers in time fail with
+	// 504 Gateway Timeout. Clones of very large repositories may need
+	// more than the 60s default; zero disables the timeout.
+	ProxyTimeout time.Duration `yaml:"proxy_timeout"`
+
+	// MaxConcurrentProxies bounds the number of requests proxied to GitHub
+	// at once, clones mostly. Requests beyond it are answered 503 Service
+	// Unavailable with a Retry-After, rather than piling up and running
+	// out of memory or file descriptors. Zero, the default, means no
+	// limit.
+	MaxConcurrentProxies int `yaml:"max_concurrent_proxies"`
+
+	// RepoConcurrency bounds the number of requests proxied to GitHub at
+	// once for a single repository, so that a hot one can't take all of
+	// MaxConcurrentProxies. It maps "user/name" repositories or path.Match
+	// patterns of them to the limit of each repository they match; when
+	// several match, the longest pattern wins. Requests beyond it are
+	// answered 503 Service Unavailable with a Retry-After while those for
+	// other repositories go on. Repositories matching none have no limit
+	// of their own.
+	RepoConcurrency map[string]int `yaml:"repo_concurrency"`
+
+	// RetryAttempts is the number of times a request without a body is
+	// sent to GitHub while it answers 502 or 503. It defaults to 3; one
+	// disables retrying.
+	RetryAttempts int `yaml:"retry_attempts"`
+
+	// RetryBaseDelay is the delay before the first retry, doubled for
+	// every following one. It defaults to 100ms.
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"`
+
+	// RefsCacheTTL is how long the refs of a repository fetched from
+	// GitHub are reused for before being fetched again, which is also
+	// how long new tags and pushes not made through the proxy may take to
+	// be seen. It defaults to 10s; zero disables caching. Clients may ask
+	// for fresh refs with Cache-Control: no-cache.
+	RefsCacheTTL time.Duration `yaml:"refs_cache_ttl"`
+
+	// RefsCacheSize is the size in bytes the cached refs may take. The
+	// least recently used ones are dropped beyond it, and the refs of
+	// repositories taking over a quarter of it aren't cached. It defaults
+	// to 32MB.
+	RefsCacheSize int64 `yaml:"refs_cache_size"`
+
+	// RefsDiskCacheDir, when set, is the directory the refs fetched from
+	// GitHub are also kept in, so that they outlive restarts, and with
+	// them the module versions listed from them. They are used for
+	// RefsDiskCacheTTL, 1h by default, once out of the memory cache: as
+	// they are when GitHub gave no ETag with them, and otherwise once
+	// GitHub confirms they haven't changed. The least recently fetched
+	// are removed beyond RefsDiskCacheMaxSize bytes, 256MB by default.
+	RefsDiskCacheDir     string        `yaml:"refs_disk_cache_dir"`
+	RefsDiskCacheTTL     time.Duration `yaml:"refs_disk_cache_ttl"`
+	RefsDiskCacheMaxSize int64         `yaml:"refs_disk_cache_max_size"`
+
+	// WarmRepos are the repositories, as "user/name", whose refs are
+	// fetched on startup, before clients ask, so that the first clones
+	// after a deploy find them cached, and connections to GitHub open.
+	// /readyz fails until they are, or until WarmTimeout, 30s by default,
+	// has passed. WarmWorkers, 4 by default, bounds the fetches made at
+	// once. Warming is only worth it with a RefsCacheTTL longer than the
+	// warm-up itself.
+	WarmRepos   []string      `yaml:"warm_repos"`
+	WarmTimeout time.Duration `yaml:"warm_timeout"`
+	WarmWorkers int           `yaml:"warm_workers"`
+
+	// NotFoundCacheTTL is how long repositories GitHub says don't exist
+	// are answered 404 without asking GitHub again, which is also how long
+	// a new repository may take to be served. It defaults to 60s; zero
+	// disables caching. Clients may bypass it with Cache-Control:
+	// no-cache.
+	NotFoundCacheTTL time.Duration `yaml:"not_found_cache_ttl"`
+
+	// GitHubQuotaWarn is the number of requests left in GitHub's rate
+	// limit below which a warning is logged, once per rate limit window.
+	// The remaining requests are also reported to the metrics. It
+	// defaults to 100; zero disables the warning.
+	GitHubQuotaWarn int `yaml:"github_quota_warn"`
+
+	// BreakerThreshold is the number of consecutive failures talking to
+	// GitHub, within BreakerWindow, that trips the circuit breaker open.
+	// While open, requests are answered 503 right away for BreakerCooldown,
+	// after which a single probe request decides whether to close it again.
+	// Defaults are 5 failures within 30s and a 10s cooldown; a zero
+	// threshold disables the breaker.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerWindow    time.Duration `yaml:"breaker_window"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// MaxRequestBodySize limits the size in bytes of the bodies of proxied
+	// POST requests, beyond which they are refused with 413 Request Entity
+	// Too Large. Fetch negotiations for repositories with many refs can be
+	// a few megabytes; the default is 50MB and zero removes the limit.
+	MaxRequestBodySize int64 `yaml:"max_request_body_size"`
+
+	// UserAgent identifies the proxy to GitHub in the User-Agent header of
+	// the requests sent there. It defaults to
+	// "gopkg-git-proxy/<version> (+https://github.com/go-aah/gopkg)".
+	UserAgent string `yaml:"user_agent"`
+
+	// ForwardUserAgent appends the User-Agent of the client, git/2.x for
+	// instance, to UserAgent on proxied requests. It is set by default.
+	ForwardUserAgent bool `yaml:"forward_user_agent"`
+
+	// ViaPseudonym names the proxy in the Via header added to the
+	// responses proxied from GitHub, after any GitHub sent, as in
+	// "Via: 1.1 gopkg-proxy". It must be a single token and defaults to
+	// "gopkg-proxy"; empty leaves Via as GitHub sent it.
+	ViaPseudonym string `yaml:"via_pseudonym"`
+
+	// TrustedHops is the number of proxies, load balancers and the like in
+	// front of this one whose X-Forwarded-For and Forwarded entries are
+	// trusted. That many entries, the last ones, are kept from the incoming
+	// headers and the rest are dropped as they could be made up by the
+	// client. It defaults to zero, for a proxy facing clients directly.
+	TrustedHops int `yaml:"trusted_hops"`
+
+	// RateLimit is the number of proxied requests, git and module proxy
+	// ones, per second each client IP may sustain, with bursts of up to
+	// RateBurst requests; go get pages and health checks are not limited.
+	// Clients over it are answered 429 Too Many Requests. The client IP is
+	// found as described for TrustedHops, which must be set right when the
+	// proxy sits behind a load balancer for clients to be told apart.
+	// Zero, the default, disables the limit.
+	RateLimit float64 `yaml:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst"`
+
+	// RateLimitExempt lists the networks, internal ones for instance,
+	// whose clients aren't rate limited.
+	RateLimitExempt []netip.Prefix `yaml:"rate_limit_exempt"`
+
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle connections to
+	// GitHub kept around for reuse, in total and per host; zero means no
+	// limit. IdleConnTimeout is how long an idle connection is kept. The
+	// defaults, 100, 100 and 90s, suit a busy proxy talking to a single
+	// host; the per host limit of net/http, 2, would mean a new connection
+	// for most concurrent clones.
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+
+	// GoSource maps GitHub repositories, as "user/name", to the URL
+	// templates of the go-source meta tag served for them, for those whose
+	// code isn't browsed at the usual GitHub URLs. Other repositories use
+	// defaultGoSource.
+	GoSource map[string]GoSource `yaml:"go_source"`
+
+	// LandingPage is the path of an html/template file replacing the
+	// page served to browsers at the root, which describes the service.
+	// It is executed with the domain name as .Domain. The page embedded in
+	// the binary is served when empty, the default.
+	LandingPage string `yaml:"landing_page"`
+
+	// CacheHeaders maps endpoints to the caching headers set on their
+	// successful responses. Endpoints are the proxied git services,
+	// "upload-pack", "receive-pack" and "info-refs", the go-get pages,
+	// "go-get", and the GOPROXY endpoints, "module-list", "module-latest",
+	// "module-info", "module-mod" and "module-zip". By default module files
+	// are cached for good, version lists and go-get pages for a minute.
+	CacheHeaders map[string]CacheHeaders `yaml:"cache_headers"`
+
+	// ResponseHeaders are set on every response, X-Content-Type-Options:
+	// nosniff or Referrer-Policy for instance. Headers the response has
+	// already, as set by the proxy or copied from GitHub, are kept unless
+	// OverrideResponseHeaders is set.
+	ResponseHeaders         map[string]string `yaml:"response_headers"`
+	OverrideResponseHeaders bool              `yaml:"override_response_headers"`
+
+	// HopHeaders are headers stripped, besides the standard hop-by-hop
+	// ones, from the requests sent to GitHub and from its responses, as
+	// the connection specific headers set by proxies in front of this
+	// one.
+	HopHeaders []string `yaml:"hop_headers"`
+
+	// ModuleCacheDir is the directory module zips built for the GOPROXY
+	// endpoints are kept in. It defaults to gopkg-modules in the temporary
+	// directory of the system.
+	ModuleCacheDir string `yaml:"module_cache_dir"`
+
+	// ModuleCacheMaxSize is the size in bytes the zips in ModuleCacheDir
+	// may take, beyond which the least recently used ones are removed in
+	// the background. It defaults to 10GB; zero removes the limit.
+	ModuleCacheMaxSize int64 `yaml:"module_cache_max_size"`
+
+	// ModuleCacheTargetSize is the size in bytes the zips in
+	// ModuleCacheDir are brought down to once over ModuleCacheMaxSize, so
+	// that the cache isn't swept again on every new zip. Zero stands for
+	// 80% of ModuleCacheMaxSize.
+	ModuleCacheTargetSize int64 `yaml:"module_cache_target_size"`
+
+	// DisableHTTP2 keeps connections to GitHub on HTTP/1.1. By default
+	// HTTP/2 is used when GitHub offers it.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+
+	// UpstreamProxy is the URL of the proxy requests to GitHub go through,
+	// http://proxy.example.com:3128 for instance, for hosts whose egress
+	// is only through one. It overrides the HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY environment variables, which are honored otherwise, for the
+	// git commands building module zips too.
+	UpstreamProxy string `yaml:"upstream_proxy"`
+
+	// AdminAddr is the address of the admin listener, localhost:6060 for
+	// instance, serving what must stay off the public one: with
+	// EnablePprof, the expvar JSON at /debug/vars, with the requests being
+	// proxied and the counts of requests, bytes, backend errors and cache
+	// lookups whatever MetricsBackend, and the pprof profiles. It is off
+	// by default.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// EnablePprof serves the profiles of net/http/pprof under
+	// /debug/pprof/ on the admin listener, which it requires, along with
+	// the expvar JSON at /debug/vars and the configuration in use at
+	// /debug/config, the paths of certificates and tokens masked. The
+	// profiles give away the command line, the code and what is in
+	// memory, and CPU profiles and traces slow the proxy down while they
+	// run, so the admin listener must only be reachable by the operators:
+	// bound to localhost or an internal network, never exposed through
+	// the load balancer.
+	EnablePprof bool `yaml:"enable_pprof"`
+
+	// Maintenance turns on maintenance mode, in which every request but
+	// the health checks, the version and the metrics is answered 503
+	// Service Unavailable with MaintenanceMessage, and a Retry-After of
+	// MaintenanceRetryAfter unless zero. It is meant to be flipped by
+	// reloading the configuration with SIGHUP, around planned GitHub
+	// maintenance or our own deploys. The defaults are "Down for
+	// maintenance, try again later." and 5m.
+	Maintenance           bool          `yaml:"maintenance"`
+	MaintenanceMessage    string        `yaml:"maintenance_message"`
+	MaintenanceRetryAfter time.Duration `yaml:"maintenance_retry_after"`
+}
+
+// GoSource holds the URL templates of a go-source meta tag, which godoc
+// and pkg.go.dev read to link to the code of a package. In them, {repo}
+// is replaced with the https URL of the repository at GitHub and {ref}
+// with the branch or tag served, while {dir}, {/dir}, {file} and {line}
+// are left for the tools to fill in.
+type GoSource struct {
+	// Home is the URL of the repository home page, "_" for none.
+	Home string `yaml:"home"`
+	// Dir is the URL of a directory listing.
+	Dir string `yaml:"dir"`
+	// File is the URL of a line in a file.
+	File string `yaml:"file"`
+}
+
+var defaultGoSource = GoSource{
+	Home: "_",
+	Dir:  "{repo}/tree/{ref}{/dir}",
+	File: "{repo}/blob/{ref}{/dir}/{file}#L{line}",
+}
+
+// liveConfig holds the configuration in use, swapped as a whole when
+// reloaded.
+var liveConfig atomic.Pointer[Config]
+
+func init() {
+	liveConfig.Store(newConfig())
+}
+
+// config returns the configuration in use. It is looked up anew every
+// time, so that a reload is seen by the requests that follow, and even
+// by those in progress for the settings they haven't read yet.
+func config() *Config {
+	return liveConfig.Load()
+}
+
+// newConfig returns a Config holding the default settings.
+func newConfig() *Config {
+	return &Config{
+		LogFormat:       "text",
+		LogLevel:        "info",
+		ShutdownTimeout: defaultShutdownTimeout,
+		BackendBaseURL:  "https://github.com",
+		RepoPolicy:      repoPolicyAllowAll,
+
+		LogSampleFirst:    defaultLogSampleFirst,
+		LogSampleInterval: defaultLogSampleInterval,
+
+		MetricsBackend:   metricsPrometheus,
+		StatsDAddr:       defaultStatsDAddr,
+		StatsDSampleRate: defaultStatsDSampleRate,
+
+		ACMEHosts: []string{
+			"localhost",
+			"gopkg.in",
+			"p1.gopkg.in",
+			"p2.gopkg.in",
+			"p3.gopkg.in",
+			"mup.labix.org",
+		},
+		ACMEEmail: "gustavo@niemeyer.net",
+
+		RedactHeaders: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"},
+		RedactParams:  []string{"access_token", "token"},
+
+		CopyBufferSize:   defaultCopyBufferSize,
+		FlushInterval:    defaultFlushInterval,
+		WriteIdleTimeout: defaultWriteIdleTimeout,
+		ProxyTimeout:     defaultProxyTimeout,
+		RetryAttempts:    defaultRetryAttempts,
+		MaxRedirects:     defaultMaxRedirects,
+		RetryBaseDelay:   defaultRetryBaseDelay,
+		RefsCacheTTL:     defaultRefsCacheTTL,
+		RefsCacheSize:    defaultRefsCacheSize,
+
+		MaxResponseHeaderBytes: defaultMaxResponseHeader,
+
+		RefsDiskCacheTTL:     defaultRefsDiskCacheTTL,
+		RefsDiskCacheMaxSize: defaultRefsDiskCacheMaxSize,
+
+		WarmTimeout: defaultWarmTimeout,
+		WarmWorkers: defaultWarmWorkers,
+
+		NotFoundCacheTTL: defaultNotFoundCacheTTL,
+
+		GitHubQuotaWarn: defaultGitHubQuotaWarn,
+
+		BreakerThreshold: defaultBreakerThreshold,
+		BreakerWindow:    defaultBreakerWindow,
+		BreakerCooldown:  defaultBreakerCooldown,
+
+		MaxRequestBodySize: defaultMaxRequestBodySize,
+		RateBurst:          defaultRateBurst,
+
+		UserAgent:        "gopkg-git-proxy/" + buildVersion + " (+https://github.com/go-aah/gopkg)",
+		ForwardUserAgent: true,
+		ViaPseudonym:     "gopkg-proxy",
+
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+
+		MaintenanceMessage:    defaultMaintenanceMessage,
+		MaintenanceRetryAfter: defaultMaintenanceRetryAfter,
+
+		CacheHeaders: map[string]CacheHeaders{
+			endpointGoGet:        {CacheControl: "public, max-age=60", Vary: "Accept"},
+			endpointModuleList:   {CacheControl: "public, max-age=60"},
+			endpointModuleLatest: {CacheControl: "public, max-age=60"},
+			endpointModuleInfo:   {CacheControl: immutable},
+			endpointModuleMod:    {CacheControl: immutable},
+			endpointModuleZip:    {CacheControl: immutable},
+		},
+
+		ModuleCacheDir:     filepath.Join(os.TempDir(), "gopkg-modules"),
+		ModuleCacheMaxSize: defaultModuleCacheMaxSize,
+	}
+}
+
+// loadConfig returns the configuration in the YAML file at path, with
+// the settings it leaves out at their newConfig defaults. Keys are the
+// names of the Config fields in snake_case, backend_base_url for
+// BackendBaseURL, and durations are written as in "30s". Maps such as
+// cache_headers are merged into the defaults. Unknown keys are an error,
+// so that typos don't go unnoticed. Secrets are better kept out of the
+// file: the GitHub token is read from GITHUB_TOKEN unless
+// github_token_file is set.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %v", err)
+	}
+	cfg := newConfig()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot parse config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// restartSettings are the Config fields whose changes only take effect
+// on restart, as what they configure is set up once at startup: the
+// logs, tracing, metrics, TLS, the GitHub tokens and the hosts they are
+// sent to, the client, the landing page, the module cache and the admin
+// listener. The listen addresses,
+// given as flags, can't be reloaded either. Their running values are
+// kept on SIGHUP, which reloads every other setting, the allowlists and
+// timeouts among them.
+var restartSettings = []string{
+	"LogFormat", "LogLevel", "AccessLog", "PushAuditLog", "TracingExporter",
+	"MetricsBackend", "StatsDAddr", "StatsDSampleRate",
+	"TLSCertFile", "TLSKeyFile", "ACMECacheDir", "ACMEHosts", "ACMEEmail",
+	"PushClientCAFile",
+	"GitHubTokenFile", "BackendBaseURL", "Backends", "LandingPage",
+	"MaxIdleConns", "MaxIdleConnsPerHost", "IdleConnTimeout", "DisableHTTP2",
+	"MaxResponseHeaderBytes", "UpstreamProxy",
+	"ModuleCacheDir", "AdminAddr", "EnablePprof",
+}
+
+// changedSettings returns the names of the fields among names that
+// differ between old and new.
+func changedSettings(old, new *Config, names []string) []string {
+	var changed []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for _, name := range names {
+		if !reflect.DeepEqual(ov.FieldByName(name).Interface(), nv.FieldByName(name).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// keepSettings copies the fields among names from old to new, so that
+// new goes on describing what was set up from old.
+func keepSettings(old, new *Config, names []string) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for _, name := range names {
+		nv.FieldByName(name).Set(ov.FieldByName(name))
+	}
+}
+
+// validate reports the first setting in c that is out of range.
+func (c *Config) validate() error {
+	if u, err := url.Parse(c.BackendBaseURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("backend base URL must be an absolute https URL, got %q", c.BackendBaseURL)
+	} else if !c.AllowPrivateBackend && isPrivateHost(u.Hostname()) {
+		return fmt.Errorf("backend base URL %q is a private address, see AllowPrivateBackend", c.BackendBaseURL)
+	}
+	prefixes := make(map[string]bool)
+	for _, b := range c.Backends {
+		if b.Prefix == "" || strings.HasPrefix(b.Prefix, "/") {
+			return fmt.Errorf("backend prefix must be the start of a user/name path, got %q", b.Prefix)
+		}
+		if prefixes[strings.ToLower(b.Prefix)] {
+			return fmt.Errorf("backend prefix %q is given twice", b.Prefix)
+		}
+		prefixes[strings.ToLower(b.Prefix)] = true
+		if u, err := url.Parse(b.BaseURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("base URL of backend %q must be an absolute https URL, got %q", b.Prefix, b.BaseURL)
+		} else if !c.AllowPrivateBackend && isPrivateHost(u.Hostname()) {
+			return fmt.Errorf("base URL of backend %q is a private address, see AllowPrivateBackend", b.Prefix)
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS certificate and key files must be given together")
+	}
+	if c.ACMECacheDir != "" && c.TLSCertFile != "" {
+		return fmt.Errorf("cannot use ACME along with TLS certificate and key files")
+	}
+	if c.ACMECacheDir != "" && len(c.ACMEHosts) == 0 {
+		return fmt.Errorf("ACME hosts must not be empty")
+	}
+	if c.PushClientCAFile != "" && c.TLSCertFile == "" && c.ACMECacheDir == "" {
+		return fmt.Errorf("push client CA file requires TLS")
+	}
+	if c.PushClientCAFile != "" && len(c.PushClients) == 0 {
+		return fmt.Errorf("push clients must not be empty with a push client CA file")
+	}
+	if !containsString([]string{tracingNone, tracingStdout, tracingOTLP}, c.TracingExporter) {
+		return fmt.Errorf("invalid tracing exporter %q", c.TracingExporter)
+	}
+	if !containsString([]string{metricsNone, metricsPrometheus, metricsStatsD}, c.MetricsBackend) {
+		return fmt.Errorf("invalid metrics backend %q", c.MetricsBackend)
+	}
+	if c.MetricsBackend == metricsStatsD && c.StatsDAddr == "" {
+		return fmt.Errorf("StatsD address must not be empty")
+	}
+	if c.StatsDSampleRate <= 0 || c.StatsDSampleRate > 1 {
+		return fmt.Errorf("StatsD sample rate must be in (0, 1], got %v", c.StatsDSampleRate)
+	}
+	if c.HSTSMaxAge < 0 {
+		return fmt.Errorf("HSTS max age must not be negative, got %v", c.HSTSMaxAge)
+	}
+	if c.SlowRequestThreshold < 0 {
+		return fmt.Errorf("slow request threshold must not be negative, got %v", c.SlowRequestThreshold)
+	}
+	if c.CopyBufferSize < minCopyBufferSize {
+		return fmt.Errorf("copy buffer size must be at least %d bytes, got %d", minCopyBufferSize, c.CopyBufferSize)
+	}
+	if c.LogSampleFirst < 0 || c.LogSampleInterval < 0 {
+		return fmt.Errorf("log sampling must not be negative, got %d per %v", c.LogSampleFirst, c.LogSampleInterval)
+	}
+	if c.WriteIdleTimeout < 0 {
+		return fmt.Errorf("write idle timeout must not be negative, got %v", c.WriteIdleTimeout)
+	}
+	if c.MaxResponseHeaderBytes < 0 {
+		return fmt.Errorf("max response header bytes must not be negative, got %d", c.MaxResponseHeaderBytes)
+	}
+	if c.MaxRedirects < 0 {
+		return fmt.Errorf("max redirects must not be negative, got %d", c.MaxRedirects)
+	}
+	if c.ProxyTimeout < 0 {
+		return fmt.Errorf("proxy timeout must not be negative, got %v", c.ProxyTimeout)
+	}
+	if c.MaxConcurrentProxies < 0 {
+		return fmt.Errorf("max concurrent proxies must not be negative, got %d", c.MaxConcurrentProxies)
+	}
+	for pattern, max := range c.RepoConcurrency {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("repo concurrency must be keyed by user/name patterns, got %q", pattern)
+		}
+		if max < 1 {
+			return fmt.Errorf("repo concurrency of %q must be at least 1, got %d", pattern, max)
+		}
+	}
+	if c.RetryAttempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1, got %d", c.RetryAttempts)
+	}
+	if c.RetryBaseDelay < 0 {
+		return fmt.Errorf("retry base delay must not be negative, got %v", c.RetryBaseDelay)
+	}
+	if c.RefsCacheTTL < 0 {
+		return fmt.Errorf("refs cache TTL must not be negative, got %v", c.RefsCacheTTL)
+	}
+	if c.RefsCacheTTL > 0 && c.RefsCacheSize <= 0 {
+		return fmt.Errorf("refs cache size must be positive, got %d", c.RefsCacheSize)
+	}
+	if c.RefsDiskCacheDir != "" && c.RefsDiskCacheTTL <= 0 {
+		return fmt.Errorf("refs disk cache TTL must be positive, got %v", c.RefsDiskCacheTTL)
+	}
+	if c.RefsDiskCacheDir != "" && c.RefsDiskCacheMaxSize <= 0 {
+		return fmt.Errorf("refs disk cache max size must be positive, got %d", c.RefsDiskCacheMaxSize)
+	}
+	if c.MaintenanceRetryAfter < 0 {
+		return fmt.Errorf("maintenance Retry-After must not be negative, got %v", c.MaintenanceRetryAfter)
+	}
+	if c.GitHubQuotaWarn < 0 {
+		return fmt.Errorf("GitHub quota warning threshold must not be negative, got %d", c.GitHubQuotaWarn)
+	}
+	if c.NotFoundCacheTTL < 0 {
+		return fmt.Errorf("not found cache TTL must not be negative, got %v", c.NotFoundCacheTTL)
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker threshold must not be negative, got %d", c.BreakerThreshold)
+	}
+	if c.BreakerThreshold > 0 && (c.BreakerWindow <= 0 || c.BreakerCooldown <= 0) {
+		return fmt.Errorf("breaker window and cooldown must be positive")
+	}
+	if c.MaxRequestBodySize < 0 {
+		return fmt.Errorf("max request body size must not be negative, got %d", c.MaxRequestBodySize)
+	}
+	if c.TrustedHops < 0 {
+		return fmt.Errorf("trusted hops must not be negative, got %d", c.TrustedHops)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative, got %v", c.RateLimit)
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return fmt.Errorf("rate burst must be at least 1, got %d", c.RateBurst)
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle connection settings must not be negative")
+	}
+	if c.UpstreamProxy != "" {
+		u, err := url.Parse(c.UpstreamProxy)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+			// Not quoted, as it may hold a password.
+			return fmt.Errorf("upstream proxy must be an absolute http, https or socks5 URL")
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive, got %v", c.ShutdownTimeout)
+	}
+	for repo, src := range c.GoSource {
+		if strings.Count(repo, "/") != 1 {
+			return fmt.Errorf("go-source repository must be given as user/name, got %q", repo)
+		}
+		if src.Home == "" || src.Dir == "" || src.File == "" {
+			return fmt.Errorf("go-source templates of %s must not be empty", repo)
+		}
+	}
+	switch c.RepoPolicy {
+	case repoPolicyAllowAll:
+		if len(c.AllowedRepos) > 0 {
+			return fmt.Errorf("allowed repositories need the %s repo policy", repoPolicyDenyAll)
+		}
+	case repoPolicyDenyAll:
+	default:
+		return fmt.Errorf("invalid repo policy %q", c.RepoPolicy)
+	}
+	for _, pattern := range c.AllowedRepos {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("allowed repository must be given as a user/name pattern, got %q", pattern)
+		}
+	}
+	for _, repo := range c.PrivateRepos {
+		if strings.Count(repo, "/") != 1 {
+			return fmt.Errorf("private repository must be given as user/name, got %q", repo)
+		}
+	}
+	for _, repo := range c.WarmRepos {
+		if strings.Count(repo, "/") != 1 {
+			return fmt.Errorf("warmed repository must be given as user/name, got %q", repo)
+		}
+	}
+	if len(c.WarmRepos) > 0 && c.WarmTimeout <= 0 {
+		return fmt.Errorf("warm timeout must be positive, got %v", c.WarmTimeout)
+	}
+	if len(c.WarmRepos) > 0 && c.WarmWorkers <= 0 {
+		return fmt.Errorf("warm workers must be positive, got %d", c.WarmWorkers)
+	}
+	for endpoint := range c.CacheHeaders {
+		if !containsString(cacheEndpoints, endpoint) {
+			return fmt.Errorf("unknown endpoint %q for cache headers", endpoint)
+		}
+	}
+	for name, value := range c.ResponseHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid response header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for response header %s: %q", name, value)
+		}
+	}
+	for _, name := range c.RedactHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid redacted header name %q", name)
+		}
+	}
+	for _, name := range c.RedactParams {
+		if name == "" || strings.ContainsAny(name, "&=#? ") {
+			return fmt.Errorf("invalid redacted query parameter %q", name)
+		}
+	}
+	for _, name := range c.HopHeaders {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid hop-by-hop header name %q", name)
+		}
+	}
+	if c.EnablePprof && c.AdminAddr == "" {
+		return fmt.Errorf("pprof requires the admin listener address")
+	}
+	if c.ModuleCacheDir == "" {
+		return fmt.Errorf("module cache directory must not be empty")
+	}
+	if c.ModuleCacheMaxSize < 0 {
+		return fmt.Errorf("module cache max size must not be negative, got %d", c.ModuleCacheMaxSize)
+	}
+	if c.ModuleCacheTargetSize < 0 {
+		return fmt.Errorf("module cache target size must not be negative, got %d", c.ModuleCacheTargetSize)
+	}
+	if c.ModuleCacheMaxSize > 0 && c.ModuleCacheTargetSize > c.ModuleCacheMaxSize {
+		return fmt.Errorf("module cache target size %d must not exceed the max size %d", c.ModuleCacheTargetSize, c.ModuleCacheMaxSize)
+	}
+	if c.UserAgent == "" {
+		return fmt.Errorf("user agent must not be empty")
+	}
+	if c.ViaPseudonym != "" && quoteForwarded(c.ViaPseudonym) != c.ViaPseudonym {
+		return fmt.Errorf("via pseudonym must be a token, got %q", c.ViaPseudonym)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
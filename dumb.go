@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The dumb HTTP protocol is what git clients older than 1.6.6, or those
+// told to by GIT_SMART_HTTP=0, fall back to: the ref listing of
+// /info/refs without a service parameter, then the repository files
+// themselves, HEAD and objects, one request per object and pack. It is
+// much slower than smart HTTP, which is always preferred: clients only
+// get there when the smart advertisement isn't offered to them.
+//
+// The version of the repository can't be applied to dumb requests, whose
+// HEAD and ref listing are files of the repository, so they are refused
+// on versioned paths rather than served the default branch. On plain
+// paths they are passed to GitHub as they are. GitHub.com has turned the
+// dumb protocol off and answers them with an upgrade notice, which goes
+// back to the client; backends still serving it do work.
+
+// dumbFiles are the repository files, other than objects, read by dumb
+// clients.
+var dumbFiles = []string{"/HEAD", "/objects/info/packs",
+	"/objects/info/alternates", "/objects/info/http-alternates"}
+
+// isDumbPath reports whether subPath, the path within a repository, is
+// one of the files read by dumb clients.
+func isDumbPath(subPath string) bool {
+	return containsString(dumbFiles, subPath) || strings.HasPrefix(subPath, "/objects/")
+}
+
+// proxyDumb forwards the request of a dumb client for a repository file
+// to GitHub, and streams the file back.
+func proxyDumb(w http.ResponseWriter, r *http.Request, target string) {
+	proxy(w, r, serviceDumb, target)
+}
+
+// sendDumbVersioned tells a dumb client its request for a versioned path
+// can't be served.
+func sendDumbVersioned(w http.ResponseWriter, repo *Repo) {
+	sendNotFound(w, "The dumb HTTP protocol is not supported on versioned paths such as %s; use a git client speaking smart HTTP.", repo.GopkgRoot())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+var dumbPathTests = []struct {
+	subPath string
+	dumb    bool
+}{
+	{"/HEAD", true},
+	{"/objects/info/packs", true},
+	{"/objects/info/http-alternates", true},
+	{"/objects/12/34567890abcdef1234567890abcdef12345678", true},
+	{"/objects/pack/pack-1234567890abcdef1234567890abcdef12345678.pack", true},
+	{"/info/refs", false},
+	{"/info/packs", false},
+	{"/git-upload-pack", false},
+	{"/objects", false},
+	{"/subpkg", false},
+	{"", false},
+}
+
+func (s *HandlerSuite) TestIsDumbPath(c *C) {
+	for _, t := range dumbPathTests {
+		c.Check(isDumbPath(t.subPath), Equals, t.dumb, Commentf("%q", t.subPath))
+	}
+}
+
+func (s *HandlerSuite) TestDumbObject(c *C) {
+	var method string
+	s.mux.HandleFunc("/go-aah/config/objects/12/34567890abcdef1234567890abcdef12345678", func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Type", "application/x-git-loose-object")
+		_, _ = w.Write([]byte("object"))
+	})
+
+	rec := s.serve("GET", "/config/objects/12/34567890abcdef1234567890abcdef12345678", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(method, Equals, "GET")
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/x-git-loose-object")
+	c.Assert(rec.Body.String(), Equals, "object")
+
+	// As GitHub.com answers them.
+	s.mux.HandleFunc("/go-aah/config/HEAD", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("Please upgrade your git client."))
+	})
+	rec = s.serve("GET", "/config/HEAD", "")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(rec.Body.String(), Equals, "Please upgrade your git client.")
+}
+
+func (s *HandlerSuite) TestDumbVersioned(c *C) {
+	s.mux.HandleFunc("/go-aah/config/HEAD", func(w http.ResponseWriter, r *http.Request) {
+		c.Error("dumb request for a versioned path proxied")
+	})
+	for _, path := range []string{"/config.v1/HEAD", "/config.v1/info/refs", "/config.v1/objects/info/packs"} {
+		rec := s.serve("GET", path, "")
+		c.Check(rec.Code, Equals, http.StatusNotFound, Commentf("%s", path))
+		c.Check(rec.Body.String(), Matches, "The dumb HTTP protocol is not supported on versioned paths such as .*/config.v1; .*")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"expvar"
+)
+
+// expvarMetrics keeps the proxy measurements in expvar variables, for a
+// quick look at /debug/vars on the admin listener whatever the metrics
+// backend. They are those of promMetrics, counted since startup, the
+// maps keyed by git service, by service and status class as in
+// "upload-pack.5xx", by cache and result as in "refs.hit", or by cache.
+// The requests in flight are left to proxy_requests_in_flight.
+type expvarMetrics struct {
+	vars *expvar.Map
+
+	requests      *expvar.Map
+	bytes         *expvar.Map
+	backendErrors *expvar.Map
+	cacheLookups  *expvar.Map
+	cacheSize     *expvar.Map
+	evictions     *expvar.Map
+	panics        *expvar.Int
+}
+
+// newExpvarMetrics returns Metrics counting in vars, which holds them
+// all.
+func newExpvarMetrics() *expvarMetrics {
+	m := &expvarMetrics{
+		vars:          new(expvar.Map).Init(),
+		requests:      new(expvar.Map).Init(),
+		bytes:         new(expvar.Map).Init(),
+		backendErrors: new(expvar.Map).Init(),
+		cacheLookups:  new(expvar.Map).Init(),
+		cacheSize:     new(expvar.Map).Init(),
+		evictions:     new(expvar.Map).Init(),
+		panics:        new(expvar.Int),
+	}
+	m.vars.Set("proxy_requests", m.requests)
+	m.vars.Set("proxy_response_bytes", m.bytes)
+	m.vars.Set("proxy_backend_errors", m.backendErrors)
+	m.vars.Set("cache_lookups", m.cacheLookups)
+	m.vars.Set("cache_size_bytes", m.cacheSize)
+	m.vars.Set("cache_evictions", m.evictions)
+	m.vars.Set("panics", m.panics)
+	return m
+}
+
+// expvarStats is published as "gopkg" and fed by run when the admin
+// listener is on.
+var expvarStats = newExpvarMetrics()
+
+func init() {
+	expvar.Publish("gopkg", expvarStats.vars)
+}
+
+func (m *expvarMetrics) ProxyStarted(string) {}
+
+func (m *expvarMetrics) ProxyDone(s ProxyStats) {
+	m.requests.Add(s.Service, 1)
+	m.bytes.Add(s.Service, s.Bytes)
+	if class := statusClass(s.Status); class != "2xx" && class != "3xx" {
+		m.backendErrors.Add(s.Service+"."+class, 1)
+	}
+}
+
+func (m *expvarMetrics) CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.Add(cache+"."+result, 1)
+}
+
+func (m *expvarMetrics) CacheSize(cache string, bytes int64) {
+	v := new(expvar.Int)
+	v.Set(bytes)
+	m.cacheSize.Set(cache, v)
+}
+
+func (m *expvarMetrics) CacheEvicted(cache string, n int) {
+	m.evictions.Add(cache, int64(n))
+}
+
+func (m *expvarMetrics) Panicked() {
+	m.panics.Add(1)
+}
+
+func (m *expvarMetrics) RateLimitRemaining(string, int) {}
+func (m *expvarMetrics) PseudoVersion()                 {}
+func (m *expvarMetrics) RepoInFlight(string, int)       {}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *AdminSuite) TestExpvarMetrics(c *C) {
+	m := newExpvarMetrics()
+	m.ProxyStarted(serviceUploadPack)
+	m.ProxyStarted(serviceUploadPack)
+	m.ProxyDone(ProxyStats{Service: serviceUploadPack, Status: http.StatusOK, Bytes: 100, Duration: time.Second})
+	m.CacheLookup(cacheRefs, true)
+	m.CacheLookup(cacheRefs, false)
+	m.CacheLookup(cacheRefs, true)
+	m.ProxyStarted(serviceInfoRefs)
+	m.ProxyDone(ProxyStats{Service: serviceInfoRefs, Status: http.StatusBadGateway})
+	m.CacheSize(cacheModuleZip, 300)
+	m.CacheSize(cacheModuleZip, 200)
+	m.CacheEvicted(cacheModuleZip, 2)
+	m.Panicked()
+
+	var vars map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(m.vars.String()), &vars), IsNil)
+	c.Assert(vars, DeepEquals, map[string]interface{}{
+		"proxy_requests":       map[string]interface{}{"upload-pack": 1.0, "info-refs": 1.0},
+		"proxy_response_bytes": map[string]interface{}{"upload-pack": 100.0, "info-refs": 0.0},
+		"proxy_backend_errors": map[string]interface{}{"info-refs.5xx": 1.0},
+		"cache_lookups":        map[string]interface{}{"refs.hit": 2.0, "refs.miss": 1.0},
+		"cache_size_bytes":     map[string]interface{}{"module_zip": 200.0},
+		"cache_evictions":      map[string]interface{}{"module_zip": 2.0},
+		"panics":               1.0,
+	})
+}
+
+func (s *AdminSuite) TestExpvarPublished(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	rec := &panicMetrics{}
+	metrics = teeMetrics{rec, expvarStats}
+	before := expvarStats.panics.Value()
+	metrics.Panicked()
+	c.Assert(rec.panics, Equals, 1)
+
+	w := httptest.NewRecorder()
+	cfg := newConfig()
+	cfg.EnablePprof = true
+	newAdminHandler(cfg).ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Gopkg struct {
+			Panics int64 `json:"panics"`
+		} `json:"gopkg"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &vars), IsNil)
+	c.Assert(vars.Gopkg.Panics, Equals, before+1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// setForwarded records in the X-Forwarded-For, X-Forwarded-Proto and
+// Forwarded (RFC 7239) headers of h, meant for GitHub, that r came from
+// its remote address. Only the last config.TrustedHops entries already
+// present in the headers of r are kept ahead of it.
+func setForwarded(h http.Header, r *http.Request) {
+	ip := remoteIP(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	xff := trustedEntries(r.Header.Values("X-Forwarded-For"))
+	h.Set("X-Forwarded-For", strings.Join(append(xff, ip), ", "))
+
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" && config().TrustedHops > 0 {
+		proto = p
+	}
+	h.Set("X-Forwarded-Proto", proto)
+
+	fwd := trustedEntries(r.Header.Values("Forwarded"))
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = `"[` + ip + `]"`
+	}
+	fwd = append(fwd, "for="+node+";host="+quoteForwarded(r.Host)+";proto="+proto)
+	h.Set("Forwarded", strings.Join(fwd, ", "))
+}
+
+// trustedEntries returns the last config.TrustedHops entries of a
+// comma separated list header with the given values.
+func trustedEntries(values []string) []string {
+	var entries []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if n := config().TrustedHops; len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// remoteIP returns the IP address r was received from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client r comes from: the first
+// X-Forwarded-For entry added by the config.TrustedHops proxies in front
+// of this one, or the remote address of r when there are none. Entries
+// further left could be made up by the client and are never looked at.
+func clientIP(r *http.Request) string {
+	xff := trustedEntries(r.Header.Values("X-Forwarded-For"))
+	if len(xff) == 0 {
+		return remoteIP(r)
+	}
+	return xff[0]
+}
+
+// quoteForwarded returns v as a Forwarded header value, quoted unless
+// it is a plain token.
+func quoteForwarded(v string) string {
+	if v != "" && strings.IndexFunc(v, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+	}) < 0 {
+		return v
+	}
+	return `"` + strings.Replace(strings.Replace(v, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ForwardSuite{})
+
+type ForwardSuite struct{}
+
+func (s *ForwardSuite) forwarded(hops int, header http.Header) http.Header {
+	defer func(n int) { config().TrustedHops = n }(config().TrustedHops)
+	config().TrustedHops = hops
+
+	r := httptest.NewRequest("GET", "/config.v1/info/refs", nil)
+	r.RemoteAddr = "192.0.2.7:41234"
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	h := make(http.Header)
+	setForwarded(h, r)
+	return h
+}
+
+func (s *ForwardSuite) TestNoHeaders(c *C) {
+	h := s.forwarded(0, nil)
+	c.Assert(h.Get("X-Forwarded-For"), Equals, "192.0.2.7")
+	c.Assert(h.Get("X-Forwarded-Proto"), Equals, "http")
+	c.Assert(h.Get("Forwarded"), Equals, "for=192.0.2.7;host=example.com;proto=http")
+}
+
+func (s *ForwardSuite) TestSpoofedHeadersDropped(c *C) {
+	h := s.forwarded(0, http.Header{
+		"X-Forwarded-For":   {"10.0.0.1"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=10.0.0.1"},
+	})
+	c.Assert(h.Get("X-Forwarded-For"), Equals, "192.0.2.7")
+	c.Assert(h.Get("X-Forwarded-Proto"), Equals, "http")
+	c.Assert(h.Get("Forwarded"), Equals, "for=192.0.2.7;host=example.com;proto=http")
+}
+
+func (s *ForwardSuite) TestTrustedChain(c *C) {
+	h := s.forwarded(1, http.Header{
+		"X-Forwarded-For":   {"10.0.0.1, 198.51.100.3", "203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=10.0.0.1, for=203.0.113.9;proto=https"},
+	})
+	c.Assert(h.Get("X-Forwarded-For"), Equals, "203.0.113.9, 192.0.2.7")
+	c.Assert(h.Get("X-Forwarded-Proto"), Equals, "https")
+	c.Assert(h.Get("Forwarded"), Equals, "for=203.0.113.9;proto=https, for=192.0.2.7;host=example.com;proto=https")
+}
+
+func (s *ForwardSuite) TestIPv6(c *C) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:41234"
+	h := make(http.Header)
+	setForwarded(h, r)
+	c.Assert(h.Get("X-Forwarded-For"), Equals, "2001:db8::1")
+	c.Assert(h.Get("Forwarded"), Equals, `for="[2001:db8::1]";host=example.com;proto=http`)
+}
+
+func (s *ForwardSuite) TestQuoteForwarded(c *C) {
+	c.Assert(quoteForwarded("aahframe.work"), Equals, "aahframe.work")
+	c.Assert(quoteForwarded("aahframe.work:8080"), Equals, `"aahframe.work:8080"`)
+	c.Assert(quoteForwarded(""), Equals, `""`)
+}
+
+func (s *ForwardSuite) TestClientIP(c *C) {
+	defer func(n int) { config().TrustedHops = n }(config().TrustedHops)
+
+	r := httptest.NewRequest("GET", "/config.v1/info/refs", nil)
+	r.RemoteAddr = "192.0.2.7:41234"
+	r.Header.Add("X-Forwarded-For", "10.0.0.1, 203.0.113.5")
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+
+	config().TrustedHops = 0
+	c.Assert(clientIP(r), Equals, "192.0.2.7")
+	config().TrustedHops = 1
+	c.Assert(clientIP(r), Equals, "198.51.100.1")
+	config().TrustedHops = 2
+	c.Assert(clientIP(r), Equals, "203.0.113.5")
+
+	r.Header.Del("X-Forwarded-For")
+	c.Assert(clientIP(r), Equals, "192.0.2.7")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requireUnambiguousFraming replies 400 when the body of r is framed in
+// more than one way, the stuff of request smuggling, and reports whether
+// the request may go on. net/http already refuses most such requests and
+// drops Content-Length when Transfer-Encoding is set, but the check keeps
+// any that get through, from another server in front for instance, from
+// ever reaching GitHub.
+func requireUnambiguousFraming(w http.ResponseWriter, r *http.Request) bool {
+	reason := ambiguousFraming(r)
+	if reason == "" {
+		return true
+	}
+	logger.WarnContext(r.Context(), "request with ambiguous framing refused", "reason", reason, "path", r.URL.Path)
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write([]byte("Ambiguous request framing."))
+	return false
+}
+
+// ambiguousFraming returns why the body of r can't be told apart with
+// certainty, or the empty string if it can: several Content-Length
+// values, Content-Length along with Transfer-Encoding, or a
+// Transfer-Encoding other than a lone chunked.
+func ambiguousFraming(r *http.Request) string {
+	cl := r.Header.Values("Content-Length")
+	te := r.Header.Values("Transfer-Encoding")
+	if len(te) == 0 {
+		// As parsed by net/http, which removes the header.
+		te = r.TransferEncoding
+	}
+	switch {
+	case len(cl) > 1:
+		return "several Content-Length"
+	case len(cl) == 1 && strings.Contains(cl[0], ","):
+		return "several Content-Length"
+	case len(cl) == 1 && len(te) > 0:
+		return "Content-Length with Transfer-Encoding"
+	case len(te) > 1:
+		return "several Transfer-Encoding"
+	case len(te) == 1 && !strings.EqualFold(strings.TrimSpace(te[0]), "chunked"):
+		return "unsupported Transfer-Encoding"
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&FramingSuite{})
+
+type FramingSuite struct{}
+
+func (s *FramingSuite) TestAmbiguousFraming(c *C) {
+	tests := []struct {
+		header http.Header
+		te     []string
+		reason string
+	}{
+		{http.Header{}, nil, ""},
+		{http.Header{"Content-Length": {"4"}}, nil, ""},
+		{http.Header{}, []string{"chunked"}, ""},
+		{http.Header{"Transfer-Encoding": {"chunked"}}, nil, ""},
+		{http.Header{"Content-Length": {"4", "4"}}, nil, "several Content-Length"},
+		{http.Header{"Content-Length": {"4, 5"}}, nil, "several Content-Length"},
+		{http.Header{"Content-Length": {"4"}}, []string{"chunked"}, "Content-Length with Transfer-Encoding"},
+		{http.Header{"Content-Length": {"4"}, "Transfer-Encoding": {"chunked"}}, nil, "Content-Length with Transfer-Encoding"},
+		{http.Header{"Transfer-Encoding": {"chunked", "chunked"}}, nil, "several Transfer-Encoding"},
+		{http.Header{"Transfer-Encoding": {"gzip, chunked"}}, nil, "unsupported Transfer-Encoding"},
+		{http.Header{}, []string{"identity"}, "unsupported Transfer-Encoding"},
+	}
+	for _, t := range tests {
+		req := &http.Request{Header: t.header, TransferEncoding: t.te}
+		c.Check(ambiguousFraming(req), Equals, t.reason, Commentf("header %v, transfer encoding %v", t.header, t.te))
+	}
+}
+
+func (s *FramingSuite) TestProxyAmbiguousFraming(c *C) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+	var log bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("Content-Length", "4")
+	req.Header.Set("Transfer-Encoding", "chunked")
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	c.Assert(rec.Body.String(), Equals, "Ambiguous request framing.")
+	c.Assert(called, Equals, false)
+	c.Assert(log.String(), Matches, `(?s).*msg="request with ambiguous framing refused" reason="Content-Length with Transfer-Encoding" path=/config.v1/git-upload-pack.*`)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// GitBackend serves the git services the proxy handlers pass on, for
+// the repository files and services at target URLs of the backend, as
+// checked by validateTarget. Client is the request of the git client,
+// whose headers and query are passed on as fits the backend, and whose
+// HEAD method asks for headers only. The responses are written back to
+// the client as they come; errors are answered with a 5xx by the
+// handlers.
+type GitBackend interface {
+	// InfoRefs returns the refs advertisement at target, for the service
+	// in the query of client.
+	InfoRefs(ctx context.Context, target string, client *http.Request) (*http.Response, error)
+
+	// UploadPack sends the upload-pack request in body to target.
+	UploadPack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error)
+
+	// ReceivePack sends the push in body to target, with the credentials
+	// of client.
+	ReceivePack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error)
+
+	// Dumb returns the repository file at target, for dumb clients.
+	Dumb(ctx context.Context, target string, client *http.Request) (*http.Response, error)
+}
+
+// gitBackend is where the proxy handlers send git requests, GitHub over
+// HTTP unless set to some other implementation.
+var gitBackend GitBackend = githubBackend{}
+
+// targetError is the error of a GitBackend unable to make a request of
+// its target at all, answered with 500 rather than as a backend failure.
+type targetError struct {
+	err error
+}
+
+func (e *targetError) Error() string { return e.err.Error() }
+func (e *targetError) Unwrap() error { return e.err }
+
+// githubBackend is the GitBackend of GitHub and GitHub Enterprise hosts,
+// talking smart HTTP through clientFor. Requests are retried as told by
+// doRetry and follow GitHub's redirects, bodies replayed.
+type githubBackend struct{}
+
+func (githubBackend) InfoRefs(ctx context.Context, target string, client *http.Request) (*http.Response, error) {
+	return githubSend(ctx, serviceInfoRefs, "GET", target, client, nil)
+}
+
+func (githubBackend) UploadPack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error) {
+	return githubSend(ctx, serviceUploadPack, "POST", target, client, body)
+}
+
+func (githubBackend) ReceivePack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error) {
+	return githubSend(ctx, serviceReceivePack, "POST", target, client, body)
+}
+
+func (githubBackend) Dumb(ctx context.Context, target string, client *http.Request) (*http.Response, error) {
+	return githubSend(ctx, serviceDumb, "GET", target, client, nil)
+}
+
+// githubSend sends the request of client for service to target with the
+// given method, HEAD for clients asking for headers only, and body, if
+// any. The query of client is kept unless target has its own, and its
+// headers are passed on but for the hop-by-hop ones, the User-Agent
+// prefixed with that of the proxy. Reads of the repositories of
+// config.PrivateRepos and config.Backends get their token.
+func githubSend(ctx context.Context, service, method, target string, client *http.Request, body io.Reader) (*http.Response, error) {
+	if client.Method == "HEAD" {
+		method, body = "HEAD", nil
+	}
+	// Kept to be sent again if GitHub redirects.
+	var replay *replayBody
+	if body != nil {
+		replay = &replayBody{r: body}
+		body = replay
+	}
+
+	outreq, err := http.NewRequestWithContext(ctx, method, withQuery(target, client.URL.RawQuery), body)
+	if err != nil {
+		return nil, &targetError{err}
+	}
+	outreq.Header = cloneHeader(client.Header)
+	outreq.Close = false
+
+	cfg := config()
+	cleanHopHeaders(outreq.Header, cfg.HopHeaders)
+	outreq.Header.Set("User-Agent", userAgent(cfg, client.UserAgent()))
+	setForwarded(outreq.Header, client)
+	injectTrace(ctx, outreq.Header)
+	setRequestID(ctx, outreq.Header)
+	if service == serviceUploadPack || service == serviceDumb {
+		setRepoToken(outreq.Header, target)
+	}
+
+	res, err := doRetry(outreq)
+	if err == nil && replay != nil && isRedirect(res.StatusCode) {
+		res, err = followRedirect(outreq, res, replay)
+	}
+	return res, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeGitBackend answers every request with its status and body, or err,
+// recording the calls as "service target body".
+type fakeGitBackend struct {
+	status int
+	body   string
+	err    error
+	calls  []string
+}
+
+func (b *fakeGitBackend) answer(service, target string, body io.Reader) (*http.Response, error) {
+	call := service + " " + target
+	if body != nil {
+		data, _ := ioutil.ReadAll(body)
+		call += " " + string(data)
+	}
+	b.calls = append(b.calls, call)
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &http.Response{
+		StatusCode: b.status,
+		Header:     http.Header{"Content-Type": {"application/x-git-upload-pack-result"}},
+		Body:       ioutil.NopCloser(strings.NewReader(b.body)),
+	}, nil
+}
+
+func (b *fakeGitBackend) InfoRefs(ctx context.Context, target string, client *http.Request) (*http.Response, error) {
+	return b.answer(serviceInfoRefs, target, nil)
+}
+
+func (b *fakeGitBackend) UploadPack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error) {
+	return b.answer(serviceUploadPack, target, body)
+}
+
+func (b *fakeGitBackend) ReceivePack(ctx context.Context, target string, client *http.Request, body io.Reader) (*http.Response, error) {
+	return b.answer(serviceReceivePack, target, body)
+}
+
+func (b *fakeGitBackend) Dumb(ctx context.Context, target string, client *http.Request) (*http.Response, error) {
+	return b.answer(serviceDumb, target, nil)
+}
+
+func (s *ProxySuite) TestProxyGitBackend(c *C) {
+	defer func(b GitBackend) { gitBackend = b }(gitBackend)
+	fake := &fakeGitBackend{status: http.StatusOK, body: "0008NAK\n"}
+	gitBackend = fake
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, "https://github.com/go-aah/config/git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/x-git-upload-pack-result")
+	c.Assert(rec.Body.String(), Equals, "0008NAK\n")
+
+	// Without body for HEAD requests.
+	req = httptest.NewRequest("HEAD", "/config.v1/git-upload-pack", nil)
+	proxyGitUploadPack(httptest.NewRecorder(), req, "https://github.com/go-aah/config/git-upload-pack")
+	req = httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	proxyInfoRefs(httptest.NewRecorder(), req, "https://github.com/go-aah/config/info/refs")
+	req = httptest.NewRequest("GET", "/config.v1/HEAD", nil)
+	proxyDumb(httptest.NewRecorder(), req, "https://github.com/go-aah/config/HEAD")
+
+	c.Assert(fake.calls, DeepEquals, []string{
+		"upload-pack https://github.com/go-aah/config/git-upload-pack 0000",
+		"upload-pack https://github.com/go-aah/config/git-upload-pack",
+		"info-refs https://github.com/go-aah/config/info/refs",
+		"dumb https://github.com/go-aah/config/HEAD",
+	})
+}
+
+func (s *ProxySuite) TestProxyGitBackendError(c *C) {
+	defer func(b GitBackend) { gitBackend = b }(gitBackend)
+	fake := &fakeGitBackend{err: errors.New("connection refused")}
+	gitBackend = fake
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, "https://github.com/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+
+	fake.err = &targetError{errors.New("invalid URL")}
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, "https://github.com/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+
+	fake.err = ErrCircuitOpen
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, "https://github.com/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+}
@@ -5,14 +5,29 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //
-// GitHub Proxying for /git-upload-pack
+// GitHub Proxying for /git-upload-pack, /git-receive-pack and /info/refs,
+// and the files read by dumb clients
 // Note: this is similar to reverse proxy not exactly :)
 //
 
@@ -30,25 +45,259 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+func proxyGitUploadPack(w http.ResponseWriter, r *http.Request, target string) {
+	proxy(w, r, serviceUploadPack, target)
+}
+
+// proxyGitReceivePack forwards a push to GitHub. Pushes are only accepted
+// with credentials; they are passed on within the Authorization header and
+// GitHub's verdict on them, 401 or 403 included, is returned verbatim.
+func proxyGitReceivePack(w http.ResponseWriter, r *http.Request, target string) {
+	if !requirePushNetwork(w, r) || !requirePushCert(w, r) || !requireAuth(w, r) {
+		return
+	}
+	proxy(w, r, serviceReceivePack, target)
+}
+
+// requireAuth replies 401 asking for credentials when r brings none
+// and reports whether the request may go on.
+func requireAuth(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="GitHub"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// proxyInfoRefs forwards the ref advertisement request of a smart HTTP
+// client to GitHub, keeping the "service" query parameter of the incoming
+// request, and streams the advertisement back as-is.
+func proxyInfoRefs(w http.ResponseWriter, r *http.Request, target string) {
+	proxy(w, r, serviceInfoRefs, target)
+}
+
+// Git services proxied to GitHub, as reported to metrics.
+const (
+	serviceUploadPack  = "upload-pack"
+	serviceReceivePack = "receive-pack"
+	serviceInfoRefs    = "info-refs"
+	serviceDumb        = "dumb"
+)
+
+// sendAdvertisement replies with the upload-pack refs advertisement in
+// data, tagged with an ETag derived from its content. Clients sending the
+// same tag back in If-None-Match get 304 Not Modified until the refs
+// change, as do those sending If-Modified-Since for a time no earlier
+// than modified, unless it is zero. Advertisements proxied to GitHub
+// as-is carry its own ETag and Last-Modified, if any, instead.
+func sendAdvertisement(w http.ResponseWriter, r *http.Request, data []byte, modified time.Time) {
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	setCacheHeaders(w.Header(), serviceInfoRefs)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if checkNotModified(w, r, modified) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	_, _ = w.Write(data)
+}
+
+// etagMatch reports whether the If-None-Match header value inm matches
+// etag, using the weak comparison of RFC 7232.
+func etagMatch(inm, etag string) bool {
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// proxy sends r to target for the given service through gitBackend and
+// streams the response back to w, unless there are already as many in
+// progress as config.MaxConcurrentProxies or, for the repository of
+// target, config.RepoConcurrency allows, or the body of r is framed
+// ambiguously. Upload-pack and receive-pack requests pass the body of r
+// on, bounded by config.MaxRequestBodySize. The whole exchange, body
+// included, is bounded by config.ProxyTimeout.
+//
 // This method includes part of code from
 // https://golang.org/src/net/http/httputil/reverseproxy.go
-func proxyGitUploadPack(w http.ResponseWriter, r *http.Request, target string) {
-	outreq, _ := http.NewRequest("POST", target, r.Body)
-	outreq.Header = cloneHeader(r.Header)
-	outreq.Close = false
+func proxy(w http.ResponseWriter, r *http.Request, service, target string) {
+	if !requireUnambiguousFraming(w, r) {
+		return
+	}
+	// One snapshot throughout, whatever reloads happen meanwhile.
+	cfg := config()
+	repo := proxiedRepo(target)
+	releaseRepo, ok := repoLimits.acquire(repo)
+	if !ok {
+		pattern, max := repoLimitFor(repo)
+		logger.WarnContext(r.Context(), "too many requests in progress for the repository", "service", service, "repo", repo, "pattern", pattern, "max", max)
+		sendBusy(w)
+		return
+	}
+	defer releaseRepo()
 
-	cleanHopHeaders(outreq.Header)
+	if !slots.acquire() {
+		logger.WarnContext(r.Context(), "too many requests in progress", "service", service, "max", cfg.MaxConcurrentProxies)
+		sendBusy(w)
+		return
+	}
+	// Deferred so that the slot is given back even on panics.
+	defer slots.release()
+
+	var body io.Reader
+	if (service == serviceUploadPack || service == serviceReceivePack) && r.Method != "HEAD" {
+		if max := cfg.MaxRequestBodySize; max > 0 {
+			if r.ContentLength > max {
+				sendBodyTooLarge(w, r, max, r.ContentLength)
+				return
+			}
+			body = http.MaxBytesReader(w, r.Body, max)
+		} else {
+			body = r.Body
+		}
+	}
+
+	ctx := r.Context()
+	if cfg.ProxyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ProxyTimeout)
+		defer cancel()
+	}
 
-	res, err := httpClient.Do(outreq)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("gopkg.service", service))
+	// Ended once the response is copied, the copy being a child span.
+	ctx, span := tracer.Start(ctx, "github "+service, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	stats := ProxyStats{Service: service}
+	start := time.Now()
+	metrics.ProxyStarted(service)
+	defer func() {
+		stats.Duration = time.Since(start)
+		metrics.ProxyDone(stats)
+	}()
+
+	var res *http.Response
+	var err error
+	switch service {
+	case serviceUploadPack:
+		res, err = gitBackend.UploadPack(ctx, target, r, body)
+	case serviceReceivePack:
+		res, err = gitBackend.ReceivePack(ctx, target, r, body)
+	case serviceInfoRefs:
+		res, err = gitBackend.InfoRefs(ctx, target, r)
+	default:
+		res, err = gitBackend.Dumb(ctx, target, r)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	if err == ErrCircuitOpen {
+		sendCircuitOpen(w)
+		return
+	}
 	if err != nil {
-		fmt.Printf("github proxy error: %v\n", err)
-		w.WriteHeader(http.StatusBadGateway)
+		var targetErr *targetError
+		if errors.As(err, &targetErr) {
+			logger.ErrorContext(ctx, "cannot build GitHub request", "service", service, "target", target, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			sendBodyTooLarge(w, r, cfg.MaxRequestBodySize, -1)
+			return
+		}
+		var moved *movedError
+		if errors.As(err, &moved) {
+			sendMoved(w, r, moved)
+			return
+		}
+		if isHeaderTooLarge(err) {
+			logger.ErrorContext(ctx, "github response headers too large", "service", service, "target", target, "limit", cfg.MaxResponseHeaderBytes)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		status, kind := backendErrorStatus(err)
+		sampledLogger.ErrorContext(ctx, "github proxy error", "service", service, "target", target, "kind", kind, "err", err)
+		w.WriteHeader(status)
 		return
 	}
 
-	cleanHopHeaders(res.Header)
+	if res.Request == nil {
+		// As left out by fake backends.
+		res.Request = r.WithContext(ctx)
+	}
+	stats.Status = res.StatusCode
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	// Not modified responses to the conditional headers passed on keep
+	// the caching headers too.
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotModified {
+		setCacheHeaders(res.Header, service)
+	}
+
+	// Copying is a span of its own, telling slow transfers to the client
+	// apart from a slow GitHub.
+	_, copySpan := tracer.Start(ctx, "copy response")
+	stats.Bytes = writeResponse(cfg, w, res, isProtocolV2(r))
+	copySpan.SetAttributes(attribute.Int64("gopkg.bytes", stats.Bytes))
+	copySpan.End()
+}
+
+// userAgent returns the User-Agent set by cfg for requests to GitHub on
+// behalf of a client with the given one, which may be empty.
+func userAgent(cfg *Config, clientUA string) string {
+	if cfg.ForwardUserAgent && clientUA != "" {
+		return cfg.UserAgent + " " + clientUA
+	}
+	return cfg.UserAgent
+}
+
+// withQuery returns target with the given raw query, unless target
+// already has a query of its own or can't be parsed.
+func withQuery(target, rawQuery string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.RawQuery != "" || rawQuery == "" {
+		return target
+	}
+	u.RawQuery = rawQuery
+	return u.String()
+}
+
+// sendBodyTooLarge replies 413 to a request with a body over limit, of
+// the given size if known or -1 otherwise.
+func sendBodyTooLarge(w http.ResponseWriter, r *http.Request, limit, size int64) {
+	if size < 0 {
+		logger.WarnContext(r.Context(), "request body too large", "limit", limit)
+	} else {
+		logger.WarnContext(r.Context(), "request body too large", "limit", limit, "size", size)
+	}
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+}
+
+// writeResponse writes the backend response res, headers, body and
+// trailers, to w, closes the response body and returns the number of
+// body bytes written. When flush is set every chunk read from the backend
+// is flushed to the client right away, otherwise data is flushed at most
+// cfg.FlushInterval after written.
+func writeResponse(cfg *Config, w http.ResponseWriter, res *http.Response, flush bool) (written int64) {
+	cleanHopHeaders(res.Header, cfg.HopHeaders)
+	// The HSTS policy of GitHub is for its hosts, not ours.
+	res.Header.Del("Strict-Transport-Security")
 
 	copyHeader(w.Header(), res.Header)
+	if cfg.ViaPseudonym != "" {
+		w.Header().Add("Via", viaProtocol(res)+" "+cfg.ViaPseudonym)
+	}
 
 	// The "Trailer" header isn't included in the Transport's response,
 	// at least for *http.Transport. Build it up from Trailer.
@@ -71,12 +320,27 @@ func proxyGitUploadPack(w http.ResponseWriter, r *http.Request, target string) {
 		}
 	}
 
-	_, _ = io.Copy(w, res.Body)
+	if res.Request.Method != "HEAD" {
+		var dst io.Writer = w
+		if timeout := cfg.WriteIdleTimeout; timeout > 0 {
+			dst = &idleWriter{w: w, rc: http.NewResponseController(w), timeout: timeout}
+		}
+		if fl, ok := w.(http.Flusher); ok {
+			if flush || cfg.FlushInterval < 0 {
+				dst = flushWriter{dst, fl}
+			} else if cfg.FlushInterval > 0 {
+				lw := &latencyWriter{w: dst, fl: fl, latency: cfg.FlushInterval}
+				defer lw.stop()
+				dst = lw
+			}
+		}
+		written, _ = copyResponse(res.Request.Context(), cfg, dst, res.Body)
+	}
 	_ = res.Body.Close()
 
 	if len(res.Trailer) == announcedTrailers {
 		copyHeader(w.Header(), res.Trailer)
-		return
+		return written
 	}
 
 	for k, vv := range res.Trailer {
@@ -85,7 +349,178 @@ func proxyGitUploadPack(w http.ResponseWriter, r *http.Request, target string) {
 			w.Header().Add(k, v)
 		}
 	}
+	return written
+}
+
+// viaProtocol returns the protocol of res as given in a Via header,
+// "1.1" or "2" for instance. Responses of fake backends, without one,
+// are taken for HTTP/1.1.
+func viaProtocol(res *http.Response) string {
+	switch {
+	case res.ProtoMajor == 0:
+		return "1.1"
+	case res.ProtoMajor >= 2:
+		return strconv.Itoa(res.ProtoMajor)
+	}
+	return strconv.Itoa(res.ProtoMajor) + "." + strconv.Itoa(res.ProtoMinor)
+}
 
+// copyBufferPool holds the buffers used by copyResponse, so that
+// concurrent transfers don't allocate a new one per request. New ones
+// are empty, sized by copyResponse.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// copyResponse streams src into dst through a buffer of
+// cfg.CopyBufferSize bytes and returns the number of bytes written.
+// Errors caused by the client going away mid-transfer, as told by
+// isDisconnect, are not reported.
+func copyResponse(ctx context.Context, cfg *Config, dst io.Writer, src io.Reader) (int64, error) {
+	bp := copyBufferPool.Get().(*[]byte)
+	if len(*bp) != cfg.CopyBufferSize {
+		// New, or the size changed since the buffer was pooled.
+		b := make([]byte, cfg.CopyBufferSize)
+		bp = &b
+	}
+	defer copyBufferPool.Put(bp)
+
+	rr := &readErrRecorder{r: src}
+	n, err := io.CopyBuffer(dst, rr, *bp)
+	switch {
+	case rr.err != nil && isDisconnect(rr.err), err != nil && isDisconnect(err):
+		logger.DebugContext(ctx, "client disconnected during body copy", "bytes", n, "err", err)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.WarnContext(ctx, "client stalled during body copy, cut off", "bytes", n, "timeout", cfg.WriteIdleTimeout)
+	case rr.err != nil:
+		sampledLogger.ErrorContext(ctx, "github proxy error during body copy", "bytes", n, "err", rr.err)
+	case err != nil:
+		sampledLogger.ErrorContext(ctx, "github proxy error writing response", "bytes", n, "err", err)
+	}
+	return n, err
+}
+
+// isDisconnect reports whether err is the result of the client hanging
+// up, which is routine for git clients and not worth reporting.
+func isDisconnect(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// readErrRecorder records the error of reads from r other than io.EOF,
+// telling them apart from errors writing what was read.
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// isProtocolV2 reports whether the client negotiates the Git wire protocol
+// version 2 through the Git-Protocol header. The header itself is passed
+// on to GitHub verbatim by cloneHeader.
+//
+// A v2 response is a sequence of independent pkt-line sections separated
+// by flush (0000) and delimiter (0001) packets which the client handles as
+// they arrive, so it is streamed without waiting for net/http buffering.
+func isProtocolV2(r *http.Request) bool {
+	for _, v := range r.Header.Values("Git-Protocol") {
+		for _, f := range strings.Split(v, ":") {
+			if strings.TrimSpace(f) == "version=2" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flushWriter flushes the underlying response after every write.
+type flushWriter struct {
+	w  io.Writer
+	fl http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		fw.fl.Flush()
+	}
+	return n, err
+}
+
+// idleWriter moves the write deadline of the response w to timeout from
+// now before every write, so that a client that stops reading is cut off
+// once it has gone that long without taking any data, while one reading
+// slowly but steadily never is. Writers without deadlines, as in tests,
+// are written to as they are.
+type idleWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	if iw.rc != nil && iw.rc.SetWriteDeadline(time.Now().Add(iw.timeout)) != nil {
+		iw.rc = nil
+	}
+	return iw.w.Write(p)
+}
+
+// latencyWriter flushes the underlying response at most latency after
+// data is written to it, so that the client sees steady progress on a
+// long transfer. It must be stopped, with stop, once done writing.
+type latencyWriter struct {
+	w       io.Writer
+	fl      http.Flusher
+	latency time.Duration
+
+	mu      sync.Mutex // guards the fields below and writes to w
+	t       *time.Timer
+	pending bool // a flush is scheduled
+}
+
+func (lw *latencyWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	n, err := lw.w.Write(p)
+	if lw.pending {
+		return n, err
+	}
+	lw.pending = true
+	if lw.t == nil {
+		lw.t = time.AfterFunc(lw.latency, lw.delayedFlush)
+	} else {
+		lw.t.Reset(lw.latency)
+	}
+	return n, err
+}
+
+func (lw *latencyWriter) delayedFlush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if !lw.pending {
+		// Stopped in the meantime.
+		return
+	}
+	lw.fl.Flush()
+	lw.pending = false
+}
+
+func (lw *latencyWriter) stop() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.pending = false
+	if lw.t != nil {
+		lw.t.Stop()
+	}
 }
 
 func cloneHeader(h http.Header) http.Header {
@@ -98,6 +533,19 @@ func cloneHeader(h http.Header) http.Header {
 	return h2
 }
 
+// isHeaderTooLarge reports whether err is that of a response whose
+// headers went over the Transport.MaxResponseHeaderBytes set from
+// config.MaxResponseHeaderBytes, over HTTP/1 or HTTP/2. net/http exports
+// neither error, so they are told by their text.
+func isHeaderTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "server response headers exceeded") ||
+		strings.Contains(msg, "response header list larger than advertised limit")
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -106,16 +554,25 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func cleanHopHeaders(h http.Header) {
-	// Remove hop-by-hop headers listed in the "Connection" header.
-	// See RFC 2616, section 14.10.
-	if c := h.Get("Connection"); c != "" {
+// cleanHopHeaders removes the hop-by-hop headers from h, those of
+// hopHeaders and configured as well as those listed in Connection.
+func cleanHopHeaders(h http.Header, configured []string) {
+	// Remove hop-by-hop headers listed in the "Connection" header, on any
+	// of its lines. See RFC 7230, section 6.1. The tokens are all read
+	// before any removal, as one may name Connection itself or another
+	// hop-by-hop header.
+	var listed []string
+	for _, c := range h.Values("Connection") {
 		for _, f := range strings.Split(c, ",") {
 			if f = strings.TrimSpace(f); f != "" {
-				h.Del(f)
+				listed = append(listed, f)
 			}
 		}
 	}
+	for _, f := range listed {
+		h.Del(f)
+	}
+	h.Del("Connection")
 
 	// Remove hop-by-hop headers to the backend. Especially
 	// important is "Connection" because we want a persistent
@@ -125,4 +582,8 @@ func cleanHopHeaders(h http.Header) {
 			h.Del(hh)
 		}
 	}
+	// And those configured for the deployment.
+	for _, hh := range configured {
+		h.Del(hh)
+	}
 }
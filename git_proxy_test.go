@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ProxySuite{})
+
+type ProxySuite struct{}
+
+func (s *ProxySuite) SetUpTest(c *C) {
+	breaker = &circuitBreaker{now: time.Now}
+	refsCached = &refsCache{now: time.Now}
+	notFoundCached = &notFoundCache{now: time.Now}
+}
+
+func (s *ProxySuite) TestProxyInfoRefs(c *C) {
+	var gotQuery string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		c.Check(r.Method, Equals, "GET")
+		c.Check(r.URL.Path, Equals, "/go-aah/config/info/refs")
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte("001e# service=git-upload-pack\n0000"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(gotQuery, Equals, "service=git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/x-git-upload-pack-advertisement")
+	body, _ := ioutil.ReadAll(rec.Body)
+	c.Assert(string(body), Equals, "001e# service=git-upload-pack\n0000")
+}
+
+func (s *ProxySuite) TestProxyNotModified(c *C) {
+	defer func(ch map[string]CacheHeaders) { config().CacheHeaders = ch }(config().CacheHeaders)
+	config().CacheHeaders = map[string]CacheHeaders{serviceDumb: {CacheControl: "no-cache"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Thu, 29 Mar 2018 08:20:30 GMT")
+		if r.Header.Get("If-Modified-Since") == "Thu, 29 Mar 2018 08:20:30 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("0000000000000000000000000000000000000000 refs/heads/master\n"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs", nil)
+	req.Header.Set("If-Modified-Since", "Thu, 29 Mar 2018 08:20:30 GMT")
+	rec := httptest.NewRecorder()
+	proxyDumb(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), Equals, 0)
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, "Thu, 29 Mar 2018 08:20:30 GMT")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "no-cache")
+}
+
+func (s *ProxySuite) TestProxyUpstreamProxy(c *C) {
+	var gotURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Proxies are sent the absolute URL.
+		gotURL = r.URL.String()
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte("001e# service=git-upload-pack\n0000"))
+	}))
+	defer upstream.Close()
+	cfg := newConfig()
+	cfg.UpstreamProxy = upstream.URL
+	defer func(client *http.Client) { httpClient = client }(httpClient)
+	httpClient = newHTTPClient(cfg)
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, "http://github.invalid/go-aah/config/info/refs")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(gotURL, Equals, "http://github.invalid/go-aah/config/info/refs?service=git-upload-pack")
+	c.Assert(rec.Body.String(), Equals, "001e# service=git-upload-pack\n0000")
+}
+
+func (s *ProxySuite) TestProxyBackendDown(c *C) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+}
+
+// A recorded protocol v2 ls-refs exchange with GitHub.
+const (
+	lsRefsRequest = "0014command=ls-refs\n" +
+		"0015agent=git/2.30.1\n" +
+		"0001" +
+		"0009peel\n" +
+		"000csymrefs\n" +
+		"0014ref-prefix HEAD\n" +
+		"001bref-prefix refs/heads/\n" +
+		"001aref-prefix refs/tags/\n" +
+		"0000"
+	lsRefsResponse = "0052a3c1a5ee544ca7d16923fe8ed3b86e88b8ff40c8 HEAD symref-target:refs/heads/master\n" +
+		"003fa3c1a5ee544ca7d16923fe8ed3b86e88b8ff40c8 refs/heads/master\n" +
+		"003b0fa3ac93c1b20f2e4ed2de6a5c5f0c938e8d048e refs/heads/v1\n" +
+		"0000"
+)
+
+func (s *ProxySuite) TestProxyProtocolV2(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Git-Protocol"), Equals, "version=2")
+		body, _ := ioutil.ReadAll(r.Body)
+		c.Check(string(body), Equals, lsRefsRequest)
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		_, _ = w.Write([]byte(lsRefsResponse))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader(lsRefsRequest))
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Flushed, Equals, true)
+	c.Assert(rec.Body.String(), Equals, lsRefsResponse)
+}
+
+func (s *ProxySuite) TestIsProtocolV2(c *C) {
+	req := httptest.NewRequest("GET", "/", nil)
+	c.Assert(isProtocolV2(req), Equals, false)
+	req.Header.Set("Git-Protocol", "version=1")
+	c.Assert(isProtocolV2(req), Equals, false)
+	req.Header.Set("Git-Protocol", "object-format=sha1:version=2")
+	c.Assert(isProtocolV2(req), Equals, true)
+}
+
+func (s *ProxySuite) TestProxyGitReceivePackNoAuth(c *C) {
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitReceivePack(rec, req, backend.URL+"/go-aah/config/git-receive-pack")
+
+	c.Assert(called, Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusUnauthorized)
+	c.Assert(rec.Header().Get("WWW-Authenticate"), Not(Equals), "")
+}
+
+func (s *ProxySuite) TestProxyGitReceivePack(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic Z29vZDpzZWNyZXQ=" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("denied"))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		c.Check(string(body), Equals, "pack")
+		w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+		_, _ = w.Write([]byte("0000"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("pack"))
+	req.SetBasicAuth("good", "secret")
+	rec := httptest.NewRecorder()
+	proxyGitReceivePack(rec, req, backend.URL+"/go-aah/config/git-receive-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/x-git-receive-pack-result")
+	c.Assert(rec.Body.String(), Equals, "0000")
+
+	req = httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("pack"))
+	req.SetBasicAuth("bad", "secret")
+	rec = httptest.NewRecorder()
+	proxyGitReceivePack(rec, req, backend.URL+"/go-aah/config/git-receive-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(rec.Body.String(), Equals, "denied")
+}
+
+func (s *ProxySuite) BenchmarkCopyResponse(c *C) {
+	data := bytes.Repeat([]byte("x"), 128*1024)
+	c.SetBytes(int64(len(data)))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		_, _ = copyResponse(context.Background(), config(), ioutil.Discard, bytes.NewReader(data))
+	}
+}
+
+func (s *ProxySuite) TestProxyTimeout(c *C) {
+	done := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(done)
+
+	defer func(d time.Duration) { config().ProxyTimeout = d }(config().ProxyTimeout)
+	config().ProxyTimeout = 50 * time.Millisecond
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusGatewayTimeout)
+}
+
+// timeoutError is a net.Error timing out, as a dial or a TLS handshake
+// does.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (s *ProxySuite) TestBackendErrorStatus(c *C) {
+	for _, t := range []struct {
+		err    error
+		status int
+		kind   string
+	}{
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout"},
+		{fmt.Errorf("cannot talk to GitHub: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "timeout"},
+		{&url.Error{Op: "Post", URL: "https://github.com", Err: timeoutError{}}, http.StatusGatewayTimeout, "timeout"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, http.StatusBadGateway, "unreachable"},
+		{&net.DNSError{Err: "no such host", Name: "github.com", IsNotFound: true}, http.StatusBadGateway, "unreachable"},
+		{errors.New("error from GitHub: 500 Internal Server Error"), http.StatusBadGateway, "unreachable"},
+	} {
+		status, kind := backendErrorStatus(t.err)
+		c.Check(status, Equals, t.status, Commentf("error %v", t.err))
+		c.Check(kind, Equals, t.kind, Commentf("error %v", t.err))
+	}
+}
+
+func (s *ProxySuite) TestProxyDropsBackendHSTS(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubdomains; preload")
+		_, _ = w.Write([]byte("0008NAK\n"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header()["Strict-Transport-Security"], IsNil)
+}
+
+func (s *ProxySuite) TestProxyInfoRefsRetry(c *C) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("refs"))
+	}))
+	defer backend.Close()
+
+	defer func(d time.Duration) { config().RetryBaseDelay = d }(config().RetryBaseDelay)
+	config().RetryBaseDelay = time.Millisecond
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(calls, Equals, 3)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "refs")
+}
+
+func (s *ProxySuite) TestProxyNoRetryWithBody(c *C) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(calls, Equals, 1)
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *ProxySuite) TestBackoff(c *C) {
+	for n := 1; n <= 4; n++ {
+		d := backoff(100*time.Millisecond, n)
+		max := 100 * time.Millisecond << uint(n-1)
+		c.Assert(d >= max/2 && d <= max, Equals, true, Commentf("retry %d waited %v", n, d))
+	}
+	c.Assert(backoff(0, 1), Equals, time.Duration(0))
+}
+
+func (s *ProxySuite) TestProxyBodyTooLarge(c *C) {
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer backend.Close()
+
+	defer func(n int64) { config().MaxRequestBodySize = n }(config().MaxRequestBodySize)
+	config().MaxRequestBodySize = 8
+
+	// Known to be too large upfront.
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0123456789"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(called, Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	// Found out while streaming.
+	req = httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0123456789"))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	// Within the limit.
+	req = httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("01234567"))
+	rec = httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestProxyTooManyRequests(c *C) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "60")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(calls, Equals, 1)
+	c.Assert(rec.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "60")
+}
+
+func (s *ProxySuite) TestProxyTooManyRequestsRetry(c *C) {
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("refs"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(calls, Equals, 2)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+}
+
+func (s *ProxySuite) TestParseRetryAfter(c *C) {
+	d, ok := parseRetryAfter("120")
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 2*time.Minute)
+
+	d, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	c.Assert(ok, Equals, true)
+	c.Assert(d > 59*time.Minute, Equals, true)
+
+	_, ok = parseRetryAfter("soon")
+	c.Assert(ok, Equals, false)
+	_, ok = parseRetryAfter("-1")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ProxySuite) TestProxyQuery(c *C) {
+	var gotURI string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack?a=1&b=%2F", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(gotURI, Equals, "/go-aah/config/git-upload-pack?a=1&b=%2F")
+
+	req = httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs?service=git-upload-pack")
+	c.Assert(gotURI, Equals, "/go-aah/config/info/refs?service=git-upload-pack")
+}
+
+func (s *ProxySuite) TestWithQuery(c *C) {
+	c.Assert(withQuery("https://github.com/go-aah/config/info/refs", "service=git-upload-pack"), Equals,
+		"https://github.com/go-aah/config/info/refs?service=git-upload-pack")
+	c.Assert(withQuery("https://github.com/go-aah/config/info/refs?x=1", "service=git-upload-pack"), Equals,
+		"https://github.com/go-aah/config/info/refs?x=1")
+	c.Assert(withQuery("https://github.com/go-aah/config/git-upload-pack", ""), Equals,
+		"https://github.com/go-aah/config/git-upload-pack")
+}
+
+func (s *ProxySuite) TestProxyBadTarget(c *C) {
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, "https://github.com/go-aah/%zz/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+}
+
+func (s *ProxySuite) TestProxyUserAgent(c *C) {
+	var gotUA string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.UserAgent()
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("User-Agent", "git/2.30.1")
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(gotUA, Equals, "gopkg-git-proxy/dev (+https://github.com/go-aah/gopkg) git/2.30.1")
+
+	defer func(ua string, fwd bool) {
+		config().UserAgent, config().ForwardUserAgent = ua, fwd
+	}(config().UserAgent, config().ForwardUserAgent)
+	config().UserAgent = "aah-proxy/1.0"
+	config().ForwardUserAgent = false
+
+	req = httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("User-Agent", "git/2.30.1")
+	rec = httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+	c.Assert(gotUA, Equals, "aah-proxy/1.0")
+}
+
+func (s *ProxySuite) TestProxyHead(c *C) {
+	var gotMethod string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte("001e# service=git-upload-pack\n0000"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("HEAD", "/config.v1/git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(gotMethod, Equals, "HEAD")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/x-git-upload-pack-advertisement")
+	c.Assert(rec.Body.Len(), Equals, 0)
+
+	req = httptest.NewRequest("HEAD", "/config.v1/info/refs?service=git-receive-pack", nil)
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(gotMethod, Equals, "HEAD")
+	c.Assert(rec.Body.Len(), Equals, 0)
+}
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan string
+}
+
+func (fr flushRecorder) Flush() {
+	fr.flushes <- fr.Body.String()
+}
+
+func (s *ProxySuite) TestLatencyWriter(c *C) {
+	rec := flushRecorder{httptest.NewRecorder(), make(chan string, 10)}
+	lw := &latencyWriter{w: rec, fl: rec, latency: 10 * time.Millisecond}
+
+	_, _ = lw.Write([]byte("one"))
+	_, _ = lw.Write([]byte("two"))
+	select {
+	case got := <-rec.flushes:
+		c.Assert(got, Equals, "onetwo")
+	case <-time.After(time.Second):
+		c.Fatalf("no flush")
+	}
+
+	_, _ = lw.Write([]byte("three"))
+	lw.stop()
+	select {
+	case got := <-rec.flushes:
+		c.Fatalf("flushed %q after stop", got)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+type failingReader struct{ err error }
+
+func (r failingReader) Read(p []byte) (int, error) { return 0, r.err }
+
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return len(p) / 2, nil }
+
+func (s *ProxySuite) TestCopyResponse(c *C) {
+	var buf bytes.Buffer
+	n, err := copyResponse(context.Background(), config(), &buf, strings.NewReader("packfile"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(8))
+	c.Assert(buf.String(), Equals, "packfile")
+
+	_, err = copyResponse(context.Background(), config(), &buf, failingReader{context.Canceled})
+	c.Assert(err, Equals, context.Canceled)
+
+	_, err = copyResponse(context.Background(), config(), shortWriter{}, strings.NewReader("packfile"))
+	c.Assert(err, Equals, io.ErrShortWrite)
+}
+
+func (s *ProxySuite) TestIsDisconnect(c *C) {
+	c.Assert(isDisconnect(context.Canceled), Equals, true)
+	c.Assert(isDisconnect(&net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}), Equals, true)
+	c.Assert(isDisconnect(&net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}), Equals, true)
+	c.Assert(isDisconnect(fmt.Errorf("closing: %w", net.ErrClosed)), Equals, true)
+	c.Assert(isDisconnect(io.ErrUnexpectedEOF), Equals, false)
+	c.Assert(isDisconnect(context.DeadlineExceeded), Equals, false)
+}
+
+func (s *ProxySuite) TestProxyMetrics(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("0008NAK\n"))
+	}))
+	defer backend.Close()
+
+	var got []ProxyStats
+	defer func(m Metrics) { metrics = m }(metrics)
+	metrics = MetricsFunc(func(s ProxyStats) { got = append(got, s) })
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	proxyGitUploadPack(httptest.NewRecorder(), req, backend.URL+"/go-aah/config/git-upload-pack")
+	req = httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	proxyInfoRefs(httptest.NewRecorder(), req, backend.URL+"/down")
+	req = httptest.NewRequest("GET", "/config.v1/info/refs?service=git-receive-pack", nil)
+	proxyInfoRefs(httptest.NewRecorder(), req, "http://127.0.0.1:1/down")
+
+	c.Assert(got, HasLen, 3)
+	c.Assert(got[0].Service, Equals, serviceUploadPack)
+	c.Assert(got[0].Status, Equals, http.StatusOK)
+	c.Assert(got[0].Bytes, Equals, int64(8))
+	c.Assert(got[0].Duration > 0, Equals, true)
+	c.Assert(got[1].Service, Equals, serviceInfoRefs)
+	c.Assert(got[1].Status, Equals, http.StatusNotFound)
+	c.Assert(got[1].Bytes, Equals, int64(0))
+	c.Assert(got[2].Status, Equals, 0)
+}
+
+func (s *ProxySuite) TestCleanHopHeaders(c *C) {
+	h := http.Header{}
+	h.Set("Connection", "close, X-Trace-Hop")
+	h.Set("X-Trace-Hop", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Edge-Conn", "42")
+	h.Set("Git-Protocol", "version=2")
+
+	cleanHopHeaders(h, nil)
+	c.Assert(h, DeepEquals, http.Header{"X-Edge-Conn": {"42"}, "Git-Protocol": {"version=2"}})
+
+	cleanHopHeaders(h, []string{"x-edge-conn"})
+	c.Assert(h, DeepEquals, http.Header{"Git-Protocol": {"version=2"}})
+}
+
+func (s *ProxySuite) TestCleanHopHeadersConnection(c *C) {
+	h := http.Header{}
+	h.Set("Connection", "X-Custom, close")
+	h.Set("X-Custom", "1")
+	cleanHopHeaders(h, nil)
+	c.Assert(h, DeepEquals, http.Header{})
+
+	// Naming itself or other hop-by-hop headers, on several lines.
+	h = http.Header{}
+	h.Add("Connection", "Connection, keep-alive")
+	h.Add("Connection", "x-second-line,, TE")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("X-Second-Line", "1")
+	h.Set("Te", "trailers")
+	h.Set("Git-Protocol", "version=2")
+	cleanHopHeaders(h, nil)
+	c.Assert(h, DeepEquals, http.Header{"Git-Protocol": {"version=2"}})
+}
+
+func (s *ProxySuite) TestProxyStalledClient(c *C) {
+	defer func(timeout time.Duration) { config().WriteIdleTimeout = timeout }(config().WriteIdleTimeout)
+	config().WriteIdleTimeout = 100 * time.Millisecond
+
+	// GitHub streams for as long as anyone reads.
+	released := make(chan bool, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { released <- true }()
+		chunk := bytes.Repeat([]byte("PACK"), 8<<10)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	done := make(chan bool, 1)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { done <- true }()
+		proxyGitUploadPack(w, r, backend.URL+"/go-aah/config/git-upload-pack")
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_ = conn.(*net.TCPConn).SetReadBuffer(4096)
+	_, err = io.WriteString(conn, "POST /config.v1/git-upload-pack HTTP/1.1\r\nHost: gopkg.in\r\nContent-Length: 4\r\n\r\n0000")
+	c.Assert(err, IsNil)
+
+	// Never read, and cut off, the GitHub connection with it.
+	for _, ch := range []chan bool{done, released} {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			c.Fatal("stalled client not cut off")
+		}
+	}
+}
+
+func (s *ProxySuite) TestProxySlowClient(c *C) {
+	defer func(timeout time.Duration) { config().WriteIdleTimeout = timeout }(config().WriteIdleTimeout)
+	config().WriteIdleTimeout = 100 * time.Millisecond
+
+	// Steady, but taking longer than the timeout on the whole.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 6; i++ {
+			_, _ = w.Write([]byte("PACK"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyGitUploadPack(w, r, backend.URL+"/go-aah/config/git-upload-pack")
+	}))
+	defer front.Close()
+
+	res, err := http.Post(front.URL+"/config.v1/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, strings.Repeat("PACK", 6))
+}
+
+func (s *ProxySuite) TestProxyResponseHeaderTooLarge(c *C) {
+	defer func(client *http.Client) { httpClient = client }(httpClient)
+	cfg := newConfig()
+	cfg.MaxResponseHeaderBytes = 1 << 10
+	httpClient = newHTTPClient(cfg)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 100; i++ {
+			w.Header().Add("X-Padding", strings.Repeat("x", 20))
+		}
+		_, _ = w.Write([]byte("0000"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+	c.Assert(rec.Header().Values("X-Padding"), HasLen, 0)
+	c.Assert(rec.Body.Len(), Equals, 0)
+
+	httpClient = newHTTPClient(newConfig())
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Values("X-Padding"), HasLen, 100)
+}
+
+func (s *ProxySuite) TestProxyResponseHeaderTooLargeHTTP2(c *C) {
+	var log bytes.Buffer
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.ProtoMajor, Equals, 2)
+		for i := 0; i < 100; i++ {
+			w.Header().Add("X-Padding", strings.Repeat("x", 20))
+		}
+		_, _ = w.Write([]byte("0000"))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	defer func(client *http.Client) { httpClient = client }(httpClient)
+	cfg := newConfig()
+	cfg.MaxResponseHeaderBytes = 1 << 10
+	httpClient = newHTTPClient(cfg)
+	httpClient.Transport.(*http.Transport).TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+	c.Assert(rec.Header().Values("X-Padding"), HasLen, 0)
+	c.Assert(log.String(), Matches, `(?s).*msg="github response headers too large".*`)
+}
+
+func (s *ProxySuite) TestIsHeaderTooLarge(c *C) {
+	c.Assert(isHeaderTooLarge(nil), Equals, false)
+	c.Assert(isHeaderTooLarge(errors.New("net/http: server response headers exceeded 1024 bytes; aborted")), Equals, true)
+	c.Assert(isHeaderTooLarge(errors.New("stream error: stream ID 1; PROTOCOL_ERROR; http2: response header list larger than advertised limit")), Equals, true)
+	c.Assert(isHeaderTooLarge(io.ErrUnexpectedEOF), Equals, false)
+}
+
+func (s *ProxySuite) TestProxyVia(c *C) {
+	defer func(via string) { config().ViaPseudonym = via }(config().ViaPseudonym)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "1.1 varnish")
+		_, _ = w.Write([]byte("0000"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Header().Values("Via"), DeepEquals, []string{"1.1 varnish", "1.1 gopkg-proxy"})
+
+	config().ViaPseudonym = ""
+	rec = httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+	c.Assert(rec.Header().Values("Via"), DeepEquals, []string{"1.1 varnish"})
+}
+
+func (s *ProxySuite) TestViaProtocol(c *C) {
+	c.Assert(viaProtocol(&http.Response{ProtoMajor: 1, ProtoMinor: 1}), Equals, "1.1")
+	c.Assert(viaProtocol(&http.Response{ProtoMajor: 1, ProtoMinor: 0}), Equals, "1.0")
+	c.Assert(viaProtocol(&http.Response{ProtoMajor: 2}), Equals, "2")
+	c.Assert(viaProtocol(&http.Response{}), Equals, "1.1")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the body size below which responses aren't compressed,
+// as gzip would save little, if anything, on them. The go-get pages, a
+// few hundred bytes, are just over it.
+const gzipMinSize = 256
+
+// gzipTypes are the media types of the responses compressed: the go-get
+// pages, the module version lists and .mod files, and the JSON of the
+// module info and the version endpoint. Module zips and packfiles are
+// compressed already and stay out.
+var gzipTypes = map[string]bool{
+	"text/html":        true,
+	"text/plain":       true,
+	"application/json": true,
+}
+
+// gitSuffixes end the paths of the git smart HTTP endpoints, whose
+// responses are streamed as GitHub sends them, encoding included.
+var gitSuffixes = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"}
+
+// withGzip wraps h so that its text responses of at least gzipMinSize
+// bytes are gzipped for the clients accepting it. The git endpoints are
+// left alone whatever their responses, as are responses already encoded.
+func withGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" || !acceptsGzip(r) || isGitPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		h.ServeHTTP(gw, r)
+		_ = gw.close()
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r includes gzip,
+// with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(enc, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func isGitPath(path string) bool {
+	for _, suffix := range gitSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter holds back the start of a response until it knows whether
+// to compress it: when the handler is done, flushes, or has written
+// gzipMinSize bytes.
+type gzipWriter struct {
+	http.ResponseWriter
+	code    int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.decided || w.code != 0 {
+		return
+	}
+	w.code = code
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified {
+		// No body to compress.
+		_ = w.decide(false)
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the headers held back, compressing what follows when big
+// is set and the response is of one of gzipTypes, and writes the body
+// buffered so far.
+func (w *gzipWriter) decide(big bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// As net/http would, once written.
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if gzipTypes[mediaType] && h.Get("Content-Encoding") == "" {
+		h.Add("Vary", "Accept-Encoding")
+		if big {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what is held back, compressed if big enough already.
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(len(w.buf) >= gzipMinSize)
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close ends the response, sending it as is when it stayed under
+// gzipMinSize.
+func (w *gzipWriter) close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&GzipSuite{})
+
+type GzipSuite struct{}
+
+var bigPage = "<html><body>" + strings.Repeat("<meta name=\"go-import\">", 100) + "</body></html>"
+
+// serveGzip serves a request for path, accepting the encoding given,
+// with a handler writing body as contentType.
+func serveGzip(path, accept, contentType, body string) *httptest.ResponseRecorder {
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	req := httptest.NewRequest("GET", path, nil)
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func gunzip(c *C, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	plain, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(plain)
+}
+
+func (s *GzipSuite) TestCompress(c *C) {
+	for _, contentType := range []string{"text/html", "text/plain; charset=utf-8", "application/json", ""} {
+		rec := serveGzip("/config.v1", "deflate, gzip", contentType, bigPage)
+		c.Assert(rec.Code, Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("Content-Encoding"), Equals, "gzip", Commentf("type %q", contentType))
+		c.Assert(rec.Header().Get("Vary"), Equals, "Accept-Encoding")
+		c.Assert(rec.Body.Len() < len(bigPage), Equals, true)
+		c.Assert(gunzip(c, rec.Body.Bytes()), Equals, bigPage)
+	}
+}
+
+func (s *GzipSuite) TestSmall(c *C) {
+	rec := serveGzip("/config.v1", "gzip", "text/html", "<html></html>")
+	c.Assert(rec.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(rec.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(rec.Body.String(), Equals, "<html></html>")
+}
+
+func (s *GzipSuite) TestNotCompressed(c *C) {
+	for _, t := range []struct{ path, accept, contentType string }{
+		{"/config.v1", "", "text/html"},
+		{"/config.v1", "identity", "text/html"},
+		{"/config.v1", "gzip;q=0", "text/html"},
+		{"/aahframe.work/config.v1/@v/v1.2.0.zip", "gzip", "application/zip"},
+		{"/config.v1/git-upload-pack", "gzip", "text/plain"},
+		{"/config.v1.git/info/refs", "gzip", "application/x-git-upload-pack-advertisement"},
+	} {
+		rec := serveGzip(t.path, t.accept, t.contentType, bigPage)
+		c.Check(rec.Header().Get("Content-Encoding"), Equals, "", Commentf("%+v", t))
+		c.Check(rec.Body.String(), Equals, bigPage, Commentf("%+v", t))
+	}
+}
+
+func (s *GzipSuite) TestAlreadyEncoded(c *C) {
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = w.Write([]byte(bigPage))
+	}))
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Header().Get("Content-Encoding"), Equals, "br")
+	c.Assert(rec.Body.String(), Equals, bigPage)
+}
+
+func (s *GzipSuite) TestStatus(c *C) {
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(bigPage))
+	}))
+	req := httptest.NewRequest("GET", "/no/such.v1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(gunzip(c, rec.Body.Bytes()), Equals, bigPage)
+}
+
+func (s *GzipSuite) TestFlush(c *C) {
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("v1.0.0\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(bigPage))
+	}))
+	req := httptest.NewRequest("GET", "/aahframe.work/config.v1/@v/list", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Flushed, Equals, true)
+	c.Assert(rec.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(rec.Body.String(), Equals, "v1.0.0\n"+bigPage)
+}
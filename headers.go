@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withResponseHeaders wraps h so that every response carries the headers
+// of config.ResponseHeaders, for security policies and CDNs. They are set
+// once h writes its response, and only where h left them unset, unless
+// config.OverrideResponseHeaders is set.
+func withResponseHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(config().ResponseHeaders) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hw := &headerWriter{ResponseWriter: w, headers: config().ResponseHeaders, override: config().OverrideResponseHeaders}
+		h.ServeHTTP(hw, r)
+		// Responses left empty too.
+		hw.apply()
+	})
+}
+
+// headerWriter sets headers on the response written through it, right
+// before its status goes out.
+type headerWriter struct {
+	http.ResponseWriter
+	headers  map[string]string
+	override bool
+	applied  bool
+}
+
+func (w *headerWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.Header()
+	for key, value := range w.headers {
+		if w.override || h.Get(key) == "" {
+			h.Set(key, value)
+		}
+	}
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses flushed when the underlying writer
+// supports it.
+func (w *headerWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.apply()
+		fl.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// validHeaderName reports whether name may be used as a header name: a
+// non-empty HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HeadersSuite{})
+
+type HeadersSuite struct {
+	running *Config
+}
+
+func (s *HeadersSuite) SetUpTest(c *C) {
+	s.running = config()
+	cfg := *s.running
+	cfg.ResponseHeaders = map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "no-referrer",
+		"X-Proxy-Region":         "eu-west",
+	}
+	liveConfig.Store(&cfg)
+}
+
+func (s *HeadersSuite) TearDownTest(c *C) {
+	liveConfig.Store(s.running)
+}
+
+func (s *HeadersSuite) serve(h http.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	withResponseHeaders(h).ServeHTTP(rec, httptest.NewRequest("GET", "/config.v1", nil))
+	return rec
+}
+
+func (s *HeadersSuite) TestResponseHeaders(c *C) {
+	rec := s.serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Region", "us-east")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	})
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+	c.Assert(rec.Header().Get("Referrer-Policy"), Equals, "no-referrer")
+	// Set by the handler.
+	c.Assert(rec.Header().Get("X-Proxy-Region"), Equals, "us-east")
+
+	// Nothing written.
+	rec = s.serve(func(w http.ResponseWriter, r *http.Request) {})
+	c.Assert(rec.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+}
+
+func (s *HeadersSuite) TestOverride(c *C) {
+	config().OverrideResponseHeaders = true
+	rec := s.serve(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Region", "us-east")
+		_, _ = w.Write([]byte("ok"))
+	})
+	c.Assert(rec.Header().Get("X-Proxy-Region"), Equals, "eu-west")
+}
+
+func (s *HeadersSuite) TestFlush(c *C) {
+	rec := s.serve(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Late", "ignored")
+	})
+	c.Assert(rec.Flushed, Equals, true)
+	c.Assert(rec.Header().Get("X-Content-Type-Options"), Equals, "nosniff")
+}
+
+func (s *HeadersSuite) TestValidHeaderName(c *C) {
+	for _, name := range []string{"X-Proxy-Region", "Referrer-Policy", "x_custom"} {
+		c.Check(validHeaderName(name), Equals, true, Commentf("name %q", name))
+	}
+	for _, name := range []string{"", "X Proxy", "X-Proxy:", "Région", "X-\n"} {
+		c.Check(validHeaderName(name), Equals, false, Commentf("name %q", name))
+	}
+}
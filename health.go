@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// readyCheckTimeout bounds the reachability check of GitHub.
+	readyCheckTimeout = 2 * time.Second
+
+	// readyCheckTTL is how long the outcome of a reachability check is
+	// reused, so that frequent readiness probes don't all reach GitHub.
+	readyCheckTTL = 5 * time.Second
+)
+
+// readiness checks that GitHub can be reached, remembering the outcome
+// of the last check for readyCheckTTL.
+type readiness struct {
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+
+	now func() time.Time
+}
+
+var ready = &readiness{now: time.Now}
+
+// check returns why GitHub can't be reached, if so. Concurrent callers
+// wait for the check in progress rather than starting their own.
+func (rd *readiness) check(ctx context.Context) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && rd.now().Sub(rd.checked) < readyCheckTTL {
+		return rd.err
+	}
+	rd.err = pingBackend(ctx)
+	rd.checked = rd.now()
+	return rd.err
+}
+
+// pingBackend sends a HEAD request to the GitHub instance in use. Any
+// answer but a server error means it is reachable.
+func pingBackend(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", config().BackendBaseURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent(config(), ""))
+	res, err := clientFor(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("GitHub answered %s", res.Status)
+	}
+	return nil
+}
+
+// serveHealthz answers liveness probes: the process is up.
+func serveHealthz(resp http.ResponseWriter, req *http.Request) {
+	_, _ = resp.Write([]byte("ok"))
+}
+
+// serveReadyz answers readiness probes, failing with 503 Service
+// Unavailable while shutting down, while the caches are warmed on
+// startup, while the circuit breaker is open or when GitHub can't be
+// reached.
+func serveReadyz(resp http.ResponseWriter, req *http.Request) {
+	var reason string
+	if draining.Load() {
+		reason = "shutting down"
+	} else if warming.Load() {
+		reason = "warming caches"
+	} else if state := breaker.State(); state != breakerClosed {
+		reason = "circuit breaker " + state.String()
+	} else if err := ready.check(req.Context()); err != nil {
+		reason = "GitHub unreachable: " + err.Error()
+	}
+	if reason != "" {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = resp.Write([]byte(reason))
+		return
+	}
+	_, _ = resp.Write([]byte("ok"))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HealthSuite{})
+
+type HealthSuite struct {
+	now     time.Time
+	pings   int
+	status  int
+	github  *httptest.Server
+	restore func()
+}
+
+func (s *HealthSuite) SetUpTest(c *C) {
+	s.pings = 0
+	s.status = http.StatusOK
+	s.github = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.pings++
+		w.WriteHeader(s.status)
+	}))
+
+	client, base, rd, b := httpClient, config().BackendBaseURL, ready, breaker
+	s.restore = func() {
+		httpClient, config().BackendBaseURL, ready, breaker = client, base, rd, b
+	}
+	httpClient = s.github.Client()
+	config().BackendBaseURL = s.github.URL
+	s.now = time.Date(2018, 3, 29, 0, 0, 0, 0, time.UTC)
+	ready = &readiness{now: func() time.Time { return s.now }}
+	breaker = &circuitBreaker{now: func() time.Time { return s.now }}
+}
+
+func (s *HealthSuite) TearDownTest(c *C) {
+	s.restore()
+	s.github.Close()
+}
+
+func (s *HealthSuite) serve(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func (s *HealthSuite) TestHealthz(c *C) {
+	defer draining.Store(false)
+	c.Assert(s.serve("/healthz").Code, Equals, http.StatusOK)
+	s.github.Close()
+	draining.Store(true)
+	c.Assert(s.serve("/healthz").Code, Equals, http.StatusOK)
+}
+
+func (s *HealthSuite) TestReadyz(c *C) {
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "ok")
+	c.Assert(s.pings, Equals, 1)
+}
+
+func (s *HealthSuite) TestReadyzCached(c *C) {
+	s.serve("/readyz")
+	s.status = http.StatusInternalServerError
+	c.Assert(s.serve("/readyz").Code, Equals, http.StatusOK)
+	c.Assert(s.pings, Equals, 1)
+
+	s.now = s.now.Add(readyCheckTTL)
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), Equals, "GitHub unreachable: GitHub answered 500 Internal Server Error")
+	c.Assert(s.pings, Equals, 2)
+}
+
+func (s *HealthSuite) TestReadyzUnreachable(c *C) {
+	s.github.Close()
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), Matches, "GitHub unreachable: .*")
+}
+
+func (s *HealthSuite) TestReadyzBreakerOpen(c *C) {
+	for i := 0; i < config().BreakerThreshold; i++ {
+		breaker.record(false)
+	}
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), Equals, "circuit breaker open")
+	c.Assert(s.pings, Equals, 0)
+}
+
+func (s *HealthSuite) TestReadyzDraining(c *C) {
+	defer draining.Store(false)
+	draining.Store(true)
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), Equals, "shutting down")
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// withHSTS wraps h so that responses to requests that came over HTTPS
+// have Strict-Transport-Security set as configured, when config.HSTSMaxAge
+// is positive. Requests count as HTTPS when received over TLS, or when
+// X-Forwarded-Proto says so and config.TrustedHops trusts the proxy that
+// set it.
+func withHSTS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config().HSTSMaxAge > 0 && isHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", hstsValue())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hstsValue returns the Strict-Transport-Security header value for the
+// HSTS settings in config.
+func hstsValue() string {
+	v := "max-age=" + strconv.FormatInt(int64(config().HSTSMaxAge/time.Second), 10)
+	if config().HSTSIncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if config().HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// isHTTPS reports whether r reached us, or the trusted proxies in front
+// of us, over HTTPS.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return config().TrustedHops > 0 && r.Header.Get("X-Forwarded-Proto") == "https"
+}
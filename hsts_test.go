@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HSTSSuite{})
+
+type HSTSSuite struct {
+	saved Config
+}
+
+func (s *HSTSSuite) SetUpTest(c *C) {
+	s.saved = *config()
+}
+
+func (s *HSTSSuite) TearDownTest(c *C) {
+	*config() = s.saved
+}
+
+func (s *HSTSSuite) serve(req *http.Request) string {
+	rec := httptest.NewRecorder()
+	withHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})).ServeHTTP(rec, req)
+	return rec.Header().Get("Strict-Transport-Security")
+}
+
+func (s *HSTSSuite) TestOffByDefault(c *C) {
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	req.TLS = &tls.ConnectionState{}
+	c.Assert(s.serve(req), Equals, "")
+}
+
+func (s *HSTSSuite) TestHTTPS(c *C) {
+	config().HSTSMaxAge = 365 * 24 * time.Hour
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	c.Assert(s.serve(req), Equals, "")
+
+	req.TLS = &tls.ConnectionState{}
+	c.Assert(s.serve(req), Equals, "max-age=31536000")
+
+	config().HSTSIncludeSubDomains = true
+	config().HSTSPreload = true
+	c.Assert(s.serve(req), Equals, "max-age=31536000; includeSubDomains; preload")
+}
+
+func (s *HSTSSuite) TestForwardedProto(c *C) {
+	config().HSTSMaxAge = time.Hour
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	c.Assert(s.serve(req), Equals, "")
+
+	config().TrustedHops = 1
+	c.Assert(s.serve(req), Equals, "max-age=3600")
+
+	req.Header.Set("X-Forwarded-Proto", "http")
+	c.Assert(s.serve(req), Equals, "")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+//go:embed landing.html
+var landingFS embed.FS
+
+// landingTemplate is the page served to browsers at the root, that of
+// landing.html unless replaced by loadLandingPage.
+var landingTemplate = template.Must(template.ParseFS(landingFS, "landing.html"))
+
+// landingData is what the landing page template is executed with.
+type landingData struct {
+	Domain string // the domain name of the service, as given by -domainName
+}
+
+// loadLandingPage returns the landing page template read from
+// cfg.LandingPage, or the embedded one when that's unset.
+func loadLandingPage(cfg *Config) (*template.Template, error) {
+	if cfg.LandingPage == "" {
+		return landingTemplate, nil
+	}
+	t, err := template.ParseFiles(cfg.LandingPage)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load landing page: %v", err)
+	}
+	return t, nil
+}
+
+// serveLanding replies with the landing page, describing the service to
+// those pasting its domain in a browser.
+func serveLanding(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := landingTemplate.Execute(resp, landingData{Domain: *domainNameFlag}); err != nil {
+		logger.ErrorContext(req.Context(), "cannot execute landing page template", "err", err)
+	}
+}
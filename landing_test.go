@@ -0,0 +1,59 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+// browse serves a browser's GET of path.
+func (s *HandlerSuite) browse(path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func (s *HandlerSuite) TestLandingPage(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+
+	rec := s.browse("/")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(rec.Body.String(), Matches, `(?s).*<title>aahframe.work - stable APIs for Go</title>.*`)
+	c.Assert(rec.Body.String(), Matches, `(?s).*go get aahframe.work/&lt;pkg&gt;.v1.*`)
+
+	// go get and other tools are still sent to the domain.
+	for _, path := range []string{"/?go-get=1", "/"} {
+		rec = s.serve("GET", path, "")
+		c.Assert(rec.Code, Equals, http.StatusTemporaryRedirect)
+		c.Assert(rec.Header().Get("Location"), Equals, "https://aahframe.work")
+	}
+}
+
+func (s *HandlerSuite) TestLoadLandingPage(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+	defer func(t *template.Template) { landingTemplate = t }(landingTemplate)
+	cfg := newConfig()
+	t, err := loadLandingPage(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(t, Equals, landingTemplate)
+
+	cfg.LandingPage = filepath.Join(c.MkDir(), "landing.html")
+	_, err = loadLandingPage(cfg)
+	c.Assert(err, ErrorMatches, "cannot load landing page: .*")
+
+	c.Assert(ioutil.WriteFile(cfg.LandingPage, []byte("<h1>Welcome to {{.Domain}}</h1>"), 0644), IsNil)
+	landingTemplate, err = loadLandingPage(cfg)
+	c.Assert(err, IsNil)
+	rec := s.browse("/")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "<h1>Welcome to aahframe.work</h1>")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger is where everything is logged, as text to stderr unless set up
+// otherwise with setupLogger.
+var logger = slog.New(contextHandler{slog.NewTextHandler(os.Stderr, nil)})
+
+// setupLogger points logger at w, formatted and filtered per cfg.
+func setupLogger(w io.Writer, cfg *Config) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q", cfg.LogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	switch cfg.LogFormat {
+	case "text":
+		logger = slog.New(contextHandler{slog.NewTextHandler(w, opts)})
+	case "json":
+		logger = slog.New(contextHandler{slog.NewJSONHandler(w, opts)})
+	default:
+		return fmt.Errorf("invalid log format %q", cfg.LogFormat)
+	}
+	return nil
+}
+
+// contextHandler adds the ID of the request being served, as found in the
+// context given to the logger, to the records it hands to Handler.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
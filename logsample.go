@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// logSampler logs messages repeated on every request during GitHub
+// outages, the first config.LogSampleFirst of each per
+// config.LogSampleInterval only. Once the interval of a message is over,
+// the number left out is logged in a warning of its own.
+type logSampler struct {
+	mu      sync.Mutex
+	windows map[string]*sampleWindow // by message
+}
+
+// sampleWindow counts a message over the interval it is sampled in.
+type sampleWindow struct {
+	logged     int
+	suppressed int
+}
+
+// sampledLogger is where the errors of proxied requests are logged.
+var sampledLogger = &logSampler{windows: map[string]*sampleWindow{}}
+
+// ErrorContext logs msg and args at the error level, unless msg was
+// logged too often already.
+func (s *logSampler) ErrorContext(ctx context.Context, msg string, args ...interface{}) {
+	if s.allow(msg) {
+		logger.ErrorContext(ctx, msg, args...)
+	}
+}
+
+// allow reports whether msg may be logged, counting it either way.
+func (s *logSampler) allow(msg string) bool {
+	first, interval := config().LogSampleFirst, config().LogSampleInterval
+	if first <= 0 || interval <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.windows[msg]
+	if w == nil {
+		w = &sampleWindow{}
+		s.windows[msg] = w
+		time.AfterFunc(interval, func() { s.close(msg, interval) })
+	}
+	if w.logged < first {
+		w.logged++
+		return true
+	}
+	w.suppressed++
+	return false
+}
+
+// close ends the interval of msg, logging how many times it was left
+// out, if any.
+func (s *logSampler) close(msg string, interval time.Duration) {
+	s.mu.Lock()
+	w := s.windows[msg]
+	delete(s.windows, msg)
+	s.mu.Unlock()
+	if w != nil && w.suppressed > 0 {
+		logger.Warn("repeated log message suppressed", "message", msg, "suppressed", w.suppressed, "interval", interval)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&LogSampleSuite{})
+
+type LogSampleSuite struct{}
+
+func (s *LogSampleSuite) TestLogSampler(c *C) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+	defer func(first int, interval time.Duration) {
+		config().LogSampleFirst, config().LogSampleInterval = first, interval
+	}(config().LogSampleFirst, config().LogSampleInterval)
+	var log bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+	// Long enough for the interval to be closed by the test only.
+	config().LogSampleFirst, config().LogSampleInterval = 2, time.Hour
+
+	ls := &logSampler{windows: map[string]*sampleWindow{}}
+	for i := 0; i < 5; i++ {
+		ls.ErrorContext(context.Background(), "github proxy error", "n", i)
+	}
+	ls.ErrorContext(context.Background(), "github proxy error writing response")
+	c.Assert(strings.Count(log.String(), `msg="github proxy error" `), Equals, 2)
+	c.Assert(log.String(), Matches, `(?s).*n=1\n.*msg="github proxy error writing response"\n`)
+
+	log.Reset()
+	ls.close("github proxy error", time.Hour)
+	ls.close("github proxy error writing response", time.Hour)
+	c.Assert(log.String(), Matches, `.*level=WARN msg="repeated log message suppressed" message="github proxy error" suppressed=3 interval=1h0m0s\n`)
+
+	// A new interval starts afresh.
+	log.Reset()
+	ls.ErrorContext(context.Background(), "github proxy error", "n", 5)
+	c.Assert(log.String(), Matches, `.*msg="github proxy error" n=5\n`)
+
+	config().LogSampleFirst = 0
+	log.Reset()
+	for i := 0; i < 5; i++ {
+		ls.ErrorContext(context.Background(), "github proxy error")
+	}
+	c.Assert(strings.Count(log.String(), "\n"), Equals, 5)
+}
@@ -2,21 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -26,14 +30,49 @@ var (
 	keyFlag        = flag.String("key", "", "Use the provided TLS key")
 	acmeFlag       = flag.String("acme", "", "Auto-request TLS certs and store in given directory")
 	domainNameFlag = flag.String("domainName", "http://labix.org/gopkg.in", "Provide custom domain name")
+	configFlag     = flag.String("config", "", "Load the configuration from the given YAML file")
 )
 
-var httpServer *http.Server
-
-var httpClient = &http.Client{
-	Timeout: 10 * time.Second,
+// draining is set once shutdown starts, so that load balancers see the
+// health check failing and stop routing requests here.
+var draining atomic.Bool
+
+// httpClient talks to GitHub on behalf of requests not handled by a
+// Server, which has a client of its own, such as the warm-up of the
+// caches. run makes it anew with the configuration read. It has no
+// overall timeout as proxied transfers may take long; requests carry
+// their own deadline instead.
+var httpClient = newHTTPClient(newConfig())
+
+// newHTTPClient returns a client for GitHub with the connection pooling
+// settings of cfg. HTTP/2 is attempted unless disabled, multiplexing
+// concurrent clones over few connections. Redirects are followed as told
+// by checkRedirect. Requests go through the upstream proxy of cfg, if
+// any, or else through those of the environment.
+func newHTTPClient(cfg *Config) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = cfg.MaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.IdleConnTimeout = cfg.IdleConnTimeout
+	t.ForceAttemptHTTP2 = !cfg.DisableHTTP2
+	t.MaxResponseHeaderBytes = int64(cfg.MaxResponseHeaderBytes)
+	t.Proxy = http.ProxyFromEnvironment
+	if cfg.UpstreamProxy != "" {
+		// Validated already.
+		u, _ := url.Parse(cfg.UpstreamProxy)
+		t.Proxy = http.ProxyURL(u)
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map is what keeps the transport from
+		// upgrading TLS connections to HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: t, CheckRedirect: checkRedirect}
 }
 
+// refsTimeout bounds the retrieval of the refs of a repository.
+const refsTimeout = 10 * time.Second
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -44,77 +83,230 @@ func main() {
 func run() error {
 	flag.Parse()
 
-	http.HandleFunc("/", handler)
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	liveConfig.Store(cfg)
+	// Before warming the caches, so that it goes through the upstream
+	// proxy too. The Server shares it.
+	httpClient = newHTTPClient(cfg)
+
+	if metrics, err = setupMetrics(cfg); err != nil {
+		return err
+	}
+	if cfg.AdminAddr != "" && cfg.EnablePprof {
+		// Also counted for /debug/vars.
+		metrics = teeMetrics{metrics, expvarStats}
+	}
 
 	if *httpFlag == "" && *httpsFlag == "" {
 		return fmt.Errorf("must provide -http and/or -https")
 	}
-	if *acmeFlag != "" && *httpsFlag == "" {
-		return fmt.Errorf("cannot use -acme without -https")
+	if githubToken, err = loadGitHubToken(cfg); err != nil {
+		return err
+	}
+	if backendTokens, err = loadBackendTokens(cfg); err != nil {
+		return err
+	}
+	if landingTemplate, err = loadLandingPage(cfg); err != nil {
+		return err
+	}
+	tlsConfigured := cfg.TLSCertFile != "" || cfg.ACMECacheDir != ""
+	if *httpsFlag != "" && !tlsConfigured {
+		return fmt.Errorf("-https requires -cert and -key, or -acme")
 	}
-	if *acmeFlag != "" && (*certFlag != "" || *keyFlag != "") {
-		return fmt.Errorf("cannot provide -acme with -key or -cert")
+	if *httpsFlag == "" && tlsConfigured {
+		return fmt.Errorf("TLS certificates provided without -https")
 	}
-	if *acmeFlag == "" && (*httpsFlag != "" || *certFlag != "" || *keyFlag != "") && (*httpsFlag == "" || *certFlag == "" || *keyFlag == "") {
-		return fmt.Errorf("-https -cert and -key must be used together")
+	if err := setupLogger(os.Stderr, cfg); err != nil {
+		return err
 	}
+	if err := setupAccessLog(cfg); err != nil {
+		return err
+	}
+	if err := setupAuditLog(cfg); err != nil {
+		return err
+	}
+	shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Error("cannot flush traces", "err", err)
+		}
+	}()
 
-	ch := make(chan error, 2)
+	ch := make(chan error, 3)
 
-	if *acmeFlag != "" {
+	if cfg.ACMECacheDir != "" {
 		// So a potential error is seen upfront.
-		if err := os.MkdirAll(*acmeFlag, 0700); err != nil {
+		if err := os.MkdirAll(cfg.ACMECacheDir, 0700); err != nil {
 			return err
 		}
 	}
 
+	// Also reports the size of the zips left by previous runs.
+	zipCached.startSweeper()
+
+	if len(cfg.WarmRepos) > 0 {
+		warming.Store(true)
+		go warmCaches(cfg)
+	}
+
+	srv := NewServer(cfg, httpClient)
+	var servers []*http.Server
+
+	// Plain HTTP is also what runs behind a TLS terminating proxy.
 	if *httpFlag != "" {
-		httpServer = &http.Server{
+		httpServer := &http.Server{
+			Handler:      srv,
 			ReadTimeout:  20 * time.Second,
 			WriteTimeout: 20 * time.Second,
 		}
 		httpServer.Addr = *httpFlag
+		servers = append(servers, httpServer)
 		go func() {
 			ch <- httpServer.ListenAndServe()
 		}()
 	}
 	if *httpsFlag != "" {
-		httpServer = &http.Server{
+		tc, err := newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		pushCertRequired = tc.ClientCAs != nil
+		httpServer := &http.Server{
+			Handler:      srv,
 			ReadTimeout:  20 * time.Second,
 			WriteTimeout: 20 * time.Second,
+			TLSConfig:    tc,
 		}
 		httpServer.Addr = *httpsFlag
-		if *acmeFlag != "" {
-			m := autocert.Manager{
-				Prompt:      autocert.AcceptTOS,
-				Cache:       autocert.DirCache(*acmeFlag),
-				RenewBefore: 24 * 30 * time.Hour,
-				HostPolicy: autocert.HostWhitelist(
-					"localhost",
-					"gopkg.in",
-					"p1.gopkg.in",
-					"p2.gopkg.in",
-					"p3.gopkg.in",
-					"mup.labix.org",
-				),
-				Email: "gustavo@niemeyer.net",
-			}
-			httpServer.TLSConfig = &tls.Config{
-				GetCertificate: m.GetCertificate,
-			}
+		servers = append(servers, httpServer)
+		go func() {
+			ch <- httpServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		}()
+	}
+
+	if cfg.AdminAddr != "" {
+		// No WriteTimeout, as CPU profiles and traces take their time.
+		adminServer := &http.Server{
+			Addr:        cfg.AdminAddr,
+			Handler:     newAdminHandler(cfg),
+			ReadTimeout: 20 * time.Second,
 		}
+		servers = append(servers, adminServer)
 		go func() {
-			ch <- httpServer.ListenAndServeTLS(*certFlag, *keyFlag)
+			ch <- adminServer.ListenAndServe()
 		}()
 	}
-	return <-ch
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-ch:
+			return err
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reloadConfig()
+				continue
+			}
+			logger.Info("shutting down", "signal", s.String(), "timeout", config().ShutdownTimeout)
+		}
+		return shutdown(servers, config().ShutdownTimeout)
+	}
+}
+
+// readConfig returns the configuration in the -config file, or the
+// default one without it, with the TLS flags applied over it, once
+// validated.
+func readConfig() (*Config, error) {
+	cfg := newConfig()
+	if *configFlag != "" {
+		var err error
+		if cfg, err = loadConfig(*configFlag); err != nil {
+			return nil, err
+		}
+	}
+	if *certFlag != "" || *keyFlag != "" {
+		cfg.TLSCertFile, cfg.TLSKeyFile = *certFlag, *keyFlag
+	}
+	if *acmeFlag != "" {
+		cfg.ACMECacheDir = *acmeFlag
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reloadConfig reads the configuration again, on SIGHUP, and puts it in
+// use if valid. Otherwise the running one is kept. The settings listed in
+// restartSettings only take effect on restart.
+func reloadConfig() {
+	if *configFlag == "" {
+		logger.Warn("not reloading the configuration, no -config file given")
+		return
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		logger.Error("cannot reload configuration, keeping the running one", "err", err)
+		return
+	}
+	// Those are left as they are running until the restart, half
+	// applied otherwise.
+	changed := changedSettings(config(), cfg, restartSettings)
+	keepSettings(config(), cfg, restartSettings)
+	if cfg.Maintenance && !config().Maintenance {
+		logger.Warn("maintenance mode on", "path", *configFlag)
+	} else if !cfg.Maintenance && config().Maintenance {
+		logger.Warn("maintenance mode off", "path", *configFlag)
+	}
+	liveConfig.Store(cfg)
+	if len(changed) > 0 {
+		logger.Warn("configuration reloaded, some changes need a restart", "path", *configFlag, "restart", changed)
+		return
+	}
+	logger.Info("configuration reloaded", "path", *configFlag)
+}
+
+// shutdown stops servers from accepting connections and waits for the
+// requests in progress, proxied clones included, to finish. Whatever is
+// left after timeout is cut off.
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				logger.Warn("shutdown timed out, closing remaining connections", "addr", srv.Addr)
+				err = srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 var gogetTemplate = template.Must(template.New("").Parse(`
 <html>
 <head>
 <meta name="go-import" content="{{.GopkgRoot}} git https://{{.GopkgRoot}}">
-{{$root := .GitHubRoot}}{{$tree := .GitHubTree}}<meta name="go-source" content="{{.GopkgRoot}} _ https://{{$root}}/tree/{{$tree}}{/dir} https://{{$root}}/blob/{{$tree}}{/dir}/{file}#L{line}">
+<meta name="go-source" content="{{.GopkgRoot}} {{.GoSource}}">
 </head>
 <body>
 go get {{.GopkgPath}}
@@ -128,6 +320,7 @@ type Repo struct {
 	Name             string
 	SubPath          string
 	OldFormat        bool // The old /v2/pkg format.
+	Unversioned      bool // A plain /pkg path, with no version.
 	MajorVersion     Version
 	IsCustomAssigned bool
 
@@ -163,6 +356,31 @@ func (repo *Repo) GitHubRoot() string {
 	return "github.com/" + repo.User + "/" + repo.Name
 }
 
+// BackendRoot returns the repository URL at the configured backend,
+// https://github.com unless pointed at a GitHub Enterprise host, or at the
+// one of config.Backends the repository is routed to.
+func (repo *Repo) BackendRoot() string {
+	path := strings.TrimPrefix(repo.GitHubRoot(), "github.com/")
+	return strings.TrimSuffix(baseURLFor(path), "/") + "/" + path
+}
+
+// GoSource returns the home, directory and file URL templates of the
+// go-source meta tag for the repository, as configured in
+// config.GoSource, whatever the case of the repository name, or else
+// defaultGoSource.
+func (repo *Repo) GoSource() string {
+	root := repo.GitHubRoot()
+	src := defaultGoSource
+	for name, s := range config().GoSource {
+		if strings.EqualFold(name, strings.TrimPrefix(root, "github.com/")) {
+			src = s
+			break
+		}
+	}
+	r := strings.NewReplacer("{repo}", "https://"+root, "{ref}", repo.GitHubTree())
+	return r.Replace(src.Home) + " " + r.Replace(src.Dir) + " " + r.Replace(src.File)
+}
+
 // GitHubTree returns the repository tree name at GitHub for the selected version.
 func (repo *Repo) GitHubTree() string {
 	if repo.FullVersion == InvalidVersion {
@@ -184,6 +402,9 @@ func (repo *Repo) GopkgPath() string {
 // GopkgVersionRoot returns the package root in gopkg.in for the
 // provided version, without a schema.
 func (repo *Repo) GopkgVersionRoot(version Version) string {
+	if repo.Unversioned {
+		return *domainNameFlag + "/" + repo.Name
+	}
 	version.Minor = -1
 	version.Patch = -1
 	v := version.String()
@@ -202,59 +423,133 @@ func (repo *Repo) GopkgVersionRoot(version Version) string {
 
 var patternOld = regexp.MustCompile(`^/(?:([a-z0-9][-a-z0-9]+)/)?((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-edge)?)/([a-zA-Z][-a-zA-Z0-9]*)(?:\.git)?((?:/[a-zA-Z][-a-zA-Z0-9]*)*)$`)
 var patternNew = regexp.MustCompile(`^/(?:([a-zA-Z0-9][-a-zA-Z0-9]+)/)?([a-zA-Z][-.a-zA-Z0-9]*)\.((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-edge)?)(?:\.git)?((?:/[a-zA-Z0-9][-.a-zA-Z0-9]*)*)$`)
+var patternPlain = regexp.MustCompile(`^/([a-zA-Z][-a-zA-Z0-9]*)(?:\.git)?((?:/[a-zA-Z0-9][-.a-zA-Z0-9]*)*)$`)
+
+// parseRepoPath matches path against the supported URL patterns and
+// returns the repository it refers to, along with the version in path as
+// written. The repository is nil if path matches no pattern.
+func parseRepoPath(path string) (repo *Repo, version string) {
+	m := patternNew.FindStringSubmatch(path)
+	oldFormat, unversioned := false, false
+	if m == nil {
+		if m = patternOld.FindStringSubmatch(path); m != nil {
+			// "/v2/name" <= "/name.v2"
+			m[2], m[3] = m[3], m[2]
+			oldFormat = true
+		} else if p := patternPlain.FindStringSubmatch(path); p != nil {
+			// "/name/sub" is the default branch of the repository.
+			m = []string{p[0], "", p[1], "", p[2]}
+			unversioned = true
+		} else {
+			return nil, ""
+		}
+	}
+	repo = &Repo{
+		User:        m[1],
+		Name:        m[2],
+		SubPath:     m[4],
+		OldFormat:   oldFormat,
+		Unversioned: unversioned,
+		FullVersion: InvalidVersion,
+	}
+	return repo, m[3]
+}
 
 func handler(resp http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/health-check" {
+	switch req.URL.Path {
+	case "/healthz":
+		serveHealthz(resp, req)
+		return
+	case "/readyz":
+		serveReadyz(resp, req)
+		return
+	case "/version":
+		serveVersion(resp, req)
+		return
+	case "/health-check":
+		if draining.Load() {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = resp.Write([]byte("shutting down"))
+			return
+		}
 		_, _ = resp.Write([]byte("ok"))
 		return
 	}
 
-	log.Printf("%s requested %s", req.RemoteAddr, req.URL)
+	logger.InfoContext(req.Context(), "request", "remote", req.RemoteAddr, "url", req.URL.String())
 
 	if req.URL.Path == "/" {
+		if req.FormValue("go-get") != "1" && isBrowser(req) {
+			serveLanding(resp, req)
+			return
+		}
 		resp.Header().Set("Location", "https://"+*domainNameFlag)
 		resp.WriteHeader(http.StatusTemporaryRedirect)
 		return
 	}
 
-	m := patternNew.FindStringSubmatch(req.URL.Path)
-	oldFormat := false
-	if m == nil {
-		m = patternOld.FindStringSubmatch(req.URL.Path)
-		if m == nil {
-			sendNotFound(resp, fmt.Sprintf("Unsupported URL pattern; see the documentation at %s for details.", *domainNameFlag))
-			return
+	if strings.Contains(req.URL.Path, "/@v/") || strings.HasSuffix(req.URL.Path, "/@latest") {
+		if allowRate(resp, req) {
+			serveModule(resp, req)
 		}
-		// "/v2/name" <= "/name.v2"
-		m[2], m[3] = m[3], m[2]
-		oldFormat = true
+		return
 	}
 
-	if strings.Contains(m[3], ".") {
+	repo, version := parseRepoPath(req.URL.Path)
+	if repo == nil {
+		sendNotFound(resp, fmt.Sprintf("Unsupported URL pattern; see the documentation at %s for details.", *domainNameFlag))
+		return
+	}
+	if isProxiedPath(repo.SubPath) && !allowRate(resp, req) {
+		return
+	}
+	if !allowMethod(resp, req, repoMethods(repo.SubPath)) {
+		return
+	}
+	traceRepo(req.Context(), repo)
+	if isPush(req, repo.SubPath) {
+		var done func()
+		resp, done = auditPush(resp, req, repo)
+		defer done()
+	}
+	if !repoAllowed(repo) {
+		sendForbidden(resp, req, repo)
+		return
+	}
+	unversioned := repo.Unversioned
+	if err := validateTarget(repo.BackendRoot()); err != nil {
+		sendBadTarget(resp, req, err)
+		return
+	}
+
+	if strings.Contains(version, ".") {
 		sendNotFound(resp, "Import paths take the major version only (.%s instead of .%s); see docs at gopkg.in for the reasoning.",
-			m[3][:strings.Index(m[3], ".")], m[3])
+			version[:strings.Index(version, ".")], version)
 		return
 	}
 
-	repo := &Repo{
-		User:        m[1],
-		Name:        m[2],
-		SubPath:     m[4],
-		OldFormat:   oldFormat,
-		FullVersion: InvalidVersion,
+	if !unversioned {
+		var ok bool
+		repo.MajorVersion, ok = parseVersion(version)
+		if !ok {
+			sendNotFound(resp, "Version %q improperly considered invalid; please warn the service maintainers.", version)
+			return
+		}
 	}
 
-	var ok bool
-	repo.MajorVersion, ok = parseVersion(m[3])
-	if !ok {
-		sendNotFound(resp, "Version %q improperly considered invalid; please warn the service maintainers.", m[3])
-		return
+	// Git sends Pragma: no-cache on every request, so only the explicit
+	// Cache-Control bypasses the refs and not found caches.
+	if strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+		refsCached.invalidate(repo.BackendRoot() + refsSuffix)
+		notFoundCached.invalidate(repo.BackendRoot() + refsSuffix)
 	}
 
 	var changed []byte
 	var versions VersionList
-	original, err := fetchRefs(repo)
-	if err == nil {
+	original, err := fetchRefs(req.Context(), repo)
+	if err == nil && unversioned {
+		changed = original
+	} else if err == nil {
 		changed, versions, err = changeRefs(original, repo.MajorVersion)
 		repo.SetVersions(versions)
 	}
@@ -275,36 +570,102 @@ func handler(resp http.ResponseWriter, req *http.Request) {
 		v := major.String()
 		sendNotFound(resp, `GitHub repository at https://%s has no branch or tag "%s%s", "%s.N%s" or "%s.N.M%s"`, repo.GitHubRoot(), v, suffix, v, suffix, v, suffix)
 		return
+	case ErrCircuitOpen:
+		sendCircuitOpen(resp)
+		return
 	default:
-		resp.WriteHeader(http.StatusBadGateway)
+		status, _ := backendErrorStatus(err)
+		resp.WriteHeader(status)
 		fmt.Fprintf(resp, "Cannot obtain refs from GitHub: %v", err)
 		return
 	}
 
 	if repo.SubPath == "/git-upload-pack" {
-		proxyGitUploadPack(resp, req, "https://"+repo.GitHubRoot()+"/git-upload-pack")
+		proxyGitUploadPack(resp, req, repo.BackendRoot()+"/git-upload-pack")
+		return
+	}
+
+	if repo.SubPath == "/git-receive-pack" {
+		proxyGitReceivePack(resp, req, repo.BackendRoot()+"/git-receive-pack")
+		// The push may have changed the refs.
+		refsCached.invalidate(repo.BackendRoot() + refsSuffix)
 		return
 	}
 
 	if repo.SubPath == "/info/refs" {
-		resp.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-		_, _ = resp.Write(changed)
+		if req.FormValue("service") == "git-receive-pack" && (!requirePushNetwork(resp, req) || !requirePushCert(resp, req) || !requireAuth(resp, req)) {
+			return
+		}
+		if req.FormValue("service") == "" && !unversioned {
+			sendDumbVersioned(resp, repo)
+			return
+		}
+		if req.FormValue("service") != "git-upload-pack" {
+			// Only the upload-pack advertisement is rewritten for the
+			// requested version, anything else goes to GitHub untouched,
+			// the ref listing of dumb clients on plain paths included.
+			// Note that the rewritten advertisement is always a protocol v0
+			// one, even for clients asking for v2 through Git-Protocol; the
+			// v2 ls-refs command would otherwise expose the real HEAD.
+			proxyInfoRefs(resp, req, repo.BackendRoot()+"/info/refs")
+			return
+		}
+		sendAdvertisement(resp, req, changed, refsCached.lastModified(repo.BackendRoot()+refsSuffix))
+		return
+	}
+
+	if isDumbPath(repo.SubPath) {
+		if !unversioned {
+			sendDumbVersioned(resp, repo)
+			return
+		}
+		proxyDumb(resp, req, repo.BackendRoot()+repo.SubPath)
 		return
 	}
 
 	resp.Header().Set("Content-Type", "text/html")
 	if req.FormValue("go-get") == "1" {
 		// execute simple template when this is a go-get request
+		setCacheHeaders(resp.Header(), endpointGoGet)
 		err = gogetTemplate.Execute(resp, repo)
 		if err != nil {
-			log.Printf("error executing go get template: %s\n", err)
+			logger.ErrorContext(req.Context(), "cannot execute go get template", "repo", repo.GitHubRoot(), "err", err)
 		}
 		return
 	}
 
+	if isBrowser(req) {
+		resp.Header().Set("Location", "https://pkg.go.dev/"+repo.GopkgPath())
+		resp.WriteHeader(http.StatusFound)
+		return
+	}
+
+	if unversioned {
+		// There's no package page for a plain path, send people to
+		// the code instead, at the backend it is proxied from.
+		url := repo.BackendRoot()
+		if repo.SubPath != "" {
+			url += "/tree/" + repo.GitHubTree() + repo.SubPath
+		}
+		resp.Header().Set("Location", url)
+		resp.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+
 	renderPackagePage(resp, req, repo)
 }
 
+// isBrowser reports whether req looks like it comes from a web browser
+// rather than from go get or other tooling, going by its Accept header.
+func isBrowser(req *http.Request) bool {
+	for _, v := range req.Header.Values("Accept") {
+		if strings.Contains(v, "text/html") {
+			return true
+		}
+	}
+	return false
+}
+
 func sendNotFound(resp http.ResponseWriter, msg string, args ...interface{}) {
 	if len(args) > 0 {
 		msg = fmt.Sprintf(msg, args...)
@@ -318,17 +679,77 @@ const refsSuffix = ".git/info/refs?service=git-upload-pack"
 var ErrNoRepo = errors.New("repository not found in GitHub")
 var ErrNoVersion = errors.New("version reference not found in GitHub")
 
-func fetchRefs(repo *Repo) (data []byte, err error) {
-	resp, err := httpClient.Get("https://" + repo.GitHubRoot() + refsSuffix)
+// refsFlight coalesces the concurrent fetches of the refs of a same
+// repository, as when many CI jobs clone it at once after a release.
+var refsFlight singleflight.Group
+
+func fetchRefs(ctx context.Context, repo *Repo) (data []byte, err error) {
+	url := repo.BackendRoot() + refsSuffix
+	if data, ok := refsCached.get(url); ok {
+		return data, nil
+	}
+	if notFoundCached.has(url) {
+		return nil, ErrNoRepo
+	}
+	// The fetch is shared, so it isn't cut short when the request that
+	// started it goes away.
+	v, err, _ := refsFlight.Do(strings.ToLower(url), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refsTimeout)
+		defer cancel()
+		return fetchRefsFrom(ctx, url)
+	})
+	if err == ErrNoRepo {
+		notFoundCached.put(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// fetchRefsFrom fetches the refs advertisement at url from GitHub, and
+// caches it. The refs kept on disk are revalidated all the same, with
+// their ETag when they came with one, and only served as they are when
+// GitHub fails to answer.
+func fetchRefsFrom(ctx context.Context, url string) (data []byte, err error) {
+	kept, etag, onDisk := refsDisk.get(url)
+	defer func() {
+		if err != nil && err != ErrNoRepo && onDisk {
+			logger.WarnContext(ctx, "serving refs kept on disk as GitHub failed", "url", url, "err", err)
+			data, err = kept, nil
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("cannot talk to GitHub: %v", err)
 	}
+	if onDisk && etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	req.Header.Set("User-Agent", userAgent(config(), ""))
+	setRepoToken(req.Header, url)
+	injectTrace(ctx, req.Header)
+	setRequestID(ctx, req.Header)
+	resp, err := doRetry(req)
+	if err == ErrCircuitOpen {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot talk to GitHub: %w", err)
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == 304 && onDisk {
+		refsCached.put(url, kept)
+		refsDisk.put(url, kept, etag)
+		return kept, nil
+	}
 	switch resp.StatusCode {
 	case 200:
 		// ok
 	case 401, 404:
+		refsDisk.invalidate(url)
 		return nil, ErrNoRepo
 	default:
 		return nil, fmt.Errorf("error from GitHub: %v", resp.Status)
@@ -338,9 +759,18 @@ func fetchRefs(repo *Repo) (data []byte, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading from GitHub: %v", err)
 	}
+	refsCached.put(url, data)
+	refsDisk.put(url, data, resp.Header.Get("ETag"))
 	return data, err
 }
 
+// changeRefs rewrites the upload-pack refs advertisement in data so that
+// HEAD and master point at the best branch or tag matching major, which
+// is what a clone of the versioned import path ends up on. The other refs
+// are advertised unchanged so that any of them may still be fetched. It
+// also returns all the versions found, and ErrNoVersion if none matches.
+// Pre-release tags such as v2.0.0-rc1 are never picked, nor listed among
+// the versions; import paths have no way to ask for them.
 func changeRefs(data []byte, major Version) (changed []byte, versions VersionList, err error) {
 	var hlinei, hlinej int // HEAD reference line start/end
 	var mlinei, mlinej int // master reference line start/end
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HandlerSuite{})
+
+// HandlerSuite drives handler against a fake GitHub.
+type HandlerSuite struct {
+	github   *httptest.Server
+	mux      *http.ServeMux
+	restore  func()
+	lastHost string
+	refsHits int
+}
+
+func (s *HandlerSuite) SetUpTest(c *C) {
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/go-aah/config.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		s.lastHost = r.Host
+		s.refsHits++
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+	s.github = httptest.NewTLSServer(s.mux)
+
+	client, base := httpClient, config().BackendBaseURL
+	s.restore = func() {
+		httpClient, config().BackendBaseURL = client, base
+		config().AllowPrivateBackend = false
+	}
+	httpClient = s.github.Client()
+	config().BackendBaseURL = s.github.URL
+	config().AllowPrivateBackend = true
+	breaker = &circuitBreaker{now: time.Now}
+	refsCached = &refsCache{now: time.Now}
+	notFoundCached = &notFoundCache{now: time.Now}
+	s.refsHits = 0
+}
+
+func (s *HandlerSuite) TearDownTest(c *C) {
+	s.restore()
+	s.github.Close()
+}
+
+func (s *HandlerSuite) serve(method, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+var methodTests = []struct {
+	method, path, allow string
+}{
+	{"GET", "/config.v1/git-upload-pack", "POST"},
+	{"PUT", "/config.v1/git-receive-pack", "POST"},
+	{"POST", "/config.v1/info/refs?service=git-upload-pack", "GET, HEAD"},
+	{"DELETE", "/config.v1", "GET, HEAD"},
+	{"PATCH", "/config/info/refs", "GET, HEAD"},
+}
+
+func (s *HandlerSuite) TestMethodNotAllowed(c *C) {
+	for _, t := range methodTests {
+		rec := s.serve(t.method, t.path, "")
+		c.Check(rec.Code, Equals, http.StatusMethodNotAllowed, Commentf("%s %s", t.method, t.path))
+		c.Check(rec.Header().Get("Allow"), Equals, t.allow, Commentf("%s %s", t.method, t.path))
+	}
+	c.Assert(s.refsHits, Equals, 0)
+}
+
+func (s *HandlerSuite) TestBackendBaseURL(c *C) {
+	var outreq *http.Request
+	s.mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		outreq = r
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+
+	rec := s.serve("POST", "/config.v1/git-upload-pack", "0000")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "0008NAK\n")
+	c.Assert(outreq, NotNil)
+	c.Assert(outreq.Host, Equals, strings.TrimPrefix(s.github.URL, "https://"))
+	c.Assert(s.lastHost, Equals, outreq.Host)
+}
+
+func (s *HandlerSuite) TestBackendRoot(c *C) {
+	defer func(base string) { config().BackendBaseURL = base }(config().BackendBaseURL)
+	config().BackendBaseURL = "https://github.example.com/"
+	repo := &Repo{Name: "config"}
+	c.Assert(repo.BackendRoot(), Equals, "https://github.example.com/go-aah/config")
+	repo = &Repo{Name: "aah"}
+	c.Assert(repo.BackendRoot(), Equals, "https://github.example.com/go-aah/aah")
+}
+
+func (s *HandlerSuite) TestShutdownDrains(c *C) {
+	defer draining.Store(false)
+
+	entered := make(chan bool)
+	release := make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- true
+			<-release
+			_, _ = w.Write([]byte("done"))
+			return
+		}
+		handler(w, r)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go srv.Serve(ln)
+	url := "http://" + ln.Addr().String()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url + "/slow")
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		inflight <- result{string(body), err}
+	}()
+	<-entered
+
+	done := make(chan error, 1)
+	go func() { done <- shutdown([]*http.Server{srv}, 5*time.Second) }()
+
+	// The health check reports the server going away right away.
+	for !draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	rec := s.serve("GET", "/health-check", "")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+
+	select {
+	case err := <-done:
+		c.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	r := <-inflight
+	c.Assert(r.err, IsNil)
+	c.Assert(r.body, Equals, "done")
+	c.Assert(<-done, IsNil)
+
+	_, err = http.Get(url + "/health-check")
+	c.Assert(err, NotNil)
+}
+
+func (s *HandlerSuite) TestShutdownTimeout(c *C) {
+	defer draining.Store(false)
+
+	entered := make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-r.Context().Done()
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go srv.Serve(ln)
+
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-entered
+
+	c.Assert(shutdown([]*http.Server{srv}, 20*time.Millisecond), IsNil)
+}
+
+func (s *HandlerSuite) TestGoGetMeta(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+
+	tests := []struct{ path, root, tree string }{
+		{"/config", "aahframe.work/config", "master"},
+		{"/config/sub/pkg", "aahframe.work/config", "master"},
+		{"/config.v1", "aahframe.work/config.v1", "v1"},
+		{"/config.v1/sub/pkg", "aahframe.work/config.v1", "v1"},
+	}
+	for _, t := range tests {
+		rec := s.serve("GET", t.path+"?go-get=1", "")
+		c.Assert(rec.Code, Equals, http.StatusOK, Commentf("path %s", t.path))
+		c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-import" content="`+t.root+` git https://`+t.root+`">.*`, Commentf("path %s", t.path))
+		c.Assert(rec.Body.String(), Matches, `(?s).*https://github.com/go-aah/config/tree/`+t.tree+`\{/dir\}.*`, Commentf("path %s", t.path))
+	}
+}
+
+func (s *HandlerSuite) TestPlainPathRedirect(c *C) {
+	rec := s.serve("GET", "/config", "")
+	c.Assert(rec.Code, Equals, http.StatusTemporaryRedirect)
+	// At the backend in use, the fake GitHub here.
+	c.Assert(rec.Header().Get("Location"), Equals, s.github.URL+"/go-aah/config")
+
+	rec = s.serve("GET", "/config/sub/pkg", "")
+	c.Assert(rec.Code, Equals, http.StatusTemporaryRedirect)
+	c.Assert(rec.Header().Get("Location"), Equals, s.github.URL+"/go-aah/config/tree/master/sub/pkg")
+}
+
+func (s *HandlerSuite) TestPlainPathRefs(c *C) {
+	rec := s.serve("GET", "/config.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash1 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	))
+}
+
+func (s *HandlerSuite) TestGoSource(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+
+	rec := s.serve("GET", "/config.v1/sub?go-get=1", "")
+	c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-source" content="aahframe.work/config.v1 _ `+
+		`https://github.com/go-aah/config/tree/v1\{/dir\} `+
+		`https://github.com/go-aah/config/blob/v1\{/dir\}/\{file\}#L\{line\}">.*`)
+
+	defer func() { config().GoSource = nil }()
+	config().GoSource = map[string]GoSource{
+		"go-aah/config": {
+			Home: "https://aahframe.work",
+			Dir:  "https://code.example.com/config/src/{ref}{/dir}",
+			File: "https://code.example.com/config/src/{ref}{/dir}/{file}?line={line}",
+		},
+	}
+	rec = s.serve("GET", "/config.v1/sub?go-get=1", "")
+	c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-source" content="aahframe.work/config.v1 https://aahframe.work `+
+		`https://code.example.com/config/src/v1\{/dir\} `+
+		`https://code.example.com/config/src/v1\{/dir\}/\{file\}\?line=\{line\}">.*`)
+
+	// GitHub names are case insensitive.
+	config().GoSource = map[string]GoSource{"Go-Aah/Config": {Home: "https://aahframe.work", Dir: "{repo}", File: "{repo}"}}
+	rec = s.serve("GET", "/config.v1/sub?go-get=1", "")
+	c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-source" content="aahframe.work/config.v1 https://aahframe.work .*`)
+}
+
+func (s *HandlerSuite) TestVersionedRefs(c *C) {
+	rec := s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, reflines(
+		"00000000000000000000000000000000000hash2 HEAD\x00symref=HEAD:refs/heads/v1 oldref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	))
+}
+
+func (s *HandlerSuite) TestVersionedGoImport(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+
+	rec := s.serve("GET", "/v1/config/sub?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-import" content="aahframe.work/v1/config git https://aahframe.work/v1/config">.*`)
+}
+
+func (s *HandlerSuite) TestVersionNotFound(c *C) {
+	rec := s.serve("GET", "/config.v2?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Body.String(), Equals, `GitHub repository at https://github.com/go-aah/config has no branch or tag "v2", "v2.N" or "v2.N.M"`)
+
+	rec = s.serve("GET", "/config.v1.2?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Body.String(), Matches, `Import paths take the major version only \(.v1 instead of .v1.2\).*`)
+}
+
+func (s *HandlerSuite) TestRefsCached(c *C) {
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+	c.Assert(s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "").Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 1)
+
+	defer func(ttl time.Duration) { config().RefsCacheTTL = ttl }(config().RefsCacheTTL)
+	config().RefsCacheTTL = 0
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 2)
+}
+
+func (s *HandlerSuite) TestNotFoundCached(c *C) {
+	hits := 0
+	s.mux.HandleFunc("/go-aah/missing.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.NotFound(w, r)
+	})
+	for i := 0; i < 3; i++ {
+		rec := s.serve("GET", "/missing.v1?go-get=1", "")
+		c.Assert(rec.Code, Equals, http.StatusNotFound)
+		c.Assert(rec.Body.String(), Matches, "GitHub repository not found at .*")
+	}
+	c.Assert(hits, Equals, 1)
+
+	// Found repositories are left alone.
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+
+	req := httptest.NewRequest("GET", "/missing.v1.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(hits, Equals, 2)
+}
+
+func (s *HandlerSuite) TestRefsCoalesced(c *C) {
+	defer func(ttl time.Duration) { config().RefsCacheTTL = ttl }(config().RefsCacheTTL)
+	config().RefsCacheTTL = 0
+
+	var hits atomic.Int32
+	entered, release := make(chan bool), make(chan bool)
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			entered <- true
+		}
+		<-release
+		_, _ = w.Write([]byte("refs"))
+	})
+
+	repo := &Repo{User: "go-aah", Name: "log"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func(ctx context.Context) {
+			data, err := fetchRefs(ctx, repo)
+			if err == nil && string(data) != "refs" {
+				err = fmt.Errorf("got refs %q", data)
+			}
+			errs <- err
+		}(ctx)
+		if i == 0 {
+			<-entered
+			// The others share the fetch the first started, even once
+			// the first is gone.
+			cancel()
+			ctx = context.Background()
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		c.Assert(<-errs, IsNil)
+	}
+	c.Assert(hits.Load(), Equals, int32(1))
+}
+
+func (s *HandlerSuite) TestRefsTimeout(c *C) {
+	release := make(chan bool)
+	defer close(release)
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	client := *httpClient
+	client.Timeout = 50 * time.Millisecond
+	httpClient = &client
+
+	rec := s.serve("GET", "/log.v1?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusGatewayTimeout)
+	c.Assert(rec.Body.String(), Matches, "Cannot obtain refs from GitHub: cannot talk to GitHub: .*Client.Timeout exceeded.*")
+
+	// GitHub not there at all.
+	s.github.Close()
+	rec = s.serve("GET", "/config.v1?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *HandlerSuite) TestBrowserRedirect(c *C) {
+	defer func(d string) { *domainNameFlag = d }(*domainNameFlag)
+	*domainNameFlag = "aahframe.work"
+
+	for _, path := range []string{"/config.v1/sub", "/config/sub"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		c.Assert(rec.Code, Equals, http.StatusFound)
+		c.Assert(rec.Header().Get("Location"), Equals, "https://pkg.go.dev/aahframe.work"+path)
+
+		// Tooling keeps getting the meta tags, whatever it accepts.
+		req = httptest.NewRequest("GET", path+"?go-get=1", nil)
+		req.Header.Set("Accept", "text/html")
+		rec = httptest.NewRecorder()
+		handler(rec, req)
+		c.Assert(rec.Code, Equals, http.StatusOK)
+		c.Assert(rec.Body.String(), Matches, `(?s).*<meta name="go-import" .*`)
+	}
+}
+
+func (s *HandlerSuite) TestRefsETag(c *C) {
+	rec := s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, Matches, `"[0-9a-f]{32}"`)
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		req := httptest.NewRequest("GET", "/config.v1.git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("If-None-Match", inm)
+		rec = httptest.NewRecorder()
+		handler(rec, req)
+		c.Assert(rec.Code, Equals, http.StatusNotModified, Commentf("If-None-Match: %s", inm))
+		c.Assert(rec.Body.Len(), Equals, 0)
+		c.Assert(rec.Header().Get("ETag"), Equals, etag)
+		c.Assert(rec.Header().Get("Content-Type"), Equals, "")
+	}
+
+	// Another version has other refs.
+	req := httptest.NewRequest("GET", "/config.v0.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	req = httptest.NewRequest("GET", "/config.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("ETag"), Not(Equals), etag)
+}
+
+func (s *HandlerSuite) TestRefsLastModified(c *C) {
+	rec := s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	modified, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+	c.Assert(err, IsNil)
+	etag := rec.Header().Get("ETag")
+
+	get := func(since time.Time, inm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/config.v1.git/info/refs?service=git-upload-pack", nil)
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	// Answered from the cached refs.
+	rec = get(modified, "")
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), Equals, 0)
+	c.Assert(rec.Header().Get("ETag"), Equals, etag)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "")
+	c.Assert(s.refsHits, Equals, 1)
+
+	c.Assert(get(modified.Add(-time.Second), "").Code, Equals, http.StatusOK)
+	// If-None-Match wins over If-Modified-Since.
+	c.Assert(get(modified, `"other"`).Code, Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestRefsNoCache(c *C) {
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+
+	// Git always sends Pragma: no-cache, which doesn't bypass the cache.
+	req := httptest.NewRequest("GET", "/config.v1.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Pragma", "no-cache")
+	handler(httptest.NewRecorder(), req)
+	c.Assert(s.refsHits, Equals, 1)
+
+	req = httptest.NewRequest("GET", "/config.v1.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	handler(httptest.NewRecorder(), req)
+	c.Assert(s.refsHits, Equals, 2)
+}
+
+func (s *HandlerSuite) TestRefsInvalidatedByPush(c *C) {
+	s.mux.HandleFunc("/go-aah/config/git-receive-pack", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0000"))
+	})
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+	req.SetBasicAuth("user", "token")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 1)
+
+	c.Assert(s.serve("GET", "/config.v1?go-get=1", "").Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 2)
+}
+
+func (s *HandlerSuite) TestCacheHeaders(c *C) {
+	defer func(ch map[string]CacheHeaders) { config().CacheHeaders = ch }(config().CacheHeaders)
+
+	rec := s.serve("GET", "/config.v1?go-get=1", "")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "public, max-age=60")
+	c.Assert(rec.Header().Get("Vary"), Equals, "Accept")
+
+	rec = s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "")
+
+	rec = s.serve("GET", "/config.v2?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "")
+
+	config().CacheHeaders = map[string]CacheHeaders{
+		serviceInfoRefs:   {CacheControl: "no-cache"},
+		serviceUploadPack: {CacheControl: "private", Vary: "Git-Protocol"},
+	}
+	rec = s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "no-cache")
+	rec = s.serve("GET", "/config.v1?go-get=1", "")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "")
+}
+
+func (s *HandlerSuite) TestCacheHeadersProxied(c *C) {
+	defer func(ch map[string]CacheHeaders) { config().CacheHeaders = ch }(config().CacheHeaders)
+	s.mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+
+	config().CacheHeaders = map[string]CacheHeaders{
+		serviceUploadPack: {CacheControl: "private", Vary: "Git-Protocol"},
+	}
+	rec := s.serve("POST", "/config.v1/git-upload-pack", "0000")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "no-cache, max-age=0, must-revalidate")
+	c.Assert(rec.Header().Get("Vary"), Equals, "Git-Protocol")
+
+	config().CacheHeaders = map[string]CacheHeaders{
+		serviceUploadPack: {CacheControl: "private", Override: true},
+	}
+	rec = s.serve("POST", "/config.v1/git-upload-pack", "0000")
+	c.Assert(rec.Header().Get("Cache-Control"), Equals, "private")
+}
+
+func (s *HandlerSuite) TestReloadConfig(c *C) {
+	defer func(path string, l *slog.Logger) { *configFlag, logger = path, l }(*configFlag, logger)
+	var log bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+
+	running := config()
+	defer liveConfig.Store(running)
+
+	*configFlag = filepath.Join(c.MkDir(), "gopkg.yaml")
+	write := func(data string) {
+		c.Assert(ioutil.WriteFile(*configFlag, []byte(data), 0644), IsNil)
+	}
+
+	write("backend_base_url: " + s.github.URL + "\nallow_private_backend: true\nrepo_policy: deny-all\nallowed_repos: [go-aah/log]\n")
+	reloadConfig()
+	c.Assert(config(), Not(Equals), running)
+	c.Assert(config().RepoPolicy, Equals, repoPolicyDenyAll)
+	c.Assert(log.String(), Matches, `.*level=INFO msg="configuration reloaded" path=\S+\n`)
+
+	// The new allowlist applies right away.
+	rec := s.serve("GET", "/config.v1?go-get=1", "")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+
+	reloaded := config()
+	log.Reset()
+	write("retry_attempts: 0\n")
+	reloadConfig()
+	c.Assert(config(), Equals, reloaded)
+	c.Assert(log.String(), Matches, `.*level=ERROR msg="cannot reload configuration, keeping the running one" err="retry attempts must be at least 1, got 0"\n`)
+
+	log.Reset()
+	write("backend_base_url: https://ghe.example.com\nallow_private_backend: true\nlog_level: debug\nmax_idle_conns: 5\n" +
+		"module_cache_dir: /elsewhere\nlanding_page: landing.html\n" +
+		"backends: [{prefix: corp/, base_url: https://git.example.com}]\n")
+	reloadConfig()
+	c.Assert(config(), Not(Equals), reloaded)
+	c.Assert(config().LogLevel, Equals, reloaded.LogLevel)
+	c.Assert(config().MaxIdleConns, Equals, reloaded.MaxIdleConns)
+	c.Assert(config().ModuleCacheDir, Equals, reloaded.ModuleCacheDir)
+	c.Assert(config().LandingPage, Equals, reloaded.LandingPage)
+	// The GitHub token doesn't go to another host.
+	c.Assert(config().BackendBaseURL, Equals, reloaded.BackendBaseURL)
+	c.Assert(config().Backends, DeepEquals, reloaded.Backends)
+	c.Assert(log.String(), Matches, `.*level=WARN msg="configuration reloaded, some changes need a restart" path=\S+ restart="\[LogLevel BackendBaseURL Backends LandingPage MaxIdleConns ModuleCacheDir\]"\n`)
+
+	log.Reset()
+	write("backend_base_url: " + s.github.URL + "\nallow_private_backend: true\nmaintenance: true\n")
+	reloadConfig()
+	c.Assert(log.String(), Matches, `(?s).*level=WARN msg="maintenance mode on" path=\S+\n.*`)
+	write("backend_base_url: " + s.github.URL + "\nallow_private_backend: true\n")
+	reloadConfig()
+	c.Assert(log.String(), Matches, `(?s).*level=WARN msg="maintenance mode off" path=\S+\n.*`)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maintenanceExempt are the paths still served in maintenance mode: the
+// health checks, so that the instance isn't taken for dead and
+// restarted, the version and the metrics.
+var maintenanceExempt = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/health-check": true,
+	"/version":      true,
+	"/metrics":      true,
+}
+
+// withMaintenance wraps h so that, while config.Maintenance is set, every
+// request but those for maintenanceExempt paths is answered 503 Service
+// Unavailable with config.MaintenanceMessage, rather than seeing whatever
+// GitHub or our own deploy leaves behind. Since the configuration is
+// looked up on every request, maintenance is turned on and off by
+// reloading it with SIGHUP.
+func withMaintenance(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config().Maintenance || maintenanceExempt[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if d := config().MaintenanceRetryAfter; d > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10))
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(config().MaintenanceMessage))
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&MaintenanceSuite{})
+
+type MaintenanceSuite struct {
+	running *Config
+}
+
+func (s *MaintenanceSuite) SetUpTest(c *C) {
+	s.running = config()
+	cfg := *s.running
+	cfg.Maintenance = true
+	liveConfig.Store(&cfg)
+}
+
+func (s *MaintenanceSuite) TearDownTest(c *C) {
+	liveConfig.Store(s.running)
+}
+
+func (s *MaintenanceSuite) serve(path string) *httptest.ResponseRecorder {
+	h := withMaintenance(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func (s *MaintenanceSuite) TestMaintenance(c *C) {
+	for _, path := range []string{"/config.v1?go-get=1", "/config.v1/info/refs", "/aahframe.work/config.v1/@v/list"} {
+		rec := s.serve(path)
+		c.Check(rec.Code, Equals, http.StatusServiceUnavailable, Commentf("path %s", path))
+		c.Check(rec.Header().Get("Retry-After"), Equals, "300")
+		c.Check(rec.Body.String(), Equals, "Down for maintenance, try again later.")
+	}
+	for path := range maintenanceExempt {
+		rec := s.serve(path)
+		c.Check(rec.Code, Equals, http.StatusOK, Commentf("path %s", path))
+		c.Check(rec.Body.String(), Equals, "ok")
+	}
+}
+
+func (s *MaintenanceSuite) TestMessage(c *C) {
+	config().MaintenanceMessage = "GitHub maintenance until 10:00 UTC."
+	config().MaintenanceRetryAfter = 1500 * time.Millisecond
+	rec := s.serve("/config.v1/git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "2")
+	c.Assert(rec.Body.String(), Equals, "GitHub maintenance until 10:00 UTC.")
+
+	config().MaintenanceRetryAfter = 0
+	rec = s.serve("/config.v1/git-upload-pack")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header()["Retry-After"], IsNil)
+}
+
+func (s *MaintenanceSuite) TestOff(c *C) {
+	config().Maintenance = false
+	rec := s.serve("/config.v1?go-get=1")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// repoMethods returns the methods accepted on the repository sub path:
+// git sends POST to the pack services, and everything else, from info/refs
+// to the go get page, is only ever read.
+func repoMethods(subPath string) []string {
+	switch subPath {
+	case "/git-upload-pack", "/git-receive-pack":
+		return []string{"POST"}
+	}
+	return []string{"GET", "HEAD"}
+}
+
+// moduleMethods are the methods accepted on the module proxy endpoints.
+var moduleMethods = []string{"GET", "HEAD"}
+
+// allowMethod reports whether req uses one of methods. When it doesn't,
+// a 405 Method Not Allowed listing them in Allow is sent, and nothing is
+// forwarded to GitHub.
+func allowMethod(resp http.ResponseWriter, req *http.Request, methods []string) bool {
+	if containsString(methods, req.Method) {
+		return true
+	}
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	resp.WriteHeader(http.StatusMethodNotAllowed)
+	_, _ = resp.Write([]byte("Method not allowed."))
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics backends of config.MetricsBackend.
+const (
+	metricsNone       = "none"
+	metricsPrometheus = "prometheus"
+	metricsStatsD     = "statsd"
+)
+
+// ProxyStats describes a request proxied to GitHub, once done.
+type ProxyStats struct {
+	Service  string        // serviceUploadPack, serviceReceivePack, serviceInfoRefs or serviceDumb
+	Status   int           // status of GitHub's response, zero if none came
+	Bytes    int64         // response body bytes sent to the client
+	Duration time.Duration // from sending the request to the end of the response
+}
+
+// Metrics receives measurements of the proxy activity.
+type Metrics interface {
+	// ProxyStarted is called when a request for service starts being
+	// proxied to GitHub, and is followed by a ProxyDone call once over.
+	ProxyStarted(service string)
+
+	// ProxyDone is called once for every request proxied to GitHub.
+	ProxyDone(s ProxyStats)
+
+	// CacheLookup is called whenever cache, cacheModuleZip for instance,
+	// is looked up, telling whether the entry was found.
+	CacheLookup(cache string, hit bool)
+
+	// CacheSize is called with the bytes held by cache whenever they
+	// change, for the caches kept on disk.
+	CacheSize(cache string, bytes int64)
+
+	// CacheEvicted is called with the n entries just evicted from cache
+	// to make room.
+	CacheEvicted(cache string, n int)
+
+	// Panicked is called whenever serving a request panics.
+	Panicked()
+
+	// RateLimitRemaining is called with the requests left in GitHub's
+	// rate limit for resource, core for instance, whenever a response
+	// tells.
+	RateLimitRemaining(resource string, remaining int)
+
+	// PseudoVersion is called whenever @latest answers with a
+	// pseudo-version, for a module without tags.
+	PseudoVersion()
+
+	// RepoInFlight is called with the requests being proxied for the
+	// repositories matching pattern of config.RepoConcurrency whenever
+	// their number changes.
+	RepoInFlight(pattern string, n int)
+}
+
+// Caches reported to Metrics.CacheLookup.
+const (
+	cacheModuleZip = "module_zip"
+	cacheRefs      = "refs"
+	cacheRefsDisk  = "refs_disk"
+	cacheNotFound  = "not_found"
+)
+
+// metrics is where measurements are reported. It discards them unless
+// set to some other implementation.
+var metrics Metrics = nopMetrics{}
+
+// setupMetrics returns the Metrics of cfg.MetricsBackend.
+func setupMetrics(cfg *Config) (Metrics, error) {
+	switch cfg.MetricsBackend {
+	case metricsNone:
+		return nopMetrics{}, nil
+	case metricsPrometheus:
+		return newPromMetrics(prometheus.DefaultRegisterer), nil
+	case metricsStatsD:
+		return newStatsDMetrics(cfg.StatsDAddr, cfg.StatsDSampleRate)
+	default:
+		return nil, fmt.Errorf("invalid metrics backend %q", cfg.MetricsBackend)
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ProxyStarted(string)            {}
+func (nopMetrics) ProxyDone(ProxyStats)           {}
+func (nopMetrics) CacheLookup(string, bool)       {}
+func (nopMetrics) CacheSize(string, int64)        {}
+func (nopMetrics) CacheEvicted(string, int)       {}
+func (nopMetrics) Panicked()                      {}
+func (nopMetrics) RateLimitRemaining(string, int) {}
+func (nopMetrics) PseudoVersion()                 {}
+func (nopMetrics) RepoInFlight(string, int)       {}
+
+// MetricsFunc adapts a function to the Metrics interface, called with
+// every ProxyDone measurement.
+type MetricsFunc func(s ProxyStats)
+
+func (f MetricsFunc) ProxyStarted(string)            {}
+func (f MetricsFunc) ProxyDone(s ProxyStats)         { f(s) }
+func (f MetricsFunc) CacheLookup(string, bool)       {}
+func (f MetricsFunc) CacheSize(string, int64)        {}
+func (f MetricsFunc) CacheEvicted(string, int)       {}
+func (f MetricsFunc) Panicked()                      {}
+func (f MetricsFunc) RateLimitRemaining(string, int) {}
+func (f MetricsFunc) PseudoVersion()                 {}
+func (f MetricsFunc) RepoInFlight(string, int)       {}
+
+// teeMetrics reports every measurement to each of its Metrics in turn.
+type teeMetrics []Metrics
+
+func (t teeMetrics) ProxyStarted(service string) {
+	for _, m := range t {
+		m.ProxyStarted(service)
+	}
+}
+
+func (t teeMetrics) ProxyDone(s ProxyStats) {
+	for _, m := range t {
+		m.ProxyDone(s)
+	}
+}
+
+func (t teeMetrics) CacheLookup(cache string, hit bool) {
+	for _, m := range t {
+		m.CacheLookup(cache, hit)
+	}
+}
+
+func (t teeMetrics) CacheSize(cache string, bytes int64) {
+	for _, m := range t {
+		m.CacheSize(cache, bytes)
+	}
+}
+
+func (t teeMetrics) CacheEvicted(cache string, n int) {
+	for _, m := range t {
+		m.CacheEvicted(cache, n)
+	}
+}
+
+func (t teeMetrics) Panicked() {
+	for _, m := range t {
+		m.Panicked()
+	}
+}
+
+func (t teeMetrics) RateLimitRemaining(resource string, remaining int) {
+	for _, m := range t {
+		m.RateLimitRemaining(resource, remaining)
+	}
+}
+
+func (t teeMetrics) PseudoVersion() {
+	for _, m := range t {
+		m.PseudoVersion()
+	}
+}
+
+func (t teeMetrics) RepoInFlight(pattern string, n int) {
+	for _, m := range t {
+		m.RepoInFlight(pattern, n)
+	}
+}
+
+// statusClass returns the class of an HTTP status as "2xx" to "5xx", or
+// "error" when no response was received.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
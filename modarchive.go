@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	modzip "golang.org/x/mod/zip"
+)
+
+// codeloadBaseURL is where GitHub serves the tarballs of repositories.
+var codeloadBaseURL = "https://codeload.github.com"
+
+// archiveURL returns the URL of the tarball of repo at rev, a tag or
+// commit hash, for the repositories whose module zips are built from
+// one: public ones at github.com. Tokens are only ever sent to their
+// backend host, so private repositories and those of other backends are
+// cloned instead.
+func archiveURL(repo *Repo, rev string) (string, bool) {
+	root := repo.BackendRoot()
+	path, ok := strings.CutPrefix(root, "https://github.com/")
+	if !ok || isPrivateRepo(root) {
+		return "", false
+	}
+	if !isCommitHash(rev) {
+		rev = "refs/tags/" + rev
+	}
+	return codeloadBaseURL + "/" + path + "/tar.gz/" + rev, true
+}
+
+// fetchArchive fetches the tarball of repo at url, that of version, and
+// extracts it into src.
+func fetchArchive(ctx context.Context, repo *Repo, version, url, src string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent(config(), ""))
+	res, err := doRetry(req)
+	if err != nil {
+		return fmt.Errorf("cannot fetch archive of %s at %s: %v", repo.GitHubRoot(), version, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch archive of %s at %s: %s", repo.GitHubRoot(), version, res.Status)
+	}
+	if err := extractArchive(res.Body, repo.Name, src); err != nil {
+		return fmt.Errorf("cannot extract archive of %s at %s: %v", repo.GitHubRoot(), version, err)
+	}
+	return nil
+}
+
+// extractArchive extracts the gzipped tarball r into dir. The tarballs of
+// GitHub hold the tree in a single top-level directory named after the
+// repository, name, and the revision, whose content goes into dir. Only
+// directories and regular files are extracted: symbolic links are left
+// out, as they are of module zips, and submodules come as empty
+// directories. Archives over the largest module zip are refused.
+func extractArchive(r io.Reader, name, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	var top string
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// The commit hash, as a comment.
+			continue
+		}
+		first, rest, _ := strings.Cut(strings.TrimSuffix(hdr.Name, "/"), "/")
+		if top == "" {
+			if !strings.HasPrefix(strings.ToLower(first), strings.ToLower(name)+"-") {
+				return fmt.Errorf("unexpected top-level directory %q", first)
+			}
+			top = first
+		} else if first != top {
+			return fmt.Errorf("more than one top-level directory, %q and %q", top, first)
+		}
+		if rest == "" {
+			continue
+		}
+		if !filepath.IsLocal(rest) {
+			return fmt.Errorf("invalid path %q", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rest))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if size += hdr.Size; size > modzip.MaxZipFile {
+				return fmt.Errorf("larger than %d bytes", int64(modzip.MaxZipFile))
+			}
+			if err := extractFile(tr, target); err != nil {
+				return err
+			}
+		}
+	}
+	if top == "" {
+		return fmt.Errorf("empty archive")
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// extractFile writes the content of r to the file at path.
+func extractFile(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ArchiveSuite{})
+
+// ArchiveSuite builds module zips from tarballs served by a fake
+// codeload.github.com.
+type ArchiveSuite struct {
+	restore func()
+}
+
+func (s *ArchiveSuite) SetUpTest(c *C) {
+	base, dir, codeload := config().BackendBaseURL, config().ModuleCacheDir, codeloadBaseURL
+	s.restore = func() {
+		config().BackendBaseURL, config().ModuleCacheDir, codeloadBaseURL = base, dir, codeload
+		config().PrivateRepos = nil
+	}
+	config().BackendBaseURL = "https://github.com"
+	config().ModuleCacheDir = c.MkDir()
+	zipCached = &zipCache{}
+	breaker = &circuitBreaker{now: time.Now}
+}
+
+func (s *ArchiveSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// tarEntry is a file of a test tarball, a directory when its name ends
+// with a slash or a symbolic link to target when set.
+type tarEntry struct {
+	name, data, target string
+}
+
+func makeTarball(c *C, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	c.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header",
+		PAXRecords: map[string]string{"comment": "0123456789abcdef0123456789abcdef01234567"}}), IsNil)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		switch {
+		case e.target != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.target, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		}
+		c.Assert(tw.WriteHeader(hdr), IsNil)
+		_, err := tw.Write([]byte(e.data))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	c.Assert(gz.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *ArchiveSuite) TestArchiveURL(c *C) {
+	repo := &Repo{User: "go-aah", Name: "config"}
+	u, ok := archiveURL(repo, "v1.2.0")
+	c.Assert(ok, Equals, true)
+	c.Assert(u, Equals, "https://codeload.github.com/go-aah/config/tar.gz/refs/tags/v1.2.0")
+	u, ok = archiveURL(repo, "0123456789abcdef0123456789abcdef01234567")
+	c.Assert(ok, Equals, true)
+	c.Assert(u, Equals, "https://codeload.github.com/go-aah/config/tar.gz/0123456789abcdef0123456789abcdef01234567")
+
+	config().PrivateRepos = []string{"go-aah/config"}
+	_, ok = archiveURL(repo, "v1.2.0")
+	c.Assert(ok, Equals, false)
+
+	config().PrivateRepos = nil
+	config().BackendBaseURL = "https://github.example.com"
+	_, ok = archiveURL(repo, "v1.2.0")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ArchiveSuite) TestBuild(c *C) {
+	tarball := makeTarball(c,
+		tarEntry{name: "config-1.2.0/"},
+		tarEntry{name: "config-1.2.0/go.mod", data: "module aahframe.work/config.v1\n"},
+		tarEntry{name: "config-1.2.0/config.go", data: "package config\n"},
+		tarEntry{name: "config-1.2.0/sub/sub.go", data: "package sub\n"},
+		tarEntry{name: "config-1.2.0/nested/go.mod", data: "module aahframe.work/config.v1/nested\n"},
+		tarEntry{name: "config-1.2.0/nested/nest.go", data: "package nested\n"},
+		tarEntry{name: "config-1.2.0/link.go", target: "config.go"},
+		// A submodule.
+		tarEntry{name: "config-1.2.0/third_party/"},
+	)
+	var gotPath string
+	codeload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = w.Write(tarball)
+	}))
+	defer codeload.Close()
+	codeloadBaseURL = codeload.URL
+
+	f, err := moduleZip(context.Background(), &Repo{User: "go-aah", Name: "config"}, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	c.Assert(gotPath, Equals, "/go-aah/config/tar.gz/refs/tags/v1.2.0")
+	c.Assert(zipNames(c, f.Name()), DeepEquals, []string{
+		"aahframe.work/config.v1@v1.2.0/config.go",
+		"aahframe.work/config.v1@v1.2.0/go.mod",
+		"aahframe.work/config.v1@v1.2.0/sub/sub.go",
+	})
+}
+
+func (s *ArchiveSuite) TestBuildError(c *C) {
+	codeload := httptest.NewServer(http.NotFoundHandler())
+	defer codeload.Close()
+	codeloadBaseURL = codeload.URL
+
+	_, err := moduleZip(context.Background(), &Repo{User: "go-aah", Name: "config"}, "aahframe.work/config.v1", "v1.3.0", "v1.3.0")
+	c.Assert(err, ErrorMatches, "cannot fetch archive of github.com/go-aah/config at v1.3.0: 404 Not Found")
+}
+
+func (s *ArchiveSuite) TestExtractInvalid(c *C) {
+	tests := []struct {
+		entries []tarEntry
+		err     string
+	}{
+		{nil, "empty archive"},
+		{[]tarEntry{{name: "other-1.2.0/go.mod"}}, `unexpected top-level directory "other-1.2.0"`},
+		{[]tarEntry{{name: "config-1.2.0/go.mod"}, {name: "config-1.3.0/go.mod"}}, `more than one top-level directory, "config-1.2.0" and "config-1.3.0"`},
+		{[]tarEntry{{name: "config-1.2.0/../../etc/passwd"}}, `invalid path "config-1.2.0/../../etc/passwd"`},
+	}
+	for _, t := range tests {
+		err := extractArchive(bytes.NewReader(makeTarball(c, t.entries...)), "config", filepath.Join(c.MkDir(), "src"))
+		c.Check(err, ErrorMatches, t.err)
+	}
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// serveModule answers the requests of the GOPROXY protocol for the
+// modules served here, so that GOPROXY may point at this host:
+//
+//	GET /<module>/@v/list
+//	GET /<module>/@v/<version>.info
+//	GET /<module>/@v/<version>.mod
+//	GET /<module>/@v/<version>.zip
+//	GET /<module>/@latest
+//
+// Modules are found at the same paths as packages, under the domain
+// name: aahframe.work/config for the default branch of go-aah/config,
+// or aahframe.work/config.v1 for its v1 tags. Note that the go command
+// only recognizes the .vN suffix as a major version under gopkg.in, so
+// elsewhere only v0 and v1 are valid versions for such module paths.
+//
+// The .info of a commit hash, possibly abbreviated, gives the canonical
+// version of that commit, for go get <module>@<hash>: its tag, or its
+// pseudo-version.
+//
+// Retracted versions are served like any other, as the go command reads
+// retractions from the go.mod of the latest version itself.
+func serveModule(resp http.ResponseWriter, req *http.Request) {
+	if !allowMethod(resp, req, moduleMethods) {
+		return
+	}
+	var escPath, file string
+	if i := strings.Index(req.URL.Path, "/@v/"); i >= 0 {
+		escPath, file = req.URL.Path[1:i], req.URL.Path[i+len("/@v/"):]
+	} else {
+		escPath, file = strings.TrimSuffix(req.URL.Path[1:], "/@latest"), "@latest"
+	}
+	modPath, err := decodeModulePath(escPath)
+	if err != nil {
+		sendBadRequest(resp, err)
+		return
+	}
+	// Either "list", "@latest" or <version>.info, .mod or .zip.
+	kind, version := file, ""
+	if i := strings.LastIndexByte(file, '.'); i >= 0 {
+		kind = file[i:]
+		if version, err = decodeVersion(file[:i]); err != nil {
+			sendBadRequest(resp, err)
+			return
+		}
+	}
+	repo := moduleRepo(modPath)
+	if repo == nil {
+		sendNotFound(resp, "Module %s is not served here.", modPath)
+		return
+	}
+	traceRepo(req.Context(), repo)
+	if !repoAllowed(repo) {
+		sendForbidden(resp, req, repo)
+		return
+	}
+	if err := validateTarget(repo.BackendRoot()); err != nil {
+		sendBadTarget(resp, req, err)
+		return
+	}
+
+	switch {
+	case kind == "list":
+		tags, err := moduleTags(req.Context(), repo, modPath)
+		if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		versions := make([]string, 0, len(tags))
+		for v := range tags {
+			versions = append(versions, v)
+		}
+		semver.Sort(versions)
+		setCacheHeaders(resp.Header(), endpointModuleList)
+		if checkNotModified(resp, req, refsCached.lastModified(repo.BackendRoot()+refsSuffix)) {
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			fmt.Fprintln(resp, v)
+		}
+	case kind == "@latest" || kind == ".info":
+		tags, err := moduleTags(req.Context(), repo, modPath)
+		if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		var hash, query string
+		var t time.Time
+		if kind == "@latest" {
+			version = latestVersion(tags)
+		}
+		switch {
+		case version == "":
+			// Untagged, go by the branch.
+			version, hash, err = untaggedVersion(req.Context(), repo, modPath)
+			if err == nil {
+				metrics.PseudoVersion()
+			}
+		case isCommitRev(version):
+			// A query for a commit, as in go get module@<hash>, answered
+			// with its canonical version.
+			query = version
+			if hash, t, err = lookupCommit(req.Context(), repo, query); err == nil {
+				version, err = commitVersion(req.Context(), repo, modPath, hash, t, tags)
+			}
+		default:
+			hash, err = moduleVersion(req.Context(), repo, modPath, version, tags)
+		}
+		if err == nil {
+			t, err = commitTime(req.Context(), repo, hash)
+		}
+		if err == ErrNoVersion {
+			if query != "" {
+				version = query
+			}
+			sendNotFound(resp, "Module %s has no version %s.", modPath, version)
+			return
+		} else if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		// What a commit resolves to changes as tags are added, while the
+		// info of a version is as old as its commit.
+		modified := t
+		if kind == "@latest" || query != "" {
+			setCacheHeaders(resp.Header(), endpointModuleLatest)
+			modified = refsCached.lastModified(repo.BackendRoot() + refsSuffix)
+		} else {
+			setCacheHeaders(resp.Header(), endpointModuleInfo)
+		}
+		if checkNotModified(resp, req, modified) {
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(resp).Encode(moduleInfo{Version: version, Time: t})
+	case kind == ".mod":
+		tags, err := moduleTags(req.Context(), repo, modPath)
+		if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		hash, err := moduleVersion(req.Context(), repo, modPath, version, tags)
+		if err == ErrNoVersion {
+			sendNotFound(resp, "Module %s has no version %s.", modPath, version)
+			return
+		} else if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		data, modified, err := fetchGoMod(req.Context(), repo, hash, req.Header.Get("If-Modified-Since"))
+		if err == errNotModified {
+			setCacheHeaders(resp.Header(), endpointModuleMod)
+			if !modified.IsZero() {
+				resp.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			}
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		} else if err == errNoGoMod {
+			// The go command expects a module without go.mod to be
+			// described by its module directive alone.
+			data = []byte("module " + modfile.AutoQuote(modPath) + "\n")
+		} else if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		} else if path := modfile.ModulePath(data); path != modPath {
+			// The go command would refuse it anyway, less clearly. Not
+			// found rather than an error, as for any other proxy.
+			logger.WarnContext(req.Context(), "go.mod module path mismatch", "module", modPath, "version", version, "declared", path, "repo", repo.GitHubRoot())
+			sendNotFound(resp, modulePathMismatch(modPath, version, path))
+			return
+		}
+		setCacheHeaders(resp.Header(), endpointModuleMod)
+		if checkNotModified(resp, req, modified) {
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = resp.Write(data)
+	case kind == ".zip":
+		tags, err := moduleTags(req.Context(), repo, modPath)
+		if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		hash, err := moduleVersion(req.Context(), repo, modPath, version, tags)
+		if err == ErrNoVersion {
+			sendNotFound(resp, "Module %s has no version %s.", modPath, version)
+			return
+		} else if err != nil {
+			sendModuleError(resp, repo, err)
+			return
+		}
+		// Tags are cloned by name, pseudo-versions by commit.
+		rev := version
+		if _, tagged := tags[version]; !tagged {
+			rev = hash
+		}
+		f, err := moduleZip(req.Context(), repo, modPath, version, rev)
+		if err != nil {
+			logger.ErrorContext(req.Context(), "cannot build module zip", "module", modPath, "version", version, "err", err)
+			sendModuleError(resp, repo, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			logger.ErrorContext(req.Context(), "cannot open module zip", "module", modPath, "version", version, "err", err)
+			resp.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setCacheHeaders(resp.Header(), endpointModuleZip)
+		resp.Header().Set("Content-Type", "application/zip")
+		// Fresh zips are written to the cache before being served too, so
+		// that interrupted downloads can always resume with a Range.
+		http.ServeContent(resp, req, "", info.ModTime(), f)
+	default:
+		sendNotFound(resp, "Unsupported module proxy request.")
+	}
+}
+
+// decodeModulePath decodes a module path as found in GOPROXY URLs, where
+// capital letters are written as an exclamation mark followed by the
+// letter in lower case (!azure for Azure), so that paths differing only
+// in case stay apart on case-insensitive file systems.
+func decodeModulePath(escaped string) (string, error) {
+	path, err := module.UnescapePath(escaped)
+	if err != nil {
+		return "", fmt.Errorf("invalid module path %q", escaped)
+	}
+	return path, nil
+}
+
+// decodeVersion decodes a version as found in GOPROXY URLs, encoded the
+// same way as module paths.
+func decodeVersion(escaped string) (string, error) {
+	v, err := module.UnescapeVersion(escaped)
+	if err != nil {
+		return "", fmt.Errorf("invalid module version %q", escaped)
+	}
+	return v, nil
+}
+
+// moduleRepo returns the repository holding the module at modPath at its
+// root, or nil if modPath isn't the path of a module served here.
+func moduleRepo(modPath string) *Repo {
+	prefix := *domainNameFlag + "/"
+	if !strings.HasPrefix(modPath, prefix) {
+		return nil
+	}
+	repo, version := parseRepoPath("/" + modPath[len(prefix):])
+	if repo == nil || repo.SubPath != "" {
+		return nil
+	}
+	if !repo.Unversioned {
+		var ok bool
+		repo.MajorVersion, ok = parseVersion(version)
+		if !ok || repo.MajorVersion.Minor >= 0 || repo.MajorVersion.Edge {
+			return nil
+		}
+	}
+	// Paths with a .git suffix and the like are left alone.
+	if repo.GopkgRoot() != modPath {
+		return nil
+	}
+	return repo
+}
+
+// moduleTags returns the versions of the module at modPath in repo, each
+// mapped to the hash of the commit it is tagged at. Only semantic version
+// tags that are valid for the module path count, and for versioned paths
+// only those of the major version in the path.
+func moduleTags(ctx context.Context, repo *Repo, modPath string) (map[string]string, error) {
+	data, err := fetchRefs(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parseTags(data)
+	if err != nil {
+		return nil, err
+	}
+	major := "v" + strconv.Itoa(repo.MajorVersion.Major)
+	versions := make(map[string]string)
+	for tag, hash := range tags {
+		if !semver.IsValid(tag) || semver.Canonical(tag) != tag || module.IsPseudoVersion(tag) {
+			continue
+		}
+		if !repo.Unversioned && semver.Major(tag) != major {
+			continue
+		}
+		if module.Check(modPath, tag) != nil {
+			continue
+		}
+		versions[tag] = hash
+	}
+	return versions, nil
+}
+
+// latestVersion returns the highest release in tags, or the highest
+// pre-release if there are no releases.
+func latestVersion(tags map[string]string) string {
+	var latest, latestPre string
+	for v := range tags {
+		if semver.Prerelease(v) == "" {
+			if semver.Compare(v, latest) > 0 {
+				latest = v
+			}
+		} else if semver.Compare(v, latestPre) > 0 {
+			latestPre = v
+		}
+	}
+	if latest == "" {
+		return latestPre
+	}
+	return latest
+}
+
+// untaggedVersion returns the pseudo-version of the module at modPath in
+// repo for the commit its import path resolves to when there are no
+// tags, along with the commit hash: the head of the default branch for
+// plain paths, and of the branch of the major version, v1 say, for
+// versioned ones. It fails with ErrNoVersion without such a branch.
+func untaggedVersion(ctx context.Context, repo *Repo, modPath string) (version, hash string, err error) {
+	data, err := fetchRefs(ctx, repo)
+	if err != nil {
+		return "", "", err
+	}
+	if !repo.Unversioned {
+		if data, _, err = changeRefs(data, repo.MajorVersion); err != nil {
+			return "", "", err
+		}
+	}
+	refs, err := parseRefs(data)
+	if err != nil {
+		return "", "", err
+	}
+	hash, ok := refs["HEAD"]
+	if !ok {
+		return "", "", ErrNoVersion
+	}
+	t, err := commitTime(ctx, repo, hash)
+	if err != nil {
+		return "", "", err
+	}
+	if version, err = commitVersion(ctx, repo, modPath, hash, t, nil); err != nil {
+		return "", "", err
+	}
+	return version, hash, nil
+}
+
+// maxBaseTags is the number of tags, highest first, that commitVersion
+// tries as the base of a pseudo-version, each costing an API request.
+const maxBaseTags = 8
+
+// commitVersion returns the version of the module at modPath in repo at
+// the commit with the given hash and date: the highest of tags at that
+// commit, or else its pseudo-version, based on the highest of tags the
+// commit descends from. Commits descending from none of the maxBaseTags
+// highest tags get a pseudo-version without a base, v0.0.0-<date>-<hash>
+// say. It fails with ErrNoVersion when the version would be invalid for
+// modPath.
+func commitVersion(ctx context.Context, repo *Repo, modPath, hash string, t time.Time, tags map[string]string) (string, error) {
+	versions := make([]string, 0, len(tags))
+	for v, h := range tags {
+		if h == hash {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) > 0 {
+		semver.Sort(versions)
+		return versions[len(versions)-1], nil
+	}
+	for v := range tags {
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+	base := ""
+	for i := len(versions) - 1; i >= 0 && i >= len(versions)-maxBaseTags; i-- {
+		ok, err := descends(ctx, repo, tags[versions[i]], hash)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			base = versions[i]
+			break
+		}
+	}
+	major := ""
+	if !repo.Unversioned && repo.MajorVersion.Major > 0 {
+		major = "v" + strconv.Itoa(repo.MajorVersion.Major)
+	}
+	version := module.PseudoVersion(major, base, t, hash[:12])
+	if module.Check(modPath, version) != nil {
+		return "", ErrNoVersion
+	}
+	return version, nil
+}
+
+// moduleVersion returns the commit hash of version of the module at
+// modPath in repo: the one tagged in tags, or for a pseudo-version, the
+// commit it names, provided its date is the commit date and its base, if
+// any, is one of tags the commit descends from. Like the go command, it
+// accepts pseudo-versions that are no longer canonical, as those found
+// in go.mod files must keep working after new tags. It fails with
+// ErrNoVersion otherwise.
+func moduleVersion(ctx context.Context, repo *Repo, modPath, version string, tags map[string]string) (string, error) {
+	if hash, ok := tags[version]; ok {
+		return hash, nil
+	}
+	if !module.IsPseudoVersion(version) || module.Check(modPath, version) != nil {
+		return "", ErrNoVersion
+	}
+	rev, err := module.PseudoVersionRev(version)
+	if err != nil || !isCommitRev(rev) {
+		return "", ErrNoVersion
+	}
+	hash, t, err := lookupCommit(ctx, repo, rev)
+	if err != nil {
+		return "", err
+	}
+	if pt, err := module.PseudoVersionTime(version); err != nil || !pt.Equal(t) {
+		return "", ErrNoVersion
+	}
+	base, err := module.PseudoVersionBase(version)
+	if err != nil {
+		return "", ErrNoVersion
+	}
+	if base != "" {
+		baseHash, ok := tags[base]
+		if !ok {
+			return "", ErrNoVersion
+		}
+		ok, err := descends(ctx, repo, baseHash, hash)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", ErrNoVersion
+		}
+	}
+	return hash, nil
+}
+
+// isCommitRev reports whether rev is a commit hash, complete or
+// abbreviated to no less than 7 hexadecimal digits.
+func isCommitRev(rev string) bool {
+	if len(rev) < 7 || len(rev) > 40 {
+		return false
+	}
+	for _, c := range rev {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// moduleInfo is the JSON body of the .info and @latest responses.
+type moduleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// commitTimes remembers the dates of the commits looked up, which never
+// change. It is emptied when it reaches maxCommitTimes entries.
+var commitTimes = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+const maxCommitTimes = 4096
+
+// commitTime returns the committer date of the commit with the given hash
+// in repo, as reported by the GitHub API.
+func commitTime(ctx context.Context, repo *Repo, hash string) (time.Time, error) {
+	_, t, err := lookupCommit(ctx, repo, hash)
+	return t, err
+}
+
+// lookupCommit returns the complete hash and the committer date of the
+// commit of repo that rev names, possibly abbreviated, as reported by the
+// GitHub API. It fails with ErrNoVersion if there is no such commit.
+func lookupCommit(ctx context.Context, repo *Repo, rev string) (string, time.Time, error) {
+	key := repo.GitHubRoot() + "@" + rev
+	commitTimes.Lock()
+	t, ok := commitTimes.m[key]
+	commitTimes.Unlock()
+	if ok {
+		return rev, t, nil
+	}
+
+	var commit struct {
+		SHA    string
+		Commit struct {
+			Committer struct {
+				Date time.Time
+			}
+		}
+	}
+	if err := getAPI(ctx, repo, "/commits/"+rev, &commit); err != nil {
+		return "", time.Time{}, err
+	}
+	// The API takes branch names too, which hashes mustn't resolve to.
+	if !strings.HasPrefix(commit.SHA, rev) {
+		return "", time.Time{}, ErrNoVersion
+	}
+	t = commit.Commit.Committer.Date.UTC()
+
+	commitTimes.Lock()
+	if len(commitTimes.m) >= maxCommitTimes {
+		commitTimes.m = make(map[string]time.Time)
+	}
+	commitTimes.m[repo.GitHubRoot()+"@"+commit.SHA] = t
+	commitTimes.Unlock()
+	return commit.SHA, t, nil
+}
+
+// commitAncestry remembers whether commits descend from others, which
+// never changes either. It is emptied when it reaches maxCommitTimes
+// entries.
+var commitAncestry = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// descends reports whether the commit of repo with the given hash is, or
+// descends from, the one with hash base, as reported by the GitHub API.
+func descends(ctx context.Context, repo *Repo, base, hash string) (bool, error) {
+	key := repo.GitHubRoot() + "@" + base + "..." + hash
+	commitAncestry.Lock()
+	ok, found := commitAncestry.m[key]
+	commitAncestry.Unlock()
+	if found {
+		return ok, nil
+	}
+
+	var compare struct {
+		Status string
+	}
+	if err := getAPI(ctx, repo, "/compare/"+base+"..."+hash, &compare); err != nil {
+		return false, err
+	}
+	ok = compare.Status == "ahead" || compare.Status == "identical"
+
+	commitAncestry.Lock()
+	if len(commitAncestry.m) >= maxCommitTimes {
+		commitAncestry.m = make(map[string]bool)
+	}
+	commitAncestry.m[key] = ok
+	commitAncestry.Unlock()
+	return ok, nil
+}
+
+// getAPI decodes into v the JSON answer of the GitHub API to a GET of the
+// given path under the repos endpoint of repo. It fails with ErrNoRepo if
+// GitHub has no such repository, remembered in notFoundCached as for its
+// refs, and ErrNoVersion if it doesn't know the commits in path.
+func getAPI(ctx context.Context, repo *Repo, path string, v interface{}) error {
+	refsURL := repo.BackendRoot() + refsSuffix
+	if notFoundCached.has(refsURL) {
+		return ErrNoRepo
+	}
+	ctx, cancel := context.WithTimeout(ctx, refsTimeout)
+	defer cancel()
+
+	root := strings.TrimPrefix(repo.GitHubRoot(), "github.com/")
+	url := apiBaseURLFor(baseURLFor(root)) + "/repos/" + root + path
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("cannot talk to GitHub: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent(config(), ""))
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := repoToken(root); token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	resp, err := doRetry(req)
+	if err == ErrCircuitOpen {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("cannot talk to GitHub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// ok
+	case 404:
+		notFoundCached.put(refsURL)
+		return ErrNoRepo
+	case 422:
+		// No commit found for the SHA.
+		return ErrNoVersion
+	default:
+		return fmt.Errorf("error from GitHub: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error reading from GitHub: %v", err)
+	}
+	return nil
+}
+
+var (
+	errNoGoMod     = errors.New("no go.mod file in repository")
+	errNotModified = errors.New("not modified")
+)
+
+// fetchGoMod returns the go.mod file at the root of repo at the commit
+// with the given hash, and its Last-Modified time as told by GitHub, or
+// errNoGoMod if there is none. The If-Modified-Since header of the
+// client, since, is passed on to GitHub, and errNotModified returned
+// with the time if GitHub answers 304 Not Modified.
+func fetchGoMod(ctx context.Context, repo *Repo, hash, since string) ([]byte, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, refsTimeout)
+	defer cancel()
+
+	url := repo.BackendRoot() + "/raw/" + hash + "/go.mod"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot talk to GitHub: %v", err)
+	}
+	req.Header.Set("User-Agent", userAgent(config(), ""))
+	setRepoToken(req.Header, url)
+	if since != "" {
+		req.Header.Set("If-Modified-Since", since)
+	}
+	resp, err := doRetry(req)
+	if err == ErrCircuitOpen {
+		return nil, time.Time{}, err
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot talk to GitHub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Zero if GitHub doesn't tell.
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	switch resp.StatusCode {
+	case 200:
+		// ok
+	case 304:
+		return nil, modified, errNotModified
+	case 404:
+		return nil, time.Time{}, errNoGoMod
+	default:
+		return nil, time.Time{}, fmt.Errorf("error from GitHub: %v", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, modzip.MaxGoMod+1))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error reading from GitHub: %v", err)
+	}
+	if len(data) > modzip.MaxGoMod {
+		return nil, time.Time{}, fmt.Errorf("go.mod file larger than %d bytes", modzip.MaxGoMod)
+	}
+	return data, modified, nil
+}
+
+// modulePathMismatch explains to clients that the go.mod file of modPath
+// at version declares module declared instead, telling apart a major
+// version suffix at odds with the path.
+func modulePathMismatch(modPath, version, declared string) string {
+	if declared == "" {
+		return fmt.Sprintf("The go.mod file of %s %s has no module directive; it must read \"module %s\".", modPath, version, modPath)
+	}
+	msg := fmt.Sprintf("The go.mod file of %s %s is for module %q", modPath, version, declared)
+	base, major := splitPathMajor(modPath)
+	if dbase, dmajor := splitPathMajor(declared); dbase == base && dmajor != major {
+		msg += ", differing in its major version suffix"
+	}
+	return msg + fmt.Sprintf("; it must read \"module %s\".", modPath)
+}
+
+// splitPathMajor splits the major version suffix off a module path,
+// either that of the paths served here, as in example.com/pkg.v2, or
+// that of the go command, as in github.com/user/pkg/v2. The suffix is
+// empty for paths without one.
+func splitPathMajor(path string) (base, major string) {
+	if prefix, pathMajor, ok := module.SplitPathVersion(path); ok && pathMajor != "" {
+		return prefix, strings.TrimLeft(pathMajor, "/.")
+	}
+	if i := strings.LastIndex(path, ".v"); i > strings.LastIndex(path, "/") {
+		if _, err := strconv.Atoi(path[i+2:]); err == nil {
+			return path[:i], path[i+1:]
+		}
+	}
+	return path, ""
+}
+
+// apiBaseURL returns the base URL of the REST API of the GitHub instance
+// in use: api.github.com, or the /api/v3 path of GitHub Enterprise hosts.
+func apiBaseURL() string {
+	return apiBaseURLFor(config().BackendBaseURL)
+}
+
+// apiBaseURLFor returns the base URL of the REST API of the GitHub
+// instance at base, as apiBaseURL does for config.BackendBaseURL.
+func apiBaseURLFor(base string) string {
+	base = strings.TrimSuffix(base, "/")
+	if base == "https://github.com" {
+		return "https://api.github.com"
+	}
+	return base + "/api/v3"
+}
+
+// parseTags returns the tags advertised in the upload-pack refs data,
+// mapped to the hash of the commit they point at.
+func parseTags(data []byte) (map[string]string, error) {
+	refs, err := parseRefs(data)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for name, hash := range refs {
+		if tag, ok := strings.CutPrefix(name, "refs/tags/"); ok {
+			tags[tag] = hash
+		}
+	}
+	return tags, nil
+}
+
+// parseRefs returns the refs advertised in the upload-pack refs data,
+// HEAD included, mapped to the hash they point at. Annotated tags are
+// mapped to the commit they are for.
+func parseRefs(data []byte) (map[string]string, error) {
+	refs := make(map[string]string)
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, fmt.Errorf("incomplete refs data received from GitHub")
+		}
+		size, err := strconv.ParseUint(string(data[i:i+4]), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse refs line size: %s", string(data[i:i+4]))
+		}
+		if size == 0 {
+			i += 4
+			continue
+		}
+		if size < 4 || i+int(size) > len(data) {
+			return nil, fmt.Errorf("incomplete refs data received from GitHub")
+		}
+		line := strings.TrimSuffix(string(data[i+4:i+int(size)]), "\n")
+		i += int(size)
+
+		if j := strings.IndexByte(line, 0); j >= 0 {
+			line = line[:j]
+		}
+		hash, name, ok := strings.Cut(line, " ")
+		if !ok || len(hash) != 40 {
+			continue
+		}
+		// An annotated tag is followed by its peeled commit.
+		refs[strings.TrimSuffix(name, "^{}")] = hash
+	}
+	return refs, nil
+}
+
+// sendBadRequest replies 400 to a malformed module proxy request.
+func sendBadRequest(resp http.ResponseWriter, err error) {
+	resp.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(resp, err)
+}
+
+// sendModuleError replies to a module proxy request that failed with err.
+func sendModuleError(resp http.ResponseWriter, repo *Repo, err error) {
+	switch err {
+	case ErrNoRepo:
+		sendNotFound(resp, "GitHub repository not found at https://%s", repo.GitHubRoot())
+	case ErrNoVersion:
+		sendNotFound(resp, "GitHub repository at https://%s has no branch for the module.", repo.GitHubRoot())
+	case ErrCircuitOpen:
+		sendCircuitOpen(resp)
+	default:
+		status, _ := backendErrorStatus(err)
+		resp.WriteHeader(status)
+		fmt.Fprintf(resp, "Cannot obtain module from GitHub: %v", err)
+	}
+}
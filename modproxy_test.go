@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ModuleSuite{})
+
+// ModuleSuite drives the module proxy endpoints against a fake GitHub.
+type ModuleSuite struct {
+	github     *httptest.Server
+	mux        *http.ServeMux
+	restore    func()
+	commitHits int
+}
+
+var moduleRefs = reflines(
+	"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+	"00000000000000000000000000000000000hash1 refs/heads/master",
+	"00000000000000000000000000000000000hash2 refs/heads/v1",
+	"00000000000000000000000000000000000hash3 refs/tags/v1.0.0",
+	"00000000000000000000000000000000000hash4 refs/tags/v1.10.0",
+	"00000000000000000000000000000000000hash5 refs/tags/v1.10.0^{}",
+	"00000000000000000000000000000000000hash6 refs/tags/v1.2.0",
+	"00000000000000000000000000000000000hash7 refs/tags/v1.11.0-rc.1",
+	"00000000000000000000000000000000000hash8 refs/tags/v1.3",
+	"00000000000000000000000000000000000hash9 refs/tags/v1.0.1-0.20180329000000-0123456789ab",
+	"0000000000000000000000000000000000hash10 refs/tags/v0.9.0",
+	"0000000000000000000000000000000000hash11 refs/tags/v2.0.0",
+	"0000000000000000000000000000000000hash12 refs/tags/release-1",
+)
+
+func (s *ModuleSuite) SetUpTest(c *C) {
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/go-aah/config.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte(moduleRefs))
+	})
+	s.mux.HandleFunc("/Go-Aah/config.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte(moduleRefs))
+	})
+	s.mux.HandleFunc("/api/v3/repos/go-aah/config/commits/", func(w http.ResponseWriter, r *http.Request) {
+		s.commitHits++
+		hash := strings.TrimPrefix(r.URL.Path, "/api/v3/repos/go-aah/config/commits/")
+		if !strings.HasPrefix(hash, "000000") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"sha":%q,"commit":{"committer":{"name":"aah","date":"2018-03-29T10:20:30+02:00"}}}`, hash)
+	})
+	s.mux.HandleFunc("/go-aah/config/raw/", func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/go-aah/config/raw/") {
+		case "00000000000000000000000000000000000hash6/go.mod":
+			_, _ = w.Write([]byte("module aahframe.work/config.v1\n\ngo 1.11\n"))
+		case "00000000000000000000000000000000000hash5/go.mod":
+			_, _ = w.Write([]byte("module github.com/go-aah/config\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	s.github = httptest.NewTLSServer(s.mux)
+	s.commitHits = 0
+	commitTimes.m = make(map[string]time.Time)
+	commitAncestry.m = make(map[string]bool)
+
+	client, base, domain := httpClient, config().BackendBaseURL, *domainNameFlag
+	s.restore = func() {
+		httpClient, config().BackendBaseURL, *domainNameFlag = client, base, domain
+		config().AllowPrivateBackend = false
+	}
+	httpClient = s.github.Client()
+	config().BackendBaseURL = s.github.URL
+	config().AllowPrivateBackend = true
+	*domainNameFlag = "aahframe.work"
+	breaker = &circuitBreaker{now: time.Now}
+	refsCached = &refsCache{now: time.Now}
+	notFoundCached = &notFoundCache{now: time.Now}
+}
+
+func (s *ModuleSuite) TearDownTest(c *C) {
+	s.restore()
+	s.github.Close()
+}
+
+func (s *ModuleSuite) get(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func (s *ModuleSuite) TestList(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(rec.Body.String(), Equals, "v1.0.0\nv1.2.0\nv1.10.0\nv1.11.0-rc.1\n")
+}
+
+func (s *ModuleSuite) TestMethodNotAllowed(c *C) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("PUT", "/aahframe.work/config.v1/@v/v1.0.0.zip", nil))
+	c.Assert(rec.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(rec.Header().Get("Allow"), Equals, "GET, HEAD")
+}
+
+func (s *ModuleSuite) TestListUnversioned(c *C) {
+	rec := s.get("/aahframe.work/config/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "v0.9.0\nv1.0.0\nv1.2.0\nv1.10.0\nv1.11.0-rc.1\n")
+}
+
+func (s *ModuleSuite) TestListEmpty(c *C) {
+	rec := s.get("/aahframe.work/config.v3/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "")
+}
+
+func (s *ModuleSuite) TestNotServed(c *C) {
+	for _, path := range []string{
+		"/github.com/go-aah/config/@v/list",
+		"/aahframe.work/config.v1/sub/@v/list",
+		"/aahframe.work/config.git/@v/list",
+		"/aahframe.work/config.v1-edge/@v/list",
+		"/aahframe.work/config.v1.2/@v/list",
+	} {
+		c.Assert(s.get(path).Code, Equals, http.StatusNotFound, Commentf("path %s", path))
+	}
+}
+
+func (s *ModuleSuite) TestNoRepo(c *C) {
+	rec := s.get("/aahframe.work/log.v1/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Body.String(), Equals, "GitHub repository not found at https://github.com/go-aah/log")
+}
+
+func (s *ModuleSuite) TestParseTags(c *C) {
+	tags, err := parseTags([]byte(moduleRefs))
+	c.Assert(err, IsNil)
+	c.Assert(tags["v1.0.0"], Equals, "00000000000000000000000000000000000hash3")
+	c.Assert(tags["v1.10.0"], Equals, "00000000000000000000000000000000000hash5")
+	c.Assert(tags, HasLen, 9)
+
+	_, err = parseTags([]byte("00zz"))
+	c.Assert(err, ErrorMatches, "cannot parse refs line size: 00zz")
+	_, err = parseTags([]byte("0040abc"))
+	c.Assert(err, ErrorMatches, "incomplete refs data received from GitHub")
+}
+
+func (s *ModuleSuite) TestInfo(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@v/v1.2.0.info")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(rec.Body.String(), Equals, `{"Version":"v1.2.0","Time":"2018-03-29T08:20:30Z"}`+"\n")
+
+	// Commit dates are looked up once.
+	c.Assert(s.get("/aahframe.work/config.v1/@v/v1.2.0.info").Code, Equals, http.StatusOK)
+	c.Assert(s.commitHits, Equals, 1)
+}
+
+func (s *ModuleSuite) TestInfoNotModified(c *C) {
+	get := func(path string, since time.Time) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	// Versions are as old as their commit.
+	committed := time.Date(2018, 3, 29, 8, 20, 30, 0, time.UTC)
+	rec := get("/aahframe.work/config.v1/@v/v1.2.0.info", committed)
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), Equals, 0)
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, "Thu, 29 Mar 2018 08:20:30 GMT")
+	c.Assert(get("/aahframe.work/config.v1/@v/v1.2.0.info", committed.Add(-time.Second)).Code, Equals, http.StatusOK)
+
+	// The list and @latest as old as the cached refs.
+	modified := refsCached.lastModified(s.github.URL + "/go-aah/config" + refsSuffix)
+	c.Assert(modified.IsZero(), Equals, false)
+	c.Assert(get("/aahframe.work/config.v1/@v/list", modified).Code, Equals, http.StatusNotModified)
+	c.Assert(get("/aahframe.work/config.v1/@latest", modified).Code, Equals, http.StatusNotModified)
+	rec = get("/aahframe.work/config.v1/@latest", modified.Add(-time.Second))
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, modified.UTC().Format(http.TimeFormat))
+}
+
+func (s *ModuleSuite) TestInfoUnknown(c *C) {
+	for _, v := range []string{"v1.4.0", "v1.3", "v2.0.0", "master"} {
+		rec := s.get("/aahframe.work/config.v1/@v/" + v + ".info")
+		c.Assert(rec.Code, Equals, http.StatusNotFound, Commentf("version %s", v))
+		c.Assert(rec.Body.String(), Equals, "Module aahframe.work/config.v1 has no version "+v+".")
+	}
+	c.Assert(s.commitHits, Equals, 0)
+}
+
+func (s *ModuleSuite) TestLatest(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@latest")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, `{"Version":"v1.10.0","Time":"2018-03-29T08:20:30Z"}`+"\n")
+
+	rec = s.get("/aahframe.work/config.v3/@latest")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+}
+
+var untaggedRefs = reflines(
+	"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+	"00000000000000000000000000000000000hash1 refs/heads/master",
+	"0123456789abcdef0123456789abcdef01234567 refs/heads/v1",
+	"00000000000000000000000000000000000hash3 refs/tags/release-1",
+)
+
+func (s *ModuleSuite) TestLatestUntagged(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	m := newPromMetrics(prometheus.NewRegistry())
+	metrics = m
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(untaggedRefs))
+	})
+	s.mux.HandleFunc("/api/v3/repos/go-aah/log/commits/", func(w http.ResponseWriter, r *http.Request) {
+		rev := strings.TrimPrefix(r.URL.Path, "/api/v3/repos/go-aah/log/commits/")
+		for _, hash := range []string{"00000000000000000000000000000000000hash1", "0123456789abcdef0123456789abcdef01234567"} {
+			if strings.HasPrefix(hash, rev) {
+				_, _ = fmt.Fprintf(w, `{"sha":%q,"commit":{"committer":{"date":"2018-03-29T10:20:30+02:00"}}}`, hash)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	})
+
+	// The branch of the major version.
+	rec := s.get("/aahframe.work/log.v1/@latest")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, `{"Version":"v1.0.0-20180329082030-0123456789ab","Time":"2018-03-29T08:20:30Z"}`+"\n")
+	c.Assert(testutil.ToFloat64(m.pseudo), Equals, 1.0)
+
+	// The default branch.
+	rec = s.get("/aahframe.work/log/@latest")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, `{"Version":"v0.0.0-20180329082030-000000000000","Time":"2018-03-29T08:20:30Z"}`+"\n")
+
+	// What go get asks for next.
+	rec = s.get("/aahframe.work/log.v1/@v/v1.0.0-20180329082030-0123456789ab.info")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, `{"Version":"v1.0.0-20180329082030-0123456789ab","Time":"2018-03-29T08:20:30Z"}`+"\n")
+	rec = s.get("/aahframe.work/log.v1/@v/v1.0.0-20180329082030-fedcba987654.info")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	rec = s.get("/aahframe.work/log.v1/@v/list")
+	c.Assert(rec.Body.String(), Equals, "")
+
+	// No branch for it either.
+	rec = s.get("/aahframe.work/log.v2/@latest")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(testutil.ToFloat64(m.pseudo), Equals, 2.0)
+}
+
+var commitRefs = reflines(
+	"cccccccccccccccccccccccccccccccccccccccc HEAD\x00symref=HEAD:refs/heads/master",
+	"cccccccccccccccccccccccccccccccccccccccc refs/heads/master",
+	"1111111111111111111111111111111111111111 refs/tags/v1.0.0",
+	"2222222222222222222222222222222222222222 refs/tags/v1.1.0",
+)
+
+// commitHandlers serves the commits of go-aah/router: aaaa... descends
+// from v1.0.0 only, bbbb... from no tag.
+func (s *ModuleSuite) commitHandlers() {
+	s.mux.HandleFunc("/go-aah/router.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(commitRefs))
+	})
+	s.mux.HandleFunc("/api/v3/repos/go-aah/router/commits/", func(w http.ResponseWriter, r *http.Request) {
+		s.commitHits++
+		rev := strings.TrimPrefix(r.URL.Path, "/api/v3/repos/go-aah/router/commits/")
+		for _, hash := range []string{strings.Repeat("1", 40), strings.Repeat("2", 40), strings.Repeat("a", 40), strings.Repeat("b", 40)} {
+			if strings.HasPrefix(hash, rev) {
+				_, _ = fmt.Fprintf(w, `{"sha":%q,"commit":{"committer":{"date":"2018-03-29T10:20:30+02:00"}}}`, hash)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = fmt.Fprintf(w, `{"message":"No commit found for SHA: %s"}`, rev)
+	})
+	s.mux.HandleFunc("/api/v3/repos/go-aah/router/compare/", func(w http.ResponseWriter, r *http.Request) {
+		status := "diverged"
+		switch strings.TrimPrefix(r.URL.Path, "/api/v3/repos/go-aah/router/compare/") {
+		case strings.Repeat("1", 40) + "..." + strings.Repeat("a", 40):
+			status = "ahead"
+		case strings.Repeat("1", 40) + "..." + strings.Repeat("b", 40), strings.Repeat("2", 40) + "..." + strings.Repeat("1", 40):
+			status = "behind"
+		}
+		_, _ = fmt.Fprintf(w, `{"status":%q}`, status)
+	})
+}
+
+func (s *ModuleSuite) TestInfoCommit(c *C) {
+	s.commitHandlers()
+	for rev, version := range map[string]string{
+		"aaaaaaa":      "v1.0.1-0.20180329082030-aaaaaaaaaaaa",
+		"bbbbbbbbbbbb": "v1.0.0-20180329082030-bbbbbbbbbbbb",
+		"2222222":      "v1.1.0",
+	} {
+		rec := s.get("/aahframe.work/router.v1/@v/" + rev + ".info")
+		c.Assert(rec.Code, Equals, http.StatusOK, Commentf("rev %s", rev))
+		c.Assert(rec.Body.String(), Equals, `{"Version":"`+version+`","Time":"2018-03-29T08:20:30Z"}`+"\n")
+		c.Assert(rec.Header().Get("Cache-Control"), Equals, "public, max-age=60")
+	}
+
+	for _, rev := range []string{"ccccccc", "abc"} {
+		rec := s.get("/aahframe.work/router.v1/@v/" + rev + ".info")
+		c.Assert(rec.Code, Equals, http.StatusNotFound)
+		c.Assert(rec.Body.String(), Equals, "Module aahframe.work/router.v1 has no version "+rev+".")
+	}
+}
+
+func (s *ModuleSuite) TestPseudoVersion(c *C) {
+	s.commitHandlers()
+	for _, v := range []string{
+		"v1.0.1-0.20180329082030-aaaaaaaaaaaa",
+		// No longer canonical, but still valid.
+		"v1.0.0-20180329082030-aaaaaaaaaaaa",
+		"v1.0.0-20180329082030-bbbbbbbbbbbb",
+	} {
+		rec := s.get("/aahframe.work/router.v1/@v/" + v + ".info")
+		c.Assert(rec.Code, Equals, http.StatusOK, Commentf("version %s", v))
+		c.Assert(rec.Body.String(), Equals, `{"Version":"`+v+`","Time":"2018-03-29T08:20:30Z"}`+"\n")
+		c.Assert(rec.Header().Get("Cache-Control"), Equals, immutable)
+		rec = s.get("/aahframe.work/router.v1/@v/" + v + ".mod")
+		c.Assert(rec.Code, Equals, http.StatusOK)
+		c.Assert(rec.Body.String(), Equals, "module aahframe.work/router.v1\n")
+	}
+
+	for _, v := range []string{
+		// Wrong date.
+		"v1.0.1-0.20180329082031-aaaaaaaaaaaa",
+		// Not descending from its base, or no such base.
+		"v1.1.1-0.20180329082030-aaaaaaaaaaaa",
+		"v1.0.1-0.20180329082030-bbbbbbbbbbbb",
+		"v1.2.1-0.20180329082030-aaaaaaaaaaaa",
+		// No such commit.
+		"v1.0.0-20180329082030-cccccccccccc",
+		// Not of the major version.
+		"v2.0.0-20180329082030-bbbbbbbbbbbb",
+	} {
+		rec := s.get("/aahframe.work/router.v1/@v/" + v + ".info")
+		c.Assert(rec.Code, Equals, http.StatusNotFound, Commentf("version %s", v))
+		c.Assert(rec.Body.String(), Equals, "Module aahframe.work/router.v1 has no version "+v+".")
+	}
+}
+
+func (s *ModuleSuite) TestIsCommitRev(c *C) {
+	c.Assert(isCommitRev("0123abc"), Equals, true)
+	c.Assert(isCommitRev(strings.Repeat("f", 40)), Equals, true)
+	c.Assert(isCommitRev("0123ab"), Equals, false)
+	c.Assert(isCommitRev(strings.Repeat("f", 41)), Equals, false)
+	c.Assert(isCommitRev("0123ABC"), Equals, false)
+	c.Assert(isCommitRev("v1.2.0"), Equals, false)
+}
+
+func (s *ModuleSuite) TestLatestVersion(c *C) {
+	c.Assert(latestVersion(map[string]string{"v1.0.0": "", "v1.2.0": "", "v1.3.0-rc.1": ""}), Equals, "v1.2.0")
+	c.Assert(latestVersion(map[string]string{"v1.3.0-rc.1": "", "v1.3.0-rc.2": ""}), Equals, "v1.3.0-rc.2")
+	c.Assert(latestVersion(nil), Equals, "")
+}
+
+func (s *ModuleSuite) TestAPIBaseURL(c *C) {
+	defer func(base string) { config().BackendBaseURL = base }(config().BackendBaseURL)
+	config().BackendBaseURL = "https://github.com/"
+	c.Assert(apiBaseURL(), Equals, "https://api.github.com")
+	config().BackendBaseURL = "https://github.example.com"
+	c.Assert(apiBaseURL(), Equals, "https://github.example.com/api/v3")
+}
+
+func (s *ModuleSuite) TestMod(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@v/v1.2.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(rec.Body.String(), Equals, "module aahframe.work/config.v1\n\ngo 1.11\n")
+}
+
+func (s *ModuleSuite) TestModNotModified(c *C) {
+	var since string
+	s.mux.HandleFunc("/go-aah/config/raw/00000000000000000000000000000000000hash6/go.mod", func(w http.ResponseWriter, r *http.Request) {
+		since = r.Header.Get("If-Modified-Since")
+		w.Header().Set("Last-Modified", "Thu, 29 Mar 2018 08:20:30 GMT")
+		if since == "Thu, 29 Mar 2018 08:20:30 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("module aahframe.work/config.v1\n"))
+	})
+	get := func(ims string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/aahframe.work/config.v1/@v/v1.2.0.mod", nil)
+		req.Header.Set("If-Modified-Since", ims)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := get("Thu, 29 Mar 2018 08:20:30 GMT")
+	c.Assert(since, Equals, "Thu, 29 Mar 2018 08:20:30 GMT")
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), Equals, 0)
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, "Thu, 29 Mar 2018 08:20:30 GMT")
+
+	rec = get("Wed, 28 Mar 2018 08:20:30 GMT")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, "Thu, 29 Mar 2018 08:20:30 GMT")
+	c.Assert(rec.Body.String(), Equals, "module aahframe.work/config.v1\n")
+}
+
+func (s *ModuleSuite) TestModMissing(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@v/v1.0.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "module aahframe.work/config.v1\n")
+}
+
+func (s *ModuleSuite) TestModMismatch(c *C) {
+	rec := s.get("/aahframe.work/config.v1/@v/v1.10.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Body.String(), Equals, `The go.mod file of aahframe.work/config.v1 v1.10.0 is for module "github.com/go-aah/config"; it must read "module aahframe.work/config.v1".`)
+
+	rec = s.get("/aahframe.work/config.v1/@v/v1.4.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ModuleSuite) TestBackendToken(c *C) {
+	defer func(backends []Backend, tokens map[Backend]string) {
+		config().Backends, backendTokens = backends, tokens
+	}(config().Backends, backendTokens)
+	var refused []string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token mirror-secret" {
+			refused = append(refused, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+	config().Backends = []Backend{{Prefix: "go-aah/", BaseURL: backend.URL}}
+	backendTokens = map[Backend]string{config().Backends[0]: "mirror-secret"}
+
+	rec := s.get("/aahframe.work/config.v1/@v/v1.2.0.info")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(s.commitHits, Equals, 1)
+	rec = s.get("/aahframe.work/config.v1/@v/v1.2.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "module aahframe.work/config.v1\n\ngo 1.11\n")
+	c.Assert(refused, HasLen, 0)
+}
+
+func (s *ModuleSuite) TestPrivateRepo(c *C) {
+	defer func(token string, repos []string) {
+		githubToken, config().PrivateRepos = token, repos
+	}(githubToken, config().PrivateRepos)
+	var refused []string
+	private := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			refused = append(refused, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+	}))
+	defer private.Close()
+	config().BackendBaseURL = private.URL
+	githubToken = "secret"
+	config().PrivateRepos = []string{"go-aah/config"}
+
+	rec := s.get("/aahframe.work/config.v1/@v/v1.2.0.info")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	rec = s.get("/aahframe.work/config.v1/@v/v1.2.0.mod")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(refused, HasLen, 0)
+}
+
+func (s *ModuleSuite) TestAPINotFoundCached(c *C) {
+	var hits int
+	s.mux.HandleFunc("/api/v3/repos/go-aah/missing/", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		http.NotFound(w, r)
+	})
+	repo := &Repo{User: "go-aah", Name: "missing"}
+	for i := 0; i < 2; i++ {
+		var v struct{}
+		c.Assert(getAPI(context.Background(), repo, "/commits/master", &v), Equals, ErrNoRepo)
+	}
+	c.Assert(hits, Equals, 1)
+
+	// Nor are its refs asked for.
+	_, err := fetchRefs(context.Background(), repo)
+	c.Assert(err, Equals, ErrNoRepo)
+}
+
+func (s *ModuleSuite) TestModulePathMismatch(c *C) {
+	c.Assert(modulePathMismatch("aahframe.work/config.v1", "v1.0.0", ""), Equals,
+		`The go.mod file of aahframe.work/config.v1 v1.0.0 has no module directive; it must read "module aahframe.work/config.v1".`)
+	c.Assert(modulePathMismatch("aahframe.work/config.v2", "v2.0.0", "aahframe.work/config"), Equals,
+		`The go.mod file of aahframe.work/config.v2 v2.0.0 is for module "aahframe.work/config", differing in its major version suffix; it must read "module aahframe.work/config.v2".`)
+	c.Assert(modulePathMismatch("aahframe.work/config.v2", "v2.0.0", "aahframe.work/config/v2"), Equals,
+		`The go.mod file of aahframe.work/config.v2 v2.0.0 is for module "aahframe.work/config/v2"; it must read "module aahframe.work/config.v2".`)
+}
+
+func (s *ModuleSuite) TestSplitPathMajor(c *C) {
+	for _, t := range []struct{ path, base, major string }{
+		{"aahframe.work/config.v1", "aahframe.work/config", "v1"},
+		{"aahframe.work/config", "aahframe.work/config", ""},
+		{"github.com/go-aah/config/v2", "github.com/go-aah/config", "v2"},
+		{"gopkg.in/yaml.v3", "gopkg.in/yaml", "v3"},
+		{"aahframe.work/config.vx", "aahframe.work/config.vx", ""},
+		{"aahframe.work.v1/config", "aahframe.work.v1/config", ""},
+	} {
+		base, major := splitPathMajor(t.path)
+		c.Check(base, Equals, t.base, Commentf("%s", t.path))
+		c.Check(major, Equals, t.major, Commentf("%s", t.path))
+	}
+}
+
+func (s *ModuleSuite) TestZip(c *C) {
+	defer func(dir string) { config().ModuleCacheDir = dir }(config().ModuleCacheDir)
+	config().ModuleCacheDir = c.MkDir()
+	zipCached = &zipCache{}
+	file, err := zipCachePath("aahframe.work/config.v1", "v1.2.0")
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(file), 0755), IsNil)
+	c.Assert(os.WriteFile(file, []byte("PK zip"), 0644), IsNil)
+
+	rec := s.get("/aahframe.work/config.v1/@v/v1.2.0.zip")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, "application/zip")
+	c.Assert(rec.Body.String(), Equals, "PK zip")
+
+	rec = s.get("/aahframe.work/config.v1/@v/v1.4.0.zip")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+}
+
+func (s *ModuleSuite) TestZipRange(c *C) {
+	defer func(dir string) { config().ModuleCacheDir = dir }(config().ModuleCacheDir)
+	config().ModuleCacheDir = c.MkDir()
+	zipCached = &zipCache{}
+	file, err := zipCachePath("aahframe.work/config.v1", "v1.2.0")
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(file), 0755), IsNil)
+	c.Assert(os.WriteFile(file, []byte("PK zip contents"), 0644), IsNil)
+	// Built well before the requests, which land in other seconds.
+	built := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(file, built, built), IsNil)
+
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/aahframe.work/config.v1/@v/v1.2.0.zip", nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	rec := get("Range", "bytes=3-5")
+	c.Assert(rec.Code, Equals, http.StatusPartialContent)
+	c.Assert(rec.Header().Get("Content-Range"), Equals, "bytes 3-5/15")
+	c.Assert(rec.Body.String(), Equals, "zip")
+	lastModified := rec.Header().Get("Last-Modified")
+	c.Assert(lastModified, Equals, built.UTC().Format(http.TimeFormat))
+
+	// Serving the zip left its modification time alone.
+	info, err := os.Stat(file)
+	c.Assert(err, IsNil)
+	c.Assert(info.ModTime().Equal(built), Equals, true)
+
+	rec = get("Range", "bytes=7-", "If-Range", lastModified)
+	c.Assert(rec.Code, Equals, http.StatusPartialContent)
+	c.Assert(rec.Body.String(), Equals, "contents")
+	c.Assert(rec.Header().Get("Last-Modified"), Equals, lastModified)
+
+	rec = get("If-Modified-Since", lastModified)
+	c.Assert(rec.Code, Equals, http.StatusNotModified)
+
+	// The whole zip when it changed since.
+	rec = get("Range", "bytes=7-", "If-Range", "Mon, 02 Jan 2006 15:04:05 GMT")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "PK zip contents")
+
+	rec = get("Range", "bytes=100-")
+	c.Assert(rec.Code, Equals, http.StatusRequestedRangeNotSatisfiable)
+}
+
+func (s *ModuleSuite) TestDecode(c *C) {
+	path, err := decodeModulePath("aahframe.work/!go-!aah/config.v1")
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "aahframe.work/Go-Aah/config.v1")
+	_, err = decodeModulePath("aahframe.work/Go-Aah/config.v1")
+	c.Assert(err, ErrorMatches, `invalid module path "aahframe.work/Go-Aah/config.v1"`)
+
+	v, err := decodeVersion("v2.0.0+incompatible")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "v2.0.0+incompatible")
+	v, err = decodeVersion("v1.0.0-!r!c1+incompatible")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "v1.0.0-RC1+incompatible")
+	_, err = decodeVersion("v1.0.0-RC1")
+	c.Assert(err, ErrorMatches, `invalid module version "v1.0.0-RC1"`)
+}
+
+func (s *ModuleSuite) TestMixedCasePath(c *C) {
+	rec := s.get("/aahframe.work/!go-!aah/config.v1/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "v1.0.0\nv1.2.0\nv1.10.0\nv1.11.0-rc.1\n")
+
+	// Capitals must be encoded.
+	rec = s.get("/aahframe.work/Go-Aah/config.v1/@v/list")
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+	rec = s.get("/aahframe.work/config.v1/@v/v1.0.0-RC1.info")
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+
+	rec = s.get("/aahframe.work/config.v1/@v/v2.0.0+incompatible.info")
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+	c.Assert(rec.Body.String(), Equals, "Module aahframe.work/config.v1 has no version v2.0.0+incompatible.")
+}
+
+func (s *ModuleSuite) TestCacheHeaders(c *C) {
+	defer func(dir string) { config().ModuleCacheDir = dir }(config().ModuleCacheDir)
+	config().ModuleCacheDir = c.MkDir()
+	zipCached = &zipCache{}
+	file, err := zipCachePath("aahframe.work/config.v1", "v1.2.0")
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(filepath.Dir(file), 0755), IsNil)
+	c.Assert(os.WriteFile(file, []byte("PK zip"), 0644), IsNil)
+
+	tests := []struct{ path, cacheControl string }{
+		{"/aahframe.work/config.v1/@v/list", "public, max-age=60"},
+		{"/aahframe.work/config.v1/@latest", "public, max-age=60"},
+		{"/aahframe.work/config.v1/@v/v1.2.0.info", immutable},
+		{"/aahframe.work/config.v1/@v/v1.2.0.mod", immutable},
+		{"/aahframe.work/config.v1/@v/v1.2.0.zip", immutable},
+		// Failures aren't cached.
+		{"/aahframe.work/config.v1/@v/v1.4.0.zip", ""},
+		{"/aahframe.work/log.v1/@v/list", ""},
+	}
+	for _, t := range tests {
+		rec := s.get(t.path)
+		c.Assert(rec.Header().Get("Cache-Control"), Equals, t.cacheControl, Commentf("path %s", t.path))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+	"golang.org/x/sync/singleflight"
+)
+
+// zipBuildTimeout bounds the build of a module zip, from fetching the
+// repository to writing the zip.
+const zipBuildTimeout = 5 * time.Minute
+
+// zipFlight coalesces the concurrent builds of a same module zip.
+var zipFlight singleflight.Group
+
+// moduleZip returns the zip of the given version of the module at
+// modPath opened, found in repo at rev, the tag of version or the commit
+// of a pseudo-version, building it into the zip cache first unless cached
+// already. Concurrent calls for the same zip share a single build,
+// which carries on if the client that started it goes away.
+func moduleZip(ctx context.Context, repo *Repo, modPath, version, rev string) (*os.File, error) {
+	file, err := zipCachePath(modPath, version)
+	if err != nil {
+		return nil, err
+	}
+	f, hit := zipCached.open(file)
+	metrics.CacheLookup(cacheModuleZip, hit)
+	if hit {
+		return f, nil
+	}
+	_, err, _ = zipFlight.Do(file, func() (interface{}, error) {
+		if f, ok := zipCached.open(file); ok {
+			return nil, f.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), zipBuildTimeout)
+		defer cancel()
+		if err := buildModuleZip(ctx, repo, modPath, version, rev, file); err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		zipCached.add(file, info.Size())
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := zipCached.open(file); ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("zip of %s@%s evicted from the cache right after being built", modPath, version)
+}
+
+// zipCachePath returns where the zip of the module version is cached.
+// Paths and versions are escaped as in the module cache of the go
+// command, so that they stay apart on case-insensitive file systems.
+func zipCachePath(modPath, version string) (string, error) {
+	path, err := module.EscapePath(modPath)
+	if err != nil {
+		return "", err
+	}
+	v, err := module.EscapeVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config().ModuleCacheDir, path, "@v", v+".zip"), nil
+}
+
+// buildModuleZip gets the tree of repo at rev, a tag or commit hash, and
+// writes the zip of version of the module to file. The zip is laid out
+// under <module>@<version>/ and leaves out VCS directories, nested modules
+// and anything else the module zip format excludes. Public repositories
+// at github.com are fetched as a tarball, as told by archiveURL, others
+// are cloned.
+func buildModuleZip(ctx context.Context, repo *Repo, modPath, version, rev, file string) error {
+	dir, err := os.MkdirTemp("", "gopkg-zip-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if u, ok := archiveURL(repo, rev); ok {
+		err = fetchArchive(ctx, repo, version, u, src)
+	} else {
+		err = cloneRepo(ctx, repo, version, rev, src)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	// Written aside and renamed into place, so that a zip in the cache is
+	// always complete.
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = modzip.CreateFromDir(tmp, module.Version{Path: modPath, Version: version}, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot create zip of %s@%s: %v", modPath, version, err)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// cloneRepo clones repo at rev, the tag or commit of version, into src.
+func cloneRepo(ctx context.Context, repo *Repo, version, rev, src string) error {
+	var cmds [][]string
+	if isCommitHash(rev) {
+		// Commits have no ref to clone by, they are fetched alone.
+		cmds = [][]string{
+			{"init", "--quiet", src},
+			{"-C", src, "fetch", "--quiet", "--depth=1", repo.BackendRoot() + ".git", rev},
+			{"-C", src, "checkout", "--quiet", "FETCH_HEAD"},
+		}
+	} else {
+		cmds = [][]string{{"clone", "--quiet", "--depth=1", "--branch", rev, "--", repo.BackendRoot() + ".git", src}}
+	}
+	for _, args := range cmds {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Env = append(cmd.Env, gitAuthEnv(repo)...)
+		if proxy := config().UpstreamProxy; proxy != "" {
+			// In the environment rather than the arguments, where its
+			// password would show.
+			cmd.Env = append(cmd.Env, "https_proxy="+proxy, "http_proxy="+proxy, "no_proxy=", "NO_PROXY=")
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot clone %s at %s: %v: %s", repo.GitHubRoot(), version, err, out)
+		}
+	}
+	return nil
+}
+
+// gitAuthEnv returns the environment authorizing the git commands run
+// against repo with its token, if any, see repoToken. The header is
+// given as git configuration in the environment rather than in the URL or
+// the arguments, where the token would show.
+func gitAuthEnv(repo *Repo) []string {
+	token := repoToken(strings.TrimPrefix(repo.GitHubRoot(), "github.com/"))
+	if token == "" {
+		return nil
+	}
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: token " + token,
+	}
+}
+
+// isCommitHash reports whether rev is a full SHA-1 commit hash.
+func isCommitHash(rev string) bool {
+	if len(rev) != 40 {
+		return false
+	}
+	for _, c := range rev {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
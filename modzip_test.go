@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ZipSuite{})
+
+// ZipSuite builds module zips from a local repository standing for
+// GitHub.
+type ZipSuite struct {
+	repo    *Repo
+	restore func()
+}
+
+func (s *ZipSuite) SetUpTest(c *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		c.Skip("git not found")
+	}
+	base, cache := c.MkDir(), c.MkDir()
+	work := filepath.Join(c.MkDir(), "config")
+	files := map[string]string{
+		"go.mod":         "module aahframe.work/config.v1\n",
+		"config.go":      "package config\n",
+		"sub/sub.go":     "package sub\n",
+		"nested/go.mod":  "module aahframe.work/config.v1/nested\n",
+		"nested/nest.go": "package nested\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(work, name)
+		c.Assert(os.MkdirAll(filepath.Dir(name), 0755), IsNil)
+		c.Assert(os.WriteFile(name, []byte(data), 0644), IsNil)
+	}
+	git(c, work, "init", "-q")
+	git(c, work, "add", ".")
+	git(c, work, "commit", "-q", "-m", "Initial commit")
+	git(c, work, "tag", "v1.2.0")
+	git(c, base, "clone", "-q", "--bare", work, filepath.Join(base, "go-aah", "config.git"))
+
+	backend, dir := config().BackendBaseURL, config().ModuleCacheDir
+	s.restore = func() {
+		config().BackendBaseURL, config().ModuleCacheDir = backend, dir
+	}
+	config().BackendBaseURL = "file://" + base
+	config().ModuleCacheDir = cache
+	zipCached = &zipCache{}
+	s.repo = &Repo{User: "go-aah", Name: "config"}
+}
+
+func (s *ZipSuite) TearDownTest(c *C) {
+	if s.restore != nil {
+		s.restore()
+	}
+}
+
+func git(c *C, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=aah", "GIT_AUTHOR_EMAIL=aah@example.com",
+		"GIT_COMMITTER_NAME=aah", "GIT_COMMITTER_EMAIL=aah@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null")
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("git %v: %s", args, out))
+}
+
+func zipNames(c *C, file string) []string {
+	r, err := zip.OpenReader(file)
+	c.Assert(err, IsNil)
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ZipSuite) TestBuild(c *C) {
+	f, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+	c.Assert(err, IsNil)
+	defer f.Close()
+	file := f.Name()
+	c.Assert(file, Equals, filepath.Join(config().ModuleCacheDir, "aahframe.work", "config.v1", "@v", "v1.2.0.zip"))
+	c.Assert(zipNames(c, file), DeepEquals, []string{
+		"aahframe.work/config.v1@v1.2.0/config.go",
+		"aahframe.work/config.v1@v1.2.0/go.mod",
+		"aahframe.work/config.v1@v1.2.0/sub/sub.go",
+	})
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(file))
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+}
+
+func (s *ZipSuite) TestCached(c *C) {
+	f, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	// The repository is gone, the zip is served from the cache.
+	config().BackendBaseURL = "file://" + c.MkDir()
+	again, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+	c.Assert(err, IsNil)
+	defer again.Close()
+	c.Assert(again.Name(), Equals, f.Name())
+}
+
+func (s *ZipSuite) TestCacheMetrics(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	lookups := &cacheMetrics{}
+	metrics = lookups
+
+	for i := 0; i < 3; i++ {
+		f, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+		c.Assert(err, IsNil)
+		c.Assert(f.Close(), IsNil)
+	}
+	c.Assert(lookups.hits, Equals, 2)
+	c.Assert(lookups.misses, Equals, 1)
+}
+
+func (s *ZipSuite) TestConcurrent(c *C) {
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var f *os.File
+			f, errs[i] = moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.2.0", "v1.2.0")
+			if f != nil {
+				f.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *ZipSuite) TestBuildError(c *C) {
+	_, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", "v1.3.0", "v1.3.0")
+	c.Assert(err, ErrorMatches, "(?s)cannot clone github.com/go-aah/config at v1.3.0: .*")
+}
+
+func (s *ZipSuite) TestBuildCommit(c *C) {
+	out, err := exec.Command("git", "-C", filepath.Join(strings.TrimPrefix(config().BackendBaseURL, "file://"), "go-aah", "config.git"), "rev-parse", "v1.2.0").Output()
+	c.Assert(err, IsNil)
+	hash := strings.TrimSpace(string(out))
+	c.Assert(isCommitHash(hash), Equals, true)
+
+	version := "v1.0.0-20180329082030-" + hash[:12]
+	f, err := moduleZip(context.Background(), s.repo, "aahframe.work/config.v1", version, hash)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	c.Assert(zipNames(c, f.Name()), DeepEquals, []string{
+		"aahframe.work/config.v1@" + version + "/config.go",
+		"aahframe.work/config.v1@" + version + "/go.mod",
+		"aahframe.work/config.v1@" + version + "/sub/sub.go",
+	})
+}
+
+func (s *ZipSuite) TestCachePath(c *C) {
+	file, err := zipCachePath("aahframe.work/Config.v1", "v1.2.0-RC")
+	c.Assert(err, IsNil)
+	c.Assert(file, Equals, filepath.Join(config().ModuleCacheDir, "aahframe.work", "!config.v1", "@v", "v1.2.0-!r!c.zip"))
+}
+
+func (s *ZipSuite) TestGitAuthEnv(c *C) {
+	defer func(backends []Backend, tokens map[Backend]string, token string, repos []string) {
+		config().Backends, backendTokens, githubToken, config().PrivateRepos = backends, tokens, token, repos
+	}(config().Backends, backendTokens, githubToken, config().PrivateRepos)
+	config().Backends = []Backend{{Prefix: "corp/", BaseURL: "https://git.corp.example.com"}}
+	backendTokens = map[Backend]string{config().Backends[0]: "corp-token"}
+	githubToken = "secret"
+	config().PrivateRepos = []string{"go-aah/errors", "corp/tools"}
+
+	c.Assert(gitAuthEnv(&Repo{User: "go-aah", Name: "config"}), IsNil)
+	c.Assert(gitAuthEnv(&Repo{User: "go-aah", Name: "errors"}), DeepEquals, []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: token secret",
+	})
+	// Backends only ever get their own token.
+	c.Assert(gitAuthEnv(&Repo{User: "corp", Name: "tools"}), DeepEquals, []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: token corp-token",
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNotFoundEntries bounds the repositories remembered as missing, so
+// that a bot going through random paths can't grow the cache for good.
+const maxNotFoundEntries = 10000
+
+// notFoundCache remembers the repositories GitHub recently answered were
+// missing, for config.NotFoundCacheTTL, so that bots and typos asking for
+// them again and again don't each cost a GitHub lookup. Repositories are
+// keyed by their refs URL in lower case, as GitHub names are case
+// insensitive, whether found missing through them or through the API.
+type notFoundCache struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+
+	now func() time.Time
+}
+
+var notFoundCached = &notFoundCache{now: time.Now}
+
+// has reports whether the repository at url is known to be missing.
+func (nc *notFoundCache) has(url string) bool {
+	if config().NotFoundCacheTTL <= 0 {
+		return false
+	}
+	key := strings.ToLower(url)
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	expires, ok := nc.expires[key]
+	if ok && !nc.now().Before(expires) {
+		delete(nc.expires, key)
+		ok = false
+	}
+	metrics.CacheLookup(cacheNotFound, ok)
+	return ok
+}
+
+// put remembers the repository at url as missing. Once the cache is full,
+// entries are only added as others expire.
+func (nc *notFoundCache) put(url string) {
+	if config().NotFoundCacheTTL <= 0 {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.expires == nil {
+		nc.expires = make(map[string]time.Time)
+	}
+	now := nc.now()
+	if len(nc.expires) >= maxNotFoundEntries {
+		for key, expires := range nc.expires {
+			if !now.Before(expires) {
+				delete(nc.expires, key)
+			}
+		}
+		if len(nc.expires) >= maxNotFoundEntries {
+			return
+		}
+	}
+	nc.expires[strings.ToLower(url)] = now.Add(config().NotFoundCacheTTL)
+}
+
+// invalidate forgets the repository at url was missing, if so.
+func (nc *notFoundCache) invalidate(url string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.expires, strings.ToLower(url))
+}
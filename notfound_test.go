@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&NotFoundCacheSuite{})
+
+type NotFoundCacheSuite struct {
+	now time.Time
+	nc  *notFoundCache
+}
+
+func (s *NotFoundCacheSuite) SetUpTest(c *C) {
+	s.now = time.Date(2018, 3, 29, 0, 0, 0, 0, time.UTC)
+	s.nc = &notFoundCache{now: func() time.Time { return s.now }}
+}
+
+func (s *NotFoundCacheSuite) TestExpiry(c *C) {
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, false)
+	s.nc.put("https://github.com/go-aah/missing.git")
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, true)
+	c.Assert(s.nc.has("https://github.com/Go-Aah/Missing.git"), Equals, true)
+	c.Assert(s.nc.has("https://github.com/go-aah/config.git"), Equals, false)
+
+	s.now = s.now.Add(config().NotFoundCacheTTL)
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, false)
+	c.Assert(s.nc.expires, HasLen, 0)
+}
+
+func (s *NotFoundCacheSuite) TestInvalidate(c *C) {
+	s.nc.put("https://github.com/go-aah/missing.git")
+	s.nc.invalidate("https://github.com/Go-Aah/missing.git")
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, false)
+}
+
+func (s *NotFoundCacheSuite) TestFull(c *C) {
+	for i := 0; i < maxNotFoundEntries; i++ {
+		s.nc.put(fmt.Sprintf("https://github.com/bot/%d.git", i))
+	}
+	s.nc.put("https://github.com/go-aah/missing.git")
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, false)
+
+	// Room is made as entries expire.
+	s.now = s.now.Add(config().NotFoundCacheTTL)
+	s.nc.put("https://github.com/go-aah/missing.git")
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, true)
+	c.Assert(s.nc.expires, HasLen, 1)
+}
+
+func (s *NotFoundCacheSuite) TestDisabled(c *C) {
+	defer func(ttl time.Duration) { config().NotFoundCacheTTL = ttl }(config().NotFoundCacheTTL)
+	config().NotFoundCacheTTL = 0
+	s.nc.put("https://github.com/go-aah/missing.git")
+	c.Assert(s.nc.has("https://github.com/go-aah/missing.git"), Equals, false)
+}
+
+func (s *NotFoundCacheSuite) TestMetrics(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	lookups := &cacheMetrics{}
+	metrics = lookups
+
+	s.nc.has("https://github.com/go-aah/missing.git")
+	s.nc.put("https://github.com/go-aah/missing.git")
+	s.nc.has("https://github.com/go-aah/missing.git")
+	c.Assert(lookups.hits, Equals, 1)
+	c.Assert(lookups.misses, Equals, 1)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -324,6 +323,6 @@ func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *Repo)
 
 	err := packageTemplate.Execute(resp, data)
 	if err != nil {
-		log.Printf("error executing package page template: %v", err)
+		logger.ErrorContext(req.Context(), "cannot execute package page template", "repo", repo.GitHubRoot(), "err", err)
 	}
 }
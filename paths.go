@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cleanRepoPath returns path with runs of slashes collapsed and trailing
+// slashes trimmed, so that /config.v1/ and //go-aah//config.v1 are served
+// as /config.v1 and /go-aah/config.v1. Case is kept: import paths are case
+// sensitive for the go tool, even though GitHub names aren't, so the
+// repository lookups compare them case-insensitively instead.
+func cleanRepoPath(path string) string {
+	if !strings.Contains(path, "//") && (len(path) <= 1 || !strings.HasSuffix(path, "/")) {
+		return path
+	}
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && b.Len() > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	clean := strings.TrimRight(b.String(), "/")
+	if clean == "" {
+		return "/"
+	}
+	return clean
+}
+
+// withCleanPath wraps h so that requests for paths that aren't clean, as
+// cleanRepoPath has them, are served as if for the clean path. Browsers
+// are redirected there instead, query included, so that only canonical
+// URLs get bookmarked and indexed. It also keeps http.ServeMux from
+// redirecting go get and git, which it would for duplicate slashes.
+func withCleanPath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clean := cleanRepoPath(r.URL.Path)
+		if clean == r.URL.Path {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if isBrowser(r) {
+			u := *r.URL
+			u.Path, u.RawPath = clean, ""
+			w.Header().Set("Location", u.RequestURI())
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = clean, ""
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PathSuite{})
+
+type PathSuite struct{}
+
+var cleanPathTests = []struct{ path, clean string }{
+	{"/", "/"},
+	{"//", "/"},
+	{"/config.v1", "/config.v1"},
+	{"/config.v1/", "/config.v1"},
+	{"/config.v1///", "/config.v1"},
+	{"//config.v1", "/config.v1"},
+	{"/go-aah//config.v1", "/go-aah/config.v1"},
+	{"/go-aah/config.v1//sub//pkg/", "/go-aah/config.v1/sub/pkg"},
+	{"/Go-Aah/Config.v1/", "/Go-Aah/Config.v1"},
+	{"/aahframe.work/config.v1/@v/list", "/aahframe.work/config.v1/@v/list"},
+}
+
+func (s *PathSuite) TestCleanRepoPath(c *C) {
+	for _, t := range cleanPathTests {
+		c.Check(cleanRepoPath(t.path), Equals, t.clean, Commentf("path %q", t.path))
+	}
+}
+
+func (s *PathSuite) TestWithCleanPath(c *C) {
+	var served string
+	h := withCleanPath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.RequestURI()
+	}))
+
+	req := httptest.NewRequest("GET", "/config.v1//sub/?go-get=1", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(served, Equals, "/config.v1/sub?go-get=1")
+	c.Assert(req.URL.Path, Equals, "/config.v1//sub/")
+
+	// Browsers are sent to the clean path.
+	served = ""
+	req = httptest.NewRequest("GET", "/config.v1//sub/?tab=doc", nil)
+	req.Header.Set("Accept", "text/html")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusMovedPermanently)
+	c.Assert(rec.Header().Get("Location"), Equals, "/config.v1/sub?tab=doc")
+	c.Assert(served, Equals, "")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// githubToken is the GitHub token private repositories are fetched with,
+// as loaded by loadGitHubToken. It must never be logged.
+var githubToken string
+
+// loadGitHubToken returns the GitHub token read from cfg.GitHubTokenFile,
+// or else from the GITHUB_TOKEN environment variable. It fails when
+// cfg.PrivateRepos is set but no token is found.
+func loadGitHubToken(cfg *Config) (string, error) {
+	token := os.Getenv("GITHUB_TOKEN")
+	if cfg.GitHubTokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.GitHubTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read GitHub token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" && len(cfg.PrivateRepos) > 0 {
+		return "", fmt.Errorf("private repositories need a GitHub token in GITHUB_TOKEN or GitHubTokenFile")
+	}
+	return token, nil
+}
+
+// setRepoToken sets h, the headers of a request to target, to authorize
+// it with githubToken when target is within a repository listed in
+// config.PrivateRepos, or with the token of its backend for those of
+// config.Backends. Tokens are only ever sent to their backend host, over
+// https.
+func setRepoToken(h http.Header, target string) {
+	if setBackendToken(h, target) || githubToken == "" || !isPrivateRepo(target) {
+		return
+	}
+	h.Set("Authorization", "token "+githubToken)
+}
+
+// isPrivateRepo reports whether target is a URL within one of the
+// repositories in config.PrivateRepos at config.BackendBaseURL.
+func isPrivateRepo(target string) bool {
+	repo, ok := targetRepo(target, config().BackendBaseURL)
+	return ok && isPrivate(repo)
+}
+
+// isPrivate reports whether the "user/name" repository is listed in
+// config.PrivateRepos.
+func isPrivate(repo string) bool {
+	for _, r := range config().PrivateRepos {
+		if strings.EqualFold(r, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoToken returns the token the requests for the "user/name"
+// repository are authorized with, as setRepoToken does for those of the
+// git proxy: that of its backend for those of config.Backends, or else
+// githubToken if it is private.
+func repoToken(repo string) string {
+	if backendFor(repo) != nil {
+		return backendToken(repo)
+	}
+	if isPrivate(repo) {
+		return githubToken
+	}
+	return ""
+}
+
+// targetRepo returns the "user/name" repository target is a URL within at
+// the backend with the given base URL, if any.
+func targetRepo(target, baseURL string) (string, bool) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "https" || u.User != nil || !strings.EqualFold(u.Host, base.Host) {
+		return "", false
+	}
+	path, ok := strings.CutPrefix(u.Path, strings.TrimSuffix(base.Path, "/")+"/")
+	if !ok {
+		return "", false
+	}
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 2 {
+		return "", false
+	}
+	return parts[0] + "/" + strings.TrimSuffix(parts[1], ".git"), true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PrivateSuite{})
+
+type PrivateSuite struct{}
+
+var privateRepoTests = []struct {
+	target string
+	ok     bool
+}{
+	{"https://github.com/go-aah/internal.git/info/refs?service=git-upload-pack", true},
+	{"https://github.com/go-aah/internal/git-upload-pack", true},
+	{"https://GitHub.com/Go-Aah/Internal/git-upload-pack", true},
+	{"https://github.com/go-aah/config/git-upload-pack", false},
+	{"https://github.com/go-aah/internal-fork/git-upload-pack", false},
+	{"https://github.com/go-aah", false},
+	{"http://github.com/go-aah/internal/git-upload-pack", false},
+	{"https://evil.com/go-aah/internal/git-upload-pack", false},
+	{"https://x@github.com/go-aah/internal/git-upload-pack", false},
+	{"https://github.com.evil.com/go-aah/internal/git-upload-pack", false},
+}
+
+func (s *PrivateSuite) TestIsPrivateRepo(c *C) {
+	defer func(repos []string) { config().PrivateRepos = repos }(config().PrivateRepos)
+	config().PrivateRepos = []string{"go-aah/internal"}
+
+	for _, t := range privateRepoTests {
+		c.Check(isPrivateRepo(t.target), Equals, t.ok, Commentf("target %s", t.target))
+	}
+}
+
+func (s *PrivateSuite) TestIsPrivateRepoBasePath(c *C) {
+	defer func(base string, repos []string) {
+		config().BackendBaseURL, config().PrivateRepos = base, repos
+	}(config().BackendBaseURL, config().PrivateRepos)
+	config().BackendBaseURL = "https://ghe.example.com/github/"
+	config().PrivateRepos = []string{"go-aah/internal"}
+
+	c.Assert(isPrivateRepo("https://ghe.example.com/github/go-aah/internal/git-upload-pack"), Equals, true)
+	c.Assert(isPrivateRepo("https://ghe.example.com/go-aah/internal/git-upload-pack"), Equals, false)
+}
+
+func (s *PrivateSuite) TestLoadGitHubToken(c *C) {
+	defer os.Setenv("GITHUB_TOKEN", os.Getenv("GITHUB_TOKEN"))
+	os.Setenv("GITHUB_TOKEN", "")
+
+	cfg := newConfig()
+	token, err := loadGitHubToken(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "")
+
+	cfg.PrivateRepos = []string{"go-aah/internal"}
+	_, err = loadGitHubToken(cfg)
+	c.Assert(err, ErrorMatches, "private repositories need a GitHub token in GITHUB_TOKEN or GitHubTokenFile")
+
+	os.Setenv("GITHUB_TOKEN", "from-env")
+	token, err = loadGitHubToken(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "from-env")
+
+	cfg.GitHubTokenFile = filepath.Join(c.MkDir(), "token")
+	_, err = loadGitHubToken(cfg)
+	c.Assert(err, ErrorMatches, "cannot read GitHub token: .*")
+	c.Assert(os.WriteFile(cfg.GitHubTokenFile, []byte("from-file\n"), 0600), IsNil)
+	token, err = loadGitHubToken(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "from-file")
+}
+
+func (s *HandlerSuite) TestPrivateRepoToken(c *C) {
+	defer func(token string, repos []string) {
+		githubToken, config().PrivateRepos = token, repos
+	}(githubToken, config().PrivateRepos)
+	githubToken = "secret"
+	config().PrivateRepos = []string{"go-aah/config"}
+
+	var auth []string
+	s.mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+	s.mux.HandleFunc("/go-aah/errors.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+	s.mux.HandleFunc("/go-aah/errors/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+
+	rec := s.serve("POST", "/config.v1/git-upload-pack", "0000")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	rec = s.serve("POST", "/errors.v1/git-upload-pack", "0000")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(auth, DeepEquals, []string{"token secret", "", ""})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// promMetrics exposes the proxy measurements to Prometheus. Metrics are
+// labelled by git service only, never by repository, to keep their
+// cardinality bounded; the per-repository in-flight gauge is labelled by
+// the config.RepoConcurrency pattern instead.
+type promMetrics struct {
+	requests      *prometheus.CounterVec
+	inFlight      *prometheus.GaugeVec
+	bytes         *prometheus.CounterVec
+	backendErrors *prometheus.CounterVec
+	responses     *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	cacheLookups  *prometheus.CounterVec
+	cacheSize     *prometheus.GaugeVec
+	evictions     *prometheus.CounterVec
+	panics        prometheus.Counter
+	rateLimit     *prometheus.GaugeVec
+	pseudo        prometheus.Counter
+	repoInFlight  *prometheus.GaugeVec
+}
+
+// newPromMetrics returns Metrics registered with reg.
+func newPromMetrics(reg prometheus.Registerer) *promMetrics {
+	m := &promMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_proxy_requests_total",
+			Help: "Requests proxied to GitHub.",
+		}, []string{"service"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gopkg_proxy_requests_in_flight",
+			Help: "Requests being proxied to GitHub.",
+		}, []string{"service"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_proxy_response_bytes_total",
+			Help: "Response body bytes proxied from GitHub to clients.",
+		}, []string{"service"}),
+		backendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_proxy_backend_errors_total",
+			Help: "Proxied requests GitHub answered with 4xx or 5xx, or failed to answer (class error).",
+		}, []string{"service", "class"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_proxy_backend_responses_total",
+			Help: "Proxied requests by class of GitHub's response, 2xx to 5xx, or error when none came.",
+		}, []string{"service", "class"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gopkg_proxy_request_duration_seconds",
+			Help: "Time taken by proxied requests, response body included.",
+			// From 50ms up to about 7 minutes, for large clones.
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+		}, []string{"service"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_cache_lookups_total",
+			Help: "Cache lookups, by cache and result (hit or miss).",
+		}, []string{"cache", "result"}),
+		cacheSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gopkg_cache_size_bytes",
+			Help: "Bytes held on disk, by cache.",
+		}, []string{"cache"}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopkg_cache_evictions_total",
+			Help: "Entries evicted to make room, by cache.",
+		}, []string{"cache"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gopkg_panics_total",
+			Help: "Requests whose handling panicked.",
+		}),
+		rateLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gopkg_github_rate_limit_remaining",
+			Help: "Requests left in GitHub's rate limit, by resource, as of its last response.",
+		}, []string{"resource"}),
+		pseudo: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gopkg_module_pseudo_versions_total",
+			Help: "Pseudo-versions given by @latest for modules without tags.",
+		}),
+		repoInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gopkg_proxy_repo_requests_in_flight",
+			Help: "Requests being proxied to GitHub for the repositories with a concurrency limit, by pattern.",
+		}, []string{"pattern"}),
+	}
+	reg.MustRegister(m.requests, m.inFlight, m.bytes, m.backendErrors, m.responses, m.duration, m.cacheLookups, m.cacheSize, m.evictions, m.panics, m.rateLimit, m.pseudo, m.repoInFlight)
+	return m
+}
+
+func (m *promMetrics) ProxyStarted(service string) {
+	m.inFlight.WithLabelValues(service).Inc()
+}
+
+func (m *promMetrics) ProxyDone(s ProxyStats) {
+	m.inFlight.WithLabelValues(s.Service).Dec()
+	m.requests.WithLabelValues(s.Service).Inc()
+	m.bytes.WithLabelValues(s.Service).Add(float64(s.Bytes))
+	m.duration.WithLabelValues(s.Service).Observe(s.Duration.Seconds())
+	class := statusClass(s.Status)
+	m.responses.WithLabelValues(s.Service, class).Inc()
+	if class != "2xx" && class != "3xx" {
+		m.backendErrors.WithLabelValues(s.Service, class).Inc()
+	}
+}
+
+func (m *promMetrics) CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func (m *promMetrics) CacheSize(cache string, bytes int64) {
+	m.cacheSize.WithLabelValues(cache).Set(float64(bytes))
+}
+
+func (m *promMetrics) CacheEvicted(cache string, n int) {
+	m.evictions.WithLabelValues(cache).Add(float64(n))
+}
+
+func (m *promMetrics) Panicked() {
+	m.panics.Inc()
+}
+
+func (m *promMetrics) RateLimitRemaining(resource string, remaining int) {
+	m.rateLimit.WithLabelValues(resource).Set(float64(remaining))
+}
+
+func (m *promMetrics) PseudoVersion() {
+	m.pseudo.Inc()
+}
+
+func (m *promMetrics) RepoInFlight(pattern string, n int) {
+	m.repoInFlight.WithLabelValues(pattern).Set(float64(n))
+}
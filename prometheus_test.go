@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PromSuite{})
+
+type PromSuite struct{}
+
+func (s *PromSuite) TestProxyDone(c *C) {
+	m := newPromMetrics(prometheus.NewRegistry())
+
+	m.ProxyStarted(serviceUploadPack)
+	m.ProxyStarted(serviceUploadPack)
+	c.Assert(testutil.ToFloat64(m.inFlight.WithLabelValues(serviceUploadPack)), Equals, 2.0)
+
+	m.ProxyDone(ProxyStats{Service: serviceUploadPack, Status: http.StatusOK, Bytes: 100, Duration: time.Second})
+	m.ProxyDone(ProxyStats{Service: serviceUploadPack, Status: http.StatusBadGateway, Bytes: 10, Duration: time.Second})
+	m.ProxyStarted(serviceInfoRefs)
+	m.ProxyDone(ProxyStats{Service: serviceInfoRefs, Status: 0})
+
+	c.Assert(testutil.ToFloat64(m.inFlight.WithLabelValues(serviceUploadPack)), Equals, 0.0)
+	c.Assert(testutil.ToFloat64(m.requests.WithLabelValues(serviceUploadPack)), Equals, 2.0)
+	c.Assert(testutil.ToFloat64(m.bytes.WithLabelValues(serviceUploadPack)), Equals, 110.0)
+	c.Assert(testutil.ToFloat64(m.backendErrors.WithLabelValues(serviceUploadPack, "5xx")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(m.backendErrors.WithLabelValues(serviceInfoRefs, "error")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(m.responses.WithLabelValues(serviceUploadPack, "2xx")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(m.responses.WithLabelValues(serviceUploadPack, "5xx")), Equals, 1.0)
+	c.Assert(testutil.ToFloat64(m.responses.WithLabelValues(serviceInfoRefs, "error")), Equals, 1.0)
+	c.Assert(testutil.CollectAndCount(m.duration), Equals, 2)
+}
+
+func (s *PromSuite) TestStatusClass(c *C) {
+	c.Assert(statusClass(200), Equals, "2xx")
+	c.Assert(statusClass(304), Equals, "3xx")
+	c.Assert(statusClass(404), Equals, "4xx")
+	c.Assert(statusClass(503), Equals, "5xx")
+	c.Assert(statusClass(0), Equals, "error")
+}
+
+func (s *PromSuite) TestCacheLookup(c *C) {
+	m := newPromMetrics(prometheus.NewRegistry())
+	m.CacheLookup(cacheModuleZip, true)
+	m.CacheLookup(cacheModuleZip, true)
+	m.CacheLookup(cacheModuleZip, false)
+	c.Assert(testutil.ToFloat64(m.cacheLookups.WithLabelValues(cacheModuleZip, "hit")), Equals, 2.0)
+	c.Assert(testutil.ToFloat64(m.cacheLookups.WithLabelValues(cacheModuleZip, "miss")), Equals, 1.0)
+}
+
+func (s *PromSuite) TestCacheSize(c *C) {
+	m := newPromMetrics(prometheus.NewRegistry())
+	m.CacheSize(cacheModuleZip, 300)
+	m.CacheSize(cacheModuleZip, 200)
+	m.CacheEvicted(cacheModuleZip, 2)
+	m.CacheEvicted(cacheModuleZip, 1)
+	c.Assert(testutil.ToFloat64(m.cacheSize.WithLabelValues(cacheModuleZip)), Equals, 200.0)
+	c.Assert(testutil.ToFloat64(m.evictions.WithLabelValues(cacheModuleZip)), Equals, 3.0)
+}
+
+func (s *PromSuite) TestPanicked(c *C) {
+	m := newPromMetrics(prometheus.NewRegistry())
+	m.Panicked()
+	c.Assert(testutil.ToFloat64(m.panics), Equals, 1.0)
+}
+
+func (s *PromSuite) TestRateLimitRemaining(c *C) {
+	m := newPromMetrics(prometheus.NewRegistry())
+	m.RateLimitRemaining("core", 4999)
+	m.RateLimitRemaining("core", 4998)
+	c.Assert(testutil.ToFloat64(m.rateLimit.WithLabelValues("core")), Equals, 4998.0)
+}
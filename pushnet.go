@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// requirePushNetwork replies 403 when pushes are only accepted from
+// config.PushNetworks and r comes from outside them, and reports whether
+// the push may go on.
+func requirePushNetwork(w http.ResponseWriter, r *http.Request) bool {
+	if len(config().PushNetworks) == 0 {
+		return true
+	}
+	if ip := clientIP(r); !inNetworks(ip, config().PushNetworks) {
+		logger.WarnContext(r.Context(), "push refused from outside the push networks", "ip", ip, "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("Pushes are not accepted from your network."))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PushNetSuite{})
+
+type PushNetSuite struct{}
+
+func (s *PushNetSuite) TearDownTest(c *C) {
+	config().PushNetworks, config().TrustedHops = nil, 0
+}
+
+func (s *PushNetSuite) TestRequirePushNetwork(c *C) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+	var log bytes.Buffer
+	logger = slog.New(slog.NewTextHandler(&log, nil))
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", nil)
+	req.RemoteAddr = "192.0.2.1:41234"
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, true)
+
+	config().PushNetworks = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	rec := httptest.NewRecorder()
+	c.Assert(requirePushNetwork(rec, req), Equals, false)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(rec.Body.String(), Equals, "Pushes are not accepted from your network.")
+	c.Assert(log.String(), Matches, `(?s).*msg="push refused from outside the push networks" ip=192.0.2.1 path=/config.v1/git-receive-pack.*`)
+
+	req.RemoteAddr = "10.1.2.3:41234"
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, true)
+	req.RemoteAddr = "[2001:db8::1]:41234"
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, true)
+
+	// Made up X-Forwarded-For entries aren't trusted.
+	req.RemoteAddr = "192.0.2.1:41234"
+	req.Header.Set("X-Forwarded-For", "10.9.9.9")
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, false)
+
+	// Behind a load balancer, the IP it forwards for counts.
+	config().TrustedHops = 1
+	req.RemoteAddr = "10.0.0.1:41234"
+	req.Header.Set("X-Forwarded-For", "10.9.9.9, 192.0.2.7")
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, false)
+	req.Header.Set("X-Forwarded-For", "192.0.2.7, 10.9.9.9")
+	c.Assert(requirePushNetwork(httptest.NewRecorder(), req), Equals, true)
+}
+
+func (s *PushNetSuite) TestReceivePackRefused(c *C) {
+	config().PushNetworks = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("push forwarded to GitHub")
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-receive-pack", strings.NewReader("0000"))
+	req.Header.Set("Authorization", "Basic dXNlcjp0b2tlbg==")
+	rec := httptest.NewRecorder()
+	proxyGitReceivePack(rec, req, backend.URL+"/go-aah/config/git-receive-pack")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+}
+
+func (s *HandlerSuite) TestPushNetworksFetchOpen(c *C) {
+	defer func() { config().PushNetworks = nil }()
+	config().PushNetworks = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	rec := s.serve("GET", "/config.v1.git/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	rec = s.serve("GET", "/config.v1.git/info/refs?service=git-receive-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit is GitHub's rate limit as reported in the X-RateLimit-*
+// headers of its responses, for one of its resources (core, search...).
+type rateLimit struct {
+	Resource  string
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// parseRateLimit parses the rate limit headers of a GitHub response, and
+// reports whether they were there. The resource defaults to core, which
+// is what responses without X-RateLimit-Resource count against.
+func parseRateLimit(h http.Header) (rateLimit, bool) {
+	limit, err1 := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return rateLimit{}, false
+	}
+	rl := rateLimit{
+		Resource:  h.Get("X-RateLimit-Resource"),
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	if rl.Resource == "" {
+		rl.Resource = "core"
+	}
+	return rl, true
+}
+
+// githubQuota watches the rate limit GitHub reports, warning once per
+// rate limit window when the remaining requests of a resource drop below
+// config.GitHubQuotaWarn, before GitHub starts answering 429.
+type githubQuota struct {
+	mu     sync.Mutex
+	warned map[string]time.Time // reset of the last window warned about, by resource
+}
+
+var quota = &githubQuota{}
+
+// observe takes note of the rate limit in the GitHub response to req.
+func (q *githubQuota) observe(req *http.Request, res *http.Response) {
+	rl, ok := parseRateLimit(res.Header)
+	if !ok {
+		return
+	}
+	metrics.RateLimitRemaining(rl.Resource, rl.Remaining)
+	if rl.Remaining >= config().GitHubQuotaWarn {
+		return
+	}
+	q.mu.Lock()
+	if q.warned == nil {
+		q.warned = make(map[string]time.Time)
+	}
+	seen := q.warned[rl.Resource].Equal(rl.Reset)
+	q.warned[rl.Resource] = rl.Reset
+	q.mu.Unlock()
+	if !seen {
+		logger.WarnContext(req.Context(), "GitHub rate limit nearly exhausted", "resource", rl.Resource,
+			"limit", rl.Limit, "remaining", rl.Remaining, "reset", rl.Reset.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&QuotaSuite{})
+
+type QuotaSuite struct {
+	log     bytes.Buffer
+	metrics *quotaMetrics
+	restore func()
+}
+
+// quotaMetrics records the last remaining requests reported, by resource.
+type quotaMetrics struct {
+	nopMetrics
+	remaining map[string]int
+}
+
+func (m *quotaMetrics) RateLimitRemaining(resource string, remaining int) {
+	m.remaining[resource] = remaining
+}
+
+func (s *QuotaSuite) SetUpTest(c *C) {
+	l, m, q := logger, metrics, quota
+	s.restore = func() { logger, metrics, quota = l, m, q }
+	s.log.Reset()
+	logger = slog.New(slog.NewTextHandler(&s.log, nil))
+	s.metrics = &quotaMetrics{remaining: make(map[string]int)}
+	metrics = s.metrics
+	quota = &githubQuota{}
+}
+
+func (s *QuotaSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func rateLimitResponse(resource, remaining, reset string) *http.Response {
+	h := http.Header{}
+	h.Set("X-RateLimit-Limit", "5000")
+	h.Set("X-RateLimit-Remaining", remaining)
+	h.Set("X-RateLimit-Reset", reset)
+	if resource != "" {
+		h.Set("X-RateLimit-Resource", resource)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: h}
+}
+
+func (s *QuotaSuite) TestParseRateLimit(c *C) {
+	rl, ok := parseRateLimit(rateLimitResponse("", "4999", "1522317600").Header)
+	c.Assert(ok, Equals, true)
+	c.Assert(rl, DeepEquals, rateLimit{"core", 5000, 4999, time.Unix(1522317600, 0)})
+
+	rl, ok = parseRateLimit(rateLimitResponse("search", "29", "1522317600").Header)
+	c.Assert(ok, Equals, true)
+	c.Assert(rl.Resource, Equals, "search")
+
+	for _, h := range []http.Header{
+		{},
+		rateLimitResponse("", "", "1522317600").Header,
+		rateLimitResponse("", "10", "soon").Header,
+	} {
+		_, ok = parseRateLimit(h)
+		c.Check(ok, Equals, false, Commentf("headers %v", h))
+	}
+}
+
+func (s *QuotaSuite) TestObserve(c *C) {
+	req := httptest.NewRequest("GET", "/go-aah/config.git/info/refs", nil)
+
+	quota.observe(req, rateLimitResponse("", "4000", "1522317600"))
+	c.Assert(s.metrics.remaining["core"], Equals, 4000)
+	c.Assert(s.log.String(), Equals, "")
+
+	// Warned about once per window.
+	quota.observe(req, rateLimitResponse("", "99", "1522317600"))
+	quota.observe(req, rateLimitResponse("", "98", "1522317600"))
+	c.Assert(s.metrics.remaining["core"], Equals, 98)
+	c.Assert(strings.Count(s.log.String(), "GitHub rate limit nearly exhausted"), Equals, 1)
+	c.Assert(s.log.String(), Matches, `time=\S+ level=WARN msg="GitHub rate limit nearly exhausted" resource=core limit=5000 remaining=99 reset=2018-03-29T10:00:00Z\n`)
+
+	quota.observe(req, rateLimitResponse("", "50", "1522321200"))
+	quota.observe(req, rateLimitResponse("search", "5", "1522317600"))
+	c.Assert(s.metrics.remaining["search"], Equals, 5)
+	c.Assert(strings.Count(s.log.String(), "GitHub rate limit nearly exhausted"), Equals, 3)
+
+	// No rate limit headers.
+	quota.observe(req, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}})
+	c.Assert(strings.Count(s.log.String(), "\n"), Equals, 3)
+}
+
+func (s *QuotaSuite) TestObserveDisabled(c *C) {
+	defer func(n int) { config().GitHubQuotaWarn = n }(config().GitHubQuotaWarn)
+	config().GitHubQuotaWarn = 0
+	req := httptest.NewRequest("GET", "/go-aah/config.git/info/refs", nil)
+	quota.observe(req, rateLimitResponse("", "3", "1522317600"))
+	c.Assert(s.metrics.remaining["core"], Equals, 3)
+	c.Assert(s.log.String(), Equals, "")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter throttles clients, identified by their IP address, with a
+// token bucket each: a bucket holds up to config.RateBurst tokens, refills
+// at config.RateLimit tokens per second and every request takes one.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &rateLimiter{now: time.Now}
+
+// rateSweepInterval is how often buckets of clients gone quiet are
+// dropped, so that the limiter doesn't grow with every IP ever seen.
+const rateSweepInterval = time.Minute
+
+// allow reports whether a request from ip may go ahead and, if not, how
+// long until it would.
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	// One snapshot throughout, so that a reload can't zero the rate
+	// midway.
+	cfg := config()
+	if cfg.RateLimit <= 0 || inNetworks(ip, cfg.RateLimitExempt) {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	rate, burst := cfg.RateLimit, float64(cfg.RateBurst)
+	if now.Sub(l.lastSweep) >= rateSweepInterval {
+		l.sweep(now, rate, burst)
+		l.lastSweep = now
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that would be full again by now, as they
+// behave the same as no bucket at all.
+func (l *rateLimiter) sweep(now time.Time, rate, burst float64) {
+	for ip, b := range l.buckets {
+		b.refill(now, rate, burst)
+		if b.tokens >= burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// refill adds the tokens earned since b was last refilled, at rate per
+// second, up to burst.
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+}
+
+// inNetworks reports whether ip is in one of networks.
+func inNetworks(ip string, networks []netip.Prefix) bool {
+	if len(networks) == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range networks {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRate reports whether the client of req, a proxied request, is
+// within its rate limit, replying 429 otherwise.
+func allowRate(resp http.ResponseWriter, req *http.Request) bool {
+	ok, wait := limiter.allow(clientIP(req))
+	if !ok {
+		sendRateLimited(resp, wait)
+	}
+	return ok
+}
+
+// isProxiedPath reports whether subPath, the path within a repository,
+// is that of a request proxied to GitHub, which is rate limited, rather
+// than of the go get page.
+func isProxiedPath(subPath string) bool {
+	switch subPath {
+	case "/git-upload-pack", "/git-receive-pack", "/info/refs":
+		return true
+	}
+	return isDumbPath(subPath)
+}
+
+// sendRateLimited replies 429 to a client over its rate limit.
+func sendRateLimited(resp http.ResponseWriter, wait time.Duration) {
+	secs := int((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(secs))
+	resp.WriteHeader(http.StatusTooManyRequests)
+	_, _ = resp.Write([]byte("Too many requests, slow down."))
+}
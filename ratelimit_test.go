@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RateLimitSuite{})
+
+type RateLimitSuite struct {
+	now time.Time
+	l   *rateLimiter
+	cfg Config
+}
+
+func (s *RateLimitSuite) SetUpTest(c *C) {
+	s.cfg = *config()
+	config().RateLimit = 2
+	config().RateBurst = 3
+	s.now = time.Date(2018, 3, 29, 0, 0, 0, 0, time.UTC)
+	s.l = &rateLimiter{now: func() time.Time { return s.now }}
+}
+
+func (s *RateLimitSuite) TearDownTest(c *C) {
+	*config() = s.cfg
+}
+
+func (s *RateLimitSuite) TestBurst(c *C) {
+	for i := 0; i < 3; i++ {
+		ok, _ := s.l.allow("192.0.2.7")
+		c.Assert(ok, Equals, true)
+	}
+	ok, wait := s.l.allow("192.0.2.7")
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, 500*time.Millisecond)
+
+	// Other clients have buckets of their own.
+	ok, _ = s.l.allow("192.0.2.8")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RateLimitSuite) TestRefill(c *C) {
+	for i := 0; i < 3; i++ {
+		s.l.allow("192.0.2.7")
+	}
+	s.now = s.now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		ok, _ := s.l.allow("192.0.2.7")
+		c.Assert(ok, Equals, true)
+	}
+	ok, _ := s.l.allow("192.0.2.7")
+	c.Assert(ok, Equals, false)
+
+	// Buckets never hold more than the burst.
+	s.now = s.now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := s.l.allow("192.0.2.7")
+		c.Assert(ok, Equals, true)
+	}
+	ok, _ = s.l.allow("192.0.2.7")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RateLimitSuite) TestSweep(c *C) {
+	s.l.allow("192.0.2.7")
+	s.l.allow("192.0.2.8")
+	c.Assert(s.l.buckets, HasLen, 2)
+	s.now = s.now.Add(rateSweepInterval)
+	s.l.allow("192.0.2.9")
+	c.Assert(s.l.buckets, HasLen, 1)
+}
+
+func (s *RateLimitSuite) TestDisabled(c *C) {
+	config().RateLimit = 0
+	for i := 0; i < 10; i++ {
+		ok, _ := s.l.allow("192.0.2.7")
+		c.Assert(ok, Equals, true)
+	}
+	c.Assert(s.l.buckets, HasLen, 0)
+}
+
+func (s *RateLimitSuite) TestExempt(c *C) {
+	config().RateLimitExempt = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	for _, ip := range []string{"10.1.2.3", "::ffff:10.1.2.3", "2001:db8::1"} {
+		for i := 0; i < 10; i++ {
+			ok, _ := s.l.allow(ip)
+			c.Assert(ok, Equals, true, Commentf("ip %s", ip))
+		}
+	}
+	for i := 0; i < 3; i++ {
+		s.l.allow("192.0.2.7")
+	}
+	ok, _ := s.l.allow("192.0.2.7")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RateLimitSuite) TestHandler(c *C) {
+	defer func(l *rateLimiter) { limiter = l }(limiter)
+	limiter = s.l
+
+	serve := func(path, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "192.0.2.1:41234"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	// Refused before reaching GitHub, for the minor version.
+	const refs = "/config.v1.2/info/refs?service=git-upload-pack"
+	for i := 0; i < 3; i++ {
+		c.Assert(serve(refs, "").Code, Equals, http.StatusNotFound)
+	}
+	rec := serve(refs, "")
+	c.Assert(rec.Code, Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "1")
+	c.Assert(serve("/Bad/@v/list", "").Code, Equals, http.StatusTooManyRequests)
+
+	// Spoofed X-Forwarded-For entries aren't trusted by default.
+	c.Assert(serve(refs, "198.51.100.1").Code, Equals, http.StatusTooManyRequests)
+
+	config().TrustedHops = 1
+	c.Assert(serve(refs, "203.0.113.5, 198.51.100.1").Code, Equals, http.StatusNotFound)
+	config().TrustedHops = 0
+
+	// Only proxied requests are limited.
+	c.Assert(serve("/", "").Code, Equals, http.StatusTemporaryRedirect)
+	c.Assert(serve("/config.v1.2", "").Code, Equals, http.StatusNotFound)
+	c.Assert(serve("/health-check", "").Code, Equals, http.StatusOK)
+}
+
+func (s *RateLimitSuite) TestIsProxiedPath(c *C) {
+	c.Assert(isProxiedPath("/info/refs"), Equals, true)
+	c.Assert(isProxiedPath("/git-upload-pack"), Equals, true)
+	c.Assert(isProxiedPath("/HEAD"), Equals, true)
+	c.Assert(isProxiedPath(""), Equals, false)
+	c.Assert(isProxiedPath("/subpkg"), Equals, false)
+}
+
+func (s *RateLimitSuite) TestConfig(c *C) {
+	cfg := newConfig()
+	cfg.RateLimit = -1
+	c.Assert(cfg.validate(), ErrorMatches, "rate limit must not be negative, got -1")
+	cfg.RateLimit = 1
+	cfg.RateBurst = 0
+	c.Assert(cfg.validate(), ErrorMatches, "rate burst must be at least 1, got 0")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery wraps h so that a panic serving a request is logged with
+// its stack and answered 500 Internal Server Error, when the response
+// headers haven't been sent yet, instead of dropping the connection.
+// http.ErrAbortHandler is let through, as it's how a handler aborts a
+// response on purpose.
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			metrics.Panicked()
+			logger.ErrorContext(r.Context(), "panic serving request", "method", r.Method, "url", r.URL.String(),
+				"panic", v, "stack", string(debug.Stack()))
+			if sw.code == 0 {
+				http.Error(sw, "Internal server error.", http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
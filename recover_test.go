@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RecoverySuite{})
+
+type RecoverySuite struct {
+	log     bytes.Buffer
+	metrics *panicMetrics
+	restore func()
+}
+
+// panicMetrics counts the panics reported.
+type panicMetrics struct {
+	nopMetrics
+	panics int
+}
+
+func (m *panicMetrics) Panicked() { m.panics++ }
+
+func (s *RecoverySuite) SetUpTest(c *C) {
+	l, m := logger, metrics
+	s.restore = func() { logger, metrics = l, m }
+	s.log.Reset()
+	logger = slog.New(slog.NewTextHandler(&s.log, nil))
+	s.metrics = &panicMetrics{}
+	metrics = s.metrics
+}
+
+func (s *RecoverySuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+func (s *RecoverySuite) TestPanic(c *C) {
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string][]string
+		m["Content-Type"] = nil
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/config.v1", nil))
+
+	c.Assert(rec.Code, Equals, http.StatusInternalServerError)
+	c.Assert(rec.Body.String(), Equals, "Internal server error.\n")
+	c.Assert(s.metrics.panics, Equals, 1)
+	c.Assert(s.log.String(), Matches, `(?s)time=\S+ level=ERROR msg="panic serving request" method=GET url=/config.v1 panic="assignment to entry in nil map" stack=.*recover_test.go.*`)
+}
+
+func (s *RecoverySuite) TestPanicAfterHeaders(c *C) {
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("partial"))
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/config.v1", nil))
+
+	c.Assert(rec.Code, Equals, http.StatusAccepted)
+	c.Assert(rec.Body.String(), Equals, "partial")
+	c.Assert(s.metrics.panics, Equals, 1)
+}
+
+func (s *RecoverySuite) TestAbortHandler(c *C) {
+	h := withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	rec := httptest.NewRecorder()
+	c.Assert(func() { h.ServeHTTP(rec, httptest.NewRequest("GET", "/config.v1", nil)) }, PanicMatches, "net/http: abort Handler")
+	c.Assert(s.metrics.panics, Equals, 0)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// redacted replaces the values of sensitive headers and query parameters
+// in the logs.
+const redacted = "***"
+
+// redactAttr is the slog ReplaceAttr function of the logger. Attributes
+// named after one of config.RedactHeaders have their value redacted, as
+// do the headers of http.Header values; the values of
+// config.RedactParams are masked within strings, errors and other
+// printable values, URLs mostly.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isRedactedHeader(a.Key) {
+		a.Value = slog.StringValue(redacted)
+		return a
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactString(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case http.Header:
+			a.Value = slog.AnyValue(redactHeader(v))
+		case error:
+			a.Value = slog.StringValue(redactString(v.Error()))
+		case fmt.Stringer:
+			a.Value = slog.StringValue(redactString(v.String()))
+		}
+	}
+	return a
+}
+
+func isRedactedHeader(name string) bool {
+	for _, h := range config().RedactHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of h with the values of the headers in
+// config.RedactHeaders redacted.
+func redactHeader(h http.Header) http.Header {
+	clean := h.Clone()
+	for name, vv := range clean {
+		if isRedactedHeader(name) {
+			for i := range vv {
+				vv[i] = redacted
+			}
+		}
+	}
+	return clean
+}
+
+// redactString returns s with the values of the query parameters in
+// config.RedactParams redacted, wherever "?name=" or "&name=" appears in
+// it. The value runs up to the next "&", "#", quote or space.
+func redactString(s string) string {
+	for _, name := range config().RedactParams {
+		for _, sep := range "?&" {
+			s = redactParam(s, string(sep)+name+"=")
+		}
+	}
+	return s
+}
+
+func redactParam(s, prefix string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, prefix)
+		if i < 0 {
+			break
+		}
+		i += len(prefix)
+		end := strings.IndexAny(s[i:], "&#\"' \t\r\n")
+		if end < 0 {
+			end = len(s) - i
+		}
+		b.WriteString(s[:i])
+		if end > 0 {
+			b.WriteString(redacted)
+		}
+		s = s[i+end:]
+	}
+	if b.Len() == 0 {
+		return s
+	}
+	b.WriteString(s)
+	return b.String()
+}
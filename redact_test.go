@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RedactSuite{})
+
+type RedactSuite struct{}
+
+var redactStringTests = []struct {
+	in, out string
+}{
+	{"/config.v1?go-get=1", "/config.v1?go-get=1"},
+	{"/config.v1/info/refs?access_token=s3cr3t", "/config.v1/info/refs?access_token=***"},
+	{"/x?service=git-upload-pack&token=s3cr3t&go-get=1", "/x?service=git-upload-pack&token=***&go-get=1"},
+	{`Get "https://github.com/x?token=a#frag": timeout`, `Get "https://github.com/x?token=***#frag": timeout`},
+	{"/x?mytoken=kept&token=", "/x?mytoken=kept&token="},
+	{"/x?token=a&token=b", "/x?token=***&token=***"},
+}
+
+func (s *RedactSuite) TestRedactString(c *C) {
+	for _, t := range redactStringTests {
+		c.Check(redactString(t.in), Equals, t.out, Commentf("%q", t.in))
+	}
+}
+
+func (s *RedactSuite) TestRedactHeader(c *C) {
+	h := http.Header{}
+	h.Set("Authorization", "Basic dXNlcjp0b2tlbg==")
+	h.Add("Cookie", "a=1")
+	h.Add("Cookie", "b=2")
+	h.Set("Git-Protocol", "version=2")
+	c.Assert(redactHeader(h), DeepEquals, http.Header{
+		"Authorization": {"***"},
+		"Cookie":        {"***", "***"},
+		"Git-Protocol":  {"version=2"},
+	})
+	c.Assert(h.Get("Authorization"), Equals, "Basic dXNlcjp0b2tlbg==")
+}
+
+func (s *RedactSuite) TestLogger(c *C) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+	var buf bytes.Buffer
+	c.Assert(setupLogger(&buf, newConfig()), IsNil)
+
+	u, _ := url.Parse("https://github.com/go-aah/config?access_token=s3cr3t")
+	h := http.Header{"X-Api-Key": {"k3y"}}
+	logger.Warn("leaky", "url", u, "authorization", "Bearer s3cr3t", "header", h,
+		"err", errors.New("cannot get /x?token=s3cr3t"))
+	c.Assert(buf.String(), Not(Matches), "(?s).*(s3cr3t|k3y).*")
+	c.Assert(buf.String(), Matches,
+		`.*url="https://github.com/go-aah/config\?access_token=\*\*\*" authorization=\*\*\* header=map\[X-Api-Key:\[\*\*\*\]\] err="cannot get /x\?token=\*\*\*"\n`)
+}
+
+func (s *RedactSuite) TestAccessLog(c *C) {
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack&access_token=s3cr3t", nil)
+	req.Header.Set("Referer", "https://example.com/?token=s3cr3t")
+	line := accessLogLine(req, 200, 0, time.Now(), 0)
+	c.Assert(line, Matches, `.*"GET /config.v1/info/refs\?service=git-upload-pack&access_token=\*\*\* HTTP/1.1" 200 - "https://example.com/\?token=\*\*\*" .*\n`)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxRedirectBody is the largest request body kept around to be sent
+// again when GitHub redirects a POST, as it does for renamed
+// repositories. Fetch negotiations fit; pushes, carrying a packfile,
+// mostly don't.
+const maxRedirectBody = 1 << 20
+
+// checkRedirect is the redirect policy of the clients talking to GitHub.
+// GET and HEAD requests follow redirects as usual. Others get the
+// redirect response back, so that proxy can follow it with the same body
+// rather than the GET net/http would turn a redirected POST into. At most
+// config.MaxRedirects are followed, to the same host only when
+// config.SameHostRedirects is set. Past those, a *movedError is returned,
+// which is not a failure of GitHub.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	cfg := config()
+	if m := via[0].Method; m != "GET" && m != "HEAD" {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > cfg.MaxRedirects {
+		return &movedError{req.URL.Redacted(), fmt.Sprintf("stopped after %d redirects", cfg.MaxRedirects)}
+	}
+	if cfg.SameHostRedirects && (req.URL.Scheme != via[0].URL.Scheme || req.URL.Host != via[0].URL.Host) {
+		return &movedError{req.URL.Redacted(), "which is not followed to another host"}
+	}
+	return nil
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// replayBody records the request body read through it, up to
+// maxRedirectBody bytes, so that it can be sent again where GitHub
+// redirects. It is read by the transport, possibly concurrently with
+// replay.
+type replayBody struct {
+	r io.Reader
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	over bool // the body is larger than maxRedirectBody
+	eof  bool // the body was read through
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.over {
+		if b.buf.Len()+n > maxRedirectBody {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// replay returns the whole body, if it was read through and kept.
+func (b *replayBody) replay() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.over || !b.eof {
+		return nil, false
+	}
+	return b.buf.Bytes(), true
+}
+
+// movedError tells that GitHub redirected a request, to Location, in a
+// way it can't be followed.
+type movedError struct {
+	Location string
+	Reason   string
+}
+
+func (e *movedError) Error() string {
+	return fmt.Sprintf("GitHub redirected to %s, %s", e.Location, e.Reason)
+}
+
+// followRedirect sends req again, with the body recorded in body, to
+// where res redirects it, as long as that's on the same host and the body
+// could be recorded whole. Redirects are followed up to
+// config.MaxRedirects times. Otherwise a *movedError is returned.
+func followRedirect(req *http.Request, res *http.Response, body *replayBody) (*http.Response, error) {
+	for i := 0; isRedirect(res.StatusCode); i++ {
+		loc, err := res.Location()
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("GitHub redirected without a valid Location: %v", err)
+		}
+		logger.WarnContext(req.Context(), "GitHub redirected request", "method", req.Method,
+			"url", req.URL.String(), "location", loc.String(), "status", res.StatusCode)
+		if max := config().MaxRedirects; i >= max {
+			return nil, &movedError{loc.String(), fmt.Sprintf("stopped after %d redirects", max)}
+		}
+		if loc.Scheme != req.URL.Scheme || loc.Host != req.URL.Host {
+			return nil, &movedError{loc.String(), "which is not followed to another host"}
+		}
+		if res.StatusCode == http.StatusSeeOther {
+			return nil, &movedError{loc.String(), "asking for a GET"}
+		}
+		data, ok := body.replay()
+		if !ok {
+			return nil, &movedError{loc.String(), "and the request body can't be sent again"}
+		}
+		next, err := http.NewRequestWithContext(req.Context(), req.Method, loc.String(), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		next.Header = cloneHeader(req.Header)
+		setRepoToken(next.Header, loc.String())
+		req = next
+		if res, err = doRetry(req); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// sendMoved tells the client GitHub redirected its request somewhere it
+// can't be followed, renamed repositories mostly.
+func sendMoved(w http.ResponseWriter, r *http.Request, moved *movedError) {
+	logger.WarnContext(r.Context(), "cannot follow GitHub redirect", "location", moved.Location, "err", moved)
+	w.WriteHeader(http.StatusBadGateway)
+	_, _ = fmt.Fprintf(w, "The repository moved at GitHub, to %s; update the import path or the remote.", moved.Location)
+}
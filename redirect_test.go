@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ProxySuite) TestCheckRedirect(c *C) {
+	get := httptest.NewRequest("GET", "/", nil)
+	post := httptest.NewRequest("POST", "/", nil)
+	c.Assert(checkRedirect(get, []*http.Request{get}), IsNil)
+	c.Assert(checkRedirect(get, []*http.Request{post}), Equals, http.ErrUseLastResponse)
+
+	via := []*http.Request{get, get}
+	c.Assert(checkRedirect(get, via), IsNil)
+	c.Assert(checkRedirect(get, append(via, get)), ErrorMatches, "GitHub redirected to /, stopped after 2 redirects")
+}
+
+func (s *ProxySuite) TestCheckRedirectSameHost(c *C) {
+	defer func() { config().SameHostRedirects = false }()
+	get := httptest.NewRequest("GET", "https://github.com/go-aah/config/info/refs", nil)
+	other := httptest.NewRequest("GET", "https://example.com/aah/config/info/refs", nil)
+	c.Assert(checkRedirect(other, []*http.Request{get}), IsNil)
+	config().SameHostRedirects = true
+	c.Assert(checkRedirect(get, []*http.Request{get}), IsNil)
+	c.Assert(checkRedirect(other, []*http.Request{get}), ErrorMatches,
+		"GitHub redirected to https://example.com/aah/config/info/refs, which is not followed to another host")
+}
+
+func (s *ProxySuite) TestProxyRedirectChainTooLong(c *C) {
+	var gets int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		http.Redirect(w, r, "/go-aah/config"+strconv.Itoa(gets)+"/info/refs", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/config.v1/info/refs?service=git-upload-pack", nil)
+	rec := httptest.NewRecorder()
+	proxyInfoRefs(rec, req, backend.URL+"/go-aah/config/info/refs")
+
+	c.Assert(gets, Equals, config().MaxRedirects+1)
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+	c.Assert(rec.Body.String(), Matches, "The repository moved at GitHub, to .*/go-aah/config3/info/refs; .*")
+}
+
+func (s *ProxySuite) TestProxyRedirectFollowed(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/go-aah/config/git-upload-pack" {
+			http.Redirect(w, r, "/aah/config/git-upload-pack", http.StatusMovedPermanently)
+			return
+		}
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.URL.Path, Equals, "/aah/config/git-upload-pack")
+		c.Check(r.Header.Get("Content-Type"), Equals, "application/x-git-upload-pack-request")
+		body, _ := io.ReadAll(r.Body)
+		c.Check(string(body), Equals, "0032want 0123456789abcdef0123456789abcdef01234567\n0000")
+		_, _ = w.Write([]byte("0008NAK\n"))
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack",
+		strings.NewReader("0032want 0123456789abcdef0123456789abcdef01234567\n0000"))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), Equals, "0008NAK\n")
+}
+
+func (s *ProxySuite) TestProxyRedirectOtherHost(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://example.com/aah/config/git-upload-pack", http.StatusTemporaryRedirect)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+	c.Assert(rec.Body.String(), Equals,
+		"The repository moved at GitHub, to https://example.com/aah/config/git-upload-pack; update the import path or the remote.")
+}
+
+func (s *ProxySuite) TestProxyRedirectBodyTooLarge(c *C) {
+	var posts int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		_, _ = io.Copy(io.Discard, r.Body)
+		http.Redirect(w, r, "/aah/config/git-upload-pack", http.StatusPermanentRedirect)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack",
+		strings.NewReader(strings.Repeat("x", maxRedirectBody+1)))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(posts, Equals, 1)
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+	c.Assert(rec.Body.String(), Matches, "The repository moved at GitHub, to .*/aah/config/git-upload-pack; .*")
+}
+
+func (s *ProxySuite) TestProxyRedirectLoop(c *C) {
+	var posts int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	rec := httptest.NewRecorder()
+	proxyGitUploadPack(rec, req, backend.URL+"/go-aah/config/git-upload-pack")
+
+	c.Assert(posts, Equals, config().MaxRedirects+1)
+	c.Assert(rec.Code, Equals, http.StatusBadGateway)
+}
@@ -158,6 +158,25 @@ var refsTests = []refsTest{{
 		"00000000000000000000000000000000000hash7 refs/heads/v2",
 	),
 	[]string{"v1", "v1.1-edge", "v1.2-edge", "v1.3-edge", "v2"},
+}, {
+	"Greatest matching tag, pre-releases ignored",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/tags/v2.0.0",
+		"00000000000000000000000000000000000hash3 refs/tags/v2.10.1",
+		"00000000000000000000000000000000000hash4 refs/tags/v2.9.3",
+		"00000000000000000000000000000000000hash5 refs/tags/v2.11.0-rc1",
+	),
+	"v2",
+	reflines(
+		"00000000000000000000000000000000000hash3 HEAD",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/tags/v2.0.0",
+		"00000000000000000000000000000000000hash3 refs/tags/v2.10.1",
+		"00000000000000000000000000000000000hash4 refs/tags/v2.9.3",
+		"00000000000000000000000000000000000hash5 refs/tags/v2.11.0-rc1",
+	),
+	[]string{"v2.0.0", "v2.9.3", "v2.10.1"},
 }}
 
 func reflines(lines ...string) string {
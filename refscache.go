@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refsCache holds the refs advertisements recently fetched from GitHub,
+// for config.RefsCacheTTL, so that the many requests of a single go get
+// or clone, and bursts of clones of a same repository, don't all fetch
+// them anew. The advertisements take up to config.RefsCacheSize bytes,
+// beyond which the least recently used ones are dropped. Repositories are
+// keyed by their refs URL in lower case, as GitHub names are case
+// insensitive.
+type refsCache struct {
+	mu      sync.Mutex
+	lru     *list.List // of *refsEntry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+
+	now func() time.Time
+}
+
+type refsEntry struct {
+	url      string
+	data     []byte
+	expires  time.Time
+	modified time.Time // when data was first cached, the Last-Modified of the refs
+}
+
+var refsCached = &refsCache{now: time.Now}
+
+// get returns the refs cached for the repository at url, if any.
+func (rc *refsCache) get(url string) ([]byte, bool) {
+	if config().RefsCacheTTL <= 0 {
+		return nil, false
+	}
+	url = strings.ToLower(url)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[url]
+	// Expired entries are left for put to tell unchanged refs, until
+	// replaced or pushed out.
+	ok = ok && rc.now().Before(e.Value.(*refsEntry).expires)
+	metrics.CacheLookup(cacheRefs, ok)
+	if !ok {
+		return nil, false
+	}
+	rc.lru.MoveToFront(e)
+	return e.Value.(*refsEntry).data, true
+}
+
+// lastModified returns when the refs cached for the repository at url
+// were first seen as they are, or the zero time if there are none.
+func (rc *refsCache) lastModified(url string) time.Time {
+	url = strings.ToLower(url)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if e, ok := rc.entries[url]; ok {
+		return e.Value.(*refsEntry).modified
+	}
+	return time.Time{}
+}
+
+// put caches data as the refs of the repository at url. Refs fetched
+// again unchanged keep their time of modification, even once expired,
+// so that If-Modified-Since goes on matching. Advertisements over a
+// quarter of the cache size aren't cached, so that a single huge
+// repository doesn't push all the others out, and the refs cached before
+// are dropped.
+func (rc *refsCache) put(url string, data []byte) {
+	if config().RefsCacheTTL <= 0 {
+		return
+	}
+	if int64(len(data)) > config().RefsCacheSize/4 {
+		// The refs cached before the repository grew are stale now.
+		rc.invalidate(url)
+		return
+	}
+	url = strings.ToLower(url)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.entries == nil {
+		rc.lru = list.New()
+		rc.entries = make(map[string]*list.Element)
+	}
+	modified := rc.now()
+	if e, ok := rc.entries[url]; ok {
+		if old := e.Value.(*refsEntry); bytes.Equal(old.data, data) {
+			modified = old.modified
+		}
+		rc.remove(e)
+	}
+	rc.entries[url] = rc.lru.PushFront(&refsEntry{url, data, rc.now().Add(config().RefsCacheTTL), modified})
+	rc.size += int64(len(data))
+	for rc.size > config().RefsCacheSize {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// invalidate drops the refs cached for the repository at url, if any,
+// from the disk cache as well.
+func (rc *refsCache) invalidate(url string) {
+	refsDisk.invalidate(url)
+	url = strings.ToLower(url)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if e, ok := rc.entries[url]; ok {
+		rc.remove(e)
+	}
+}
+
+func (rc *refsCache) remove(e *list.Element) {
+	re := rc.lru.Remove(e).(*refsEntry)
+	delete(rc.entries, re.url)
+	rc.size -= int64(len(re.data))
+}
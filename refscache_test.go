@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RefsCacheSuite{})
+
+type RefsCacheSuite struct {
+	now time.Time
+	rc  *refsCache
+}
+
+func (s *RefsCacheSuite) SetUpTest(c *C) {
+	s.now = time.Date(2018, 3, 29, 0, 0, 0, 0, time.UTC)
+	s.rc = &refsCache{now: func() time.Time { return s.now }}
+}
+
+func (s *RefsCacheSuite) TestExpiry(c *C) {
+	_, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, false)
+
+	s.rc.put("https://github.com/go-aah/config.git", []byte("refs"))
+	data, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, true)
+	c.Assert(string(data), Equals, "refs")
+
+	s.now = s.now.Add(config().RefsCacheTTL)
+	_, ok = s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, false)
+	// Kept for its time of modification, still counted.
+	c.Assert(s.rc.entries, HasLen, 1)
+	c.Assert(s.rc.size, Equals, int64(4))
+}
+
+func (s *RefsCacheSuite) TestLastModified(c *C) {
+	url := "https://github.com/go-aah/config.git"
+	c.Assert(s.rc.lastModified(url).IsZero(), Equals, true)
+	first := s.now
+	s.rc.put(url, []byte("refs"))
+	c.Assert(s.rc.lastModified(url), Equals, first)
+
+	// Unchanged refs keep their time.
+	s.now = s.now.Add(time.Minute)
+	s.rc.put(url, []byte("refs"))
+	c.Assert(s.rc.lastModified("https://github.com/Go-Aah/config.git"), Equals, first)
+	s.rc.put(url, []byte("new refs"))
+	c.Assert(s.rc.lastModified(url), Equals, s.now)
+}
+
+func (s *RefsCacheSuite) TestLastModifiedAfterExpiry(c *C) {
+	url := "https://github.com/go-aah/config.git"
+	first := s.now
+	s.rc.put(url, []byte("refs"))
+
+	s.now = s.now.Add(config().RefsCacheTTL)
+	_, ok := s.rc.get(url)
+	c.Assert(ok, Equals, false)
+	// Fetched again unchanged.
+	s.rc.put(url, []byte("refs"))
+	c.Assert(s.rc.lastModified(url), Equals, first)
+	_, ok = s.rc.get(url)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RefsCacheSuite) TestEvict(c *C) {
+	defer func(size int64) { config().RefsCacheSize = size }(config().RefsCacheSize)
+	config().RefsCacheSize = 40
+
+	s.rc.put("https://github.com/go-aah/config.git", []byte(strings.Repeat("a", 10)))
+	s.rc.put("https://github.com/go-aah/log.git", []byte(strings.Repeat("b", 10)))
+	s.rc.put("https://github.com/go-aah/router.git", []byte(strings.Repeat("d", 10)))
+	// Using config makes log the least recently used one.
+	_, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, true)
+	s.rc.put("https://github.com/go-aah/view.git", []byte(strings.Repeat("e", 10)))
+	s.rc.put("https://github.com/go-aah/i18n.git", []byte(strings.Repeat("f", 10)))
+
+	_, ok = s.rc.get("https://github.com/go-aah/log.git")
+	c.Assert(ok, Equals, false)
+	_, ok = s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, true)
+	c.Assert(s.rc.size, Equals, int64(40))
+
+	// Refs over a quarter of the cache aren't kept.
+	s.rc.put("https://github.com/go-aah/huge.git", []byte(strings.Repeat("h", 11)))
+	_, ok = s.rc.get("https://github.com/go-aah/huge.git")
+	c.Assert(ok, Equals, false)
+	c.Assert(s.rc.size, Equals, int64(40))
+}
+
+func (s *RefsCacheSuite) TestGrownTooLarge(c *C) {
+	defer func(size int64) { config().RefsCacheSize = size }(config().RefsCacheSize)
+	config().RefsCacheSize = 40
+
+	s.rc.put("https://github.com/go-aah/config.git", []byte(strings.Repeat("a", 10)))
+	s.rc.put("https://github.com/go-aah/config.git", []byte(strings.Repeat("a", 11)))
+	_, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, false)
+	c.Assert(s.rc.size, Equals, int64(0))
+}
+
+func (s *RefsCacheSuite) TestReplace(c *C) {
+	s.rc.put("https://github.com/go-aah/config.git", []byte("old"))
+	s.rc.put("https://github.com/go-aah/config.git", []byte("newer"))
+	data, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, true)
+	c.Assert(string(data), Equals, "newer")
+	c.Assert(s.rc.size, Equals, int64(5))
+}
+
+func (s *RefsCacheSuite) TestCaseInsensitive(c *C) {
+	s.rc.put("https://github.com/Go-Aah/Config.git", []byte("refs"))
+	data, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, true)
+	c.Assert(string(data), Equals, "refs")
+	s.rc.invalidate("https://github.com/GO-AAH/config.git")
+	_, ok = s.rc.get("https://github.com/Go-Aah/Config.git")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RefsCacheSuite) TestInvalidate(c *C) {
+	s.rc.invalidate("https://github.com/go-aah/config.git")
+	s.rc.put("https://github.com/go-aah/config.git", []byte("refs"))
+	s.rc.invalidate("https://github.com/go-aah/config.git")
+	_, ok := s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(ok, Equals, false)
+	c.Assert(s.rc.size, Equals, int64(0))
+}
+
+func (s *RefsCacheSuite) TestMetrics(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	lookups := &cacheMetrics{}
+	metrics = lookups
+
+	s.rc.get("https://github.com/go-aah/config.git")
+	s.rc.put("https://github.com/go-aah/config.git", []byte("refs"))
+	s.rc.get("https://github.com/go-aah/config.git")
+	c.Assert(lookups.hits, Equals, 1)
+	c.Assert(lookups.misses, Equals, 1)
+}
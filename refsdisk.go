@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refsDiskCache is the tier of the refs cache kept in
+// config.RefsDiskCacheDir, for the refs to outlive restarts. An entry is
+// a file named after the SHA-256 of the refs URL, holding a JSON header
+// line and the advertisement. Entries failing their checksum, as when
+// the disk filled up while writing, are dropped.
+//
+// Module metadata isn't kept on disk: the versions of a module come from
+// its refs, and the commit times and go.mod files fetched for the others
+// are left to the memory caches and GitHub.
+type refsDiskCache struct {
+	mu    sync.Mutex // serializes the writes and evictions, guards size
+	dir   string     // that size is of, once walked
+	size  int64      // bytes of the entries in dir
+	sized bool
+
+	now func() time.Time
+}
+
+// refsDiskHeader is the first line of a refs disk cache entry.
+type refsDiskHeader struct {
+	URL     string    `json:"url"`
+	ETag    string    `json:"etag,omitempty"`
+	Fetched time.Time `json:"fetched"`
+	Sum     string    `json:"sha256"`
+}
+
+var refsDisk = &refsDiskCache{now: time.Now}
+
+func (dc *refsDiskCache) path(url string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(url)))
+	return filepath.Join(config().RefsDiskCacheDir, hex.EncodeToString(sum[:])+".refs")
+}
+
+// get returns the refs kept for the repository at url, fetched no longer
+// than config.RefsDiskCacheTTL ago, along with the ETag GitHub gave them.
+func (dc *refsDiskCache) get(url string) (data []byte, etag string, ok bool) {
+	if config().RefsDiskCacheDir == "" {
+		return nil, "", false
+	}
+	defer func() { metrics.CacheLookup(cacheRefsDisk, ok) }()
+	path := dc.path(url)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", false
+	}
+	line, data, _ := bytes.Cut(raw, []byte("\n"))
+	var h refsDiskHeader
+	if err := json.Unmarshal(line, &h); err != nil || !strings.EqualFold(h.URL, url) || h.Sum != sha256Hex(data) {
+		logger.Warn("dropping corrupt refs disk cache entry", "path", path)
+		dc.remove(path)
+		return nil, "", false
+	}
+	if dc.now().Sub(h.Fetched) >= config().RefsDiskCacheTTL {
+		dc.remove(path)
+		return nil, "", false
+	}
+	return data, h.ETag, true
+}
+
+// put keeps data, with the ETag GitHub gave it, as the refs of the
+// repository at url, just fetched or confirmed unchanged. Entries over a
+// quarter of config.RefsDiskCacheMaxSize aren't kept.
+func (dc *refsDiskCache) put(url string, data []byte, etag string) {
+	dir := config().RefsDiskCacheDir
+	if dir == "" || int64(len(data)) > config().RefsDiskCacheMaxSize/4 {
+		return
+	}
+	line, err := json.Marshal(refsDiskHeader{URL: strings.ToLower(url), ETag: etag, Fetched: dc.now(), Sum: sha256Hex(data)})
+	if err != nil {
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Warn("cannot create refs disk cache", "dir", dir, "err", err)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		logger.Warn("cannot write refs disk cache", "dir", dir, "err", err)
+		return
+	}
+	dc.evict(dir)
+	entry := append(append(line, '\n'), data...)
+	_, err = f.Write(entry)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	path := dc.path(url)
+	var replaced int64
+	if info, err := os.Stat(path); err == nil {
+		replaced = info.Size()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		logger.Warn("cannot write refs disk cache", "dir", dir, "err", err)
+		_ = os.Remove(f.Name())
+		return
+	}
+	dc.size += int64(len(entry)) - replaced
+	if dc.size > config().RefsDiskCacheMaxSize {
+		dc.evict(dir)
+	}
+}
+
+// invalidate drops the refs kept for the repository at url, if any.
+func (dc *refsDiskCache) invalidate(url string) {
+	if config().RefsDiskCacheDir == "" {
+		return
+	}
+	dc.remove(dc.path(url))
+}
+
+// remove drops the entry at path, keeping count of the size of the cache.
+func (dc *refsDiskCache) remove(path string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	info, err := os.Stat(path)
+	if err != nil || os.Remove(path) != nil {
+		return
+	}
+	if dc.sized && filepath.Dir(path) == dc.dir {
+		dc.size -= info.Size()
+	}
+}
+
+// evict sizes the entries of dir, when they weren't already or are over
+// config.RefsDiskCacheMaxSize, and then removes the least recently
+// written ones until they take no more than that. Only then is the
+// directory walked, the size being kept up to date otherwise.
+func (dc *refsDiskCache) evict(dir string) {
+	if dc.sized && dc.dir == dir && dc.size <= config().RefsDiskCacheMaxSize {
+		return
+	}
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var entries []entry
+	var total int64
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".refs") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			entries = append(entries, entry{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	for _, e := range entries {
+		if total <= config().RefsDiskCacheMaxSize {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+		}
+	}
+	dc.dir, dc.size, dc.sized = dir, total, true
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
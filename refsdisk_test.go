@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RefsDiskSuite{})
+
+type RefsDiskSuite struct {
+	now     time.Time
+	restore func()
+}
+
+func (s *RefsDiskSuite) SetUpTest(c *C) {
+	dir, ttl, max, rd := config().RefsDiskCacheDir, config().RefsDiskCacheTTL, config().RefsDiskCacheMaxSize, refsDisk
+	s.restore = func() {
+		config().RefsDiskCacheDir, config().RefsDiskCacheTTL, config().RefsDiskCacheMaxSize, refsDisk = dir, ttl, max, rd
+	}
+	config().RefsDiskCacheDir = c.MkDir()
+	config().RefsDiskCacheTTL = time.Hour
+	config().RefsDiskCacheMaxSize = defaultRefsDiskCacheMaxSize
+	s.now = time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	refsDisk = &refsDiskCache{now: func() time.Time { return s.now }}
+}
+
+func (s *RefsDiskSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+const diskURL = "https://github.com/go-aah/config.git/info/refs?service=git-upload-pack"
+
+func (s *RefsDiskSuite) TestPutGet(c *C) {
+	_, _, ok := refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+
+	refsDisk.put(diskURL, []byte("refs\nmore refs"), `"v1"`)
+	data, etag, ok := refsDisk.get(strings.ToUpper(diskURL))
+	c.Assert(ok, Equals, true)
+	c.Assert(string(data), Equals, "refs\nmore refs")
+	c.Assert(etag, Equals, `"v1"`)
+
+	s.now = s.now.Add(time.Hour)
+	_, _, ok = refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+	_, err := os.Stat(refsDisk.path(diskURL))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *RefsDiskSuite) TestDisabled(c *C) {
+	config().RefsDiskCacheDir = ""
+	refsDisk.put(diskURL, []byte("refs"), "")
+	_, _, ok := refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RefsDiskSuite) TestCorrupt(c *C) {
+	refsDisk.put(diskURL, []byte("refs"), "")
+	path := refsDisk.path(diskURL)
+	raw, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(os.WriteFile(path, append(raw, "junk"...), 0600), IsNil)
+
+	_, _, ok := refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *RefsDiskSuite) TestInvalidate(c *C) {
+	refsDisk.put(diskURL, []byte("refs"), "")
+	refsCached.invalidate(diskURL)
+	_, _, ok := refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RefsDiskSuite) TestSize(c *C) {
+	sizes := func() (total int64) {
+		files, _ := filepath.Glob(filepath.Join(config().RefsDiskCacheDir, "*.refs"))
+		for _, f := range files {
+			info, err := os.Stat(f)
+			c.Assert(err, IsNil)
+			total += info.Size()
+		}
+		return total
+	}
+	other := strings.Replace(diskURL, "config", "log", 1)
+	refsDisk.put(diskURL, []byte("refs"), "")
+	refsDisk.put(other, []byte("other refs"), "")
+	c.Assert(refsDisk.size, Equals, sizes())
+	refsDisk.put(diskURL, []byte("more refs"), `"v2"`)
+	c.Assert(refsDisk.size, Equals, sizes())
+	refsDisk.invalidate(other)
+	c.Assert(refsDisk.size, Equals, sizes())
+	c.Assert(refsDisk.size > 0, Equals, true)
+}
+
+func (s *RefsDiskSuite) TestEvict(c *C) {
+	config().RefsDiskCacheMaxSize = 1000
+	data := []byte(strings.Repeat("x", 100))
+	var urls []string
+	for i := 0; i < 10; i++ {
+		url := strings.Replace(diskURL, "config", "repo"+string(rune('a'+i)), 1)
+		urls = append(urls, url)
+		refsDisk.put(url, data, "")
+		// Oldest first.
+		mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(refsDisk.path(url), mtime, mtime), IsNil)
+	}
+	files, _ := filepath.Glob(filepath.Join(config().RefsDiskCacheDir, "*.refs"))
+	c.Assert(len(files) < 10, Equals, true)
+
+	_, _, ok := refsDisk.get(urls[0])
+	c.Assert(ok, Equals, false)
+	_, _, ok = refsDisk.get(urls[9])
+	c.Assert(ok, Equals, true)
+
+	// Too large to be kept.
+	refsDisk.put(diskURL, []byte(strings.Repeat("x", 300)), "")
+	_, _, ok = refsDisk.get(diskURL)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *HandlerSuite) TestRefsDiskCache(c *C) {
+	defer func(dir string) { config().RefsDiskCacheDir = dir }(config().RefsDiskCacheDir)
+	config().RefsDiskCacheDir = c.MkDir()
+
+	rec := s.serve("GET", "/config.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 1)
+
+	// Restarted, the refs kept without an ETag are fetched again.
+	refsCached = &refsCache{now: time.Now}
+	again := s.serve("GET", "/config.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(again.Code, Equals, http.StatusOK)
+	c.Assert(again.Body.String(), Equals, rec.Body.String())
+	c.Assert(s.refsHits, Equals, 2)
+}
+
+func (s *HandlerSuite) TestRefsDiskCacheFallback(c *C) {
+	defer func(dir string) { config().RefsDiskCacheDir = dir }(config().RefsDiskCacheDir)
+	config().RefsDiskCacheDir = c.MkDir()
+	var down bool
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+
+	rec := s.serve("GET", "/log.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+
+	// Restarted while GitHub fails, the refs kept are served.
+	refsCached = &refsCache{now: time.Now}
+	down = true
+	again := s.serve("GET", "/log.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(again.Code, Equals, http.StatusOK)
+	c.Assert(again.Body.String(), Equals, rec.Body.String())
+}
+
+func (s *HandlerSuite) TestRefsDiskCacheETag(c *C) {
+	defer func(dir string) { config().RefsDiskCacheDir = dir }(config().RefsDiskCacheDir)
+	config().RefsDiskCacheDir = c.MkDir()
+	var hits, notModified int
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("ETag", `"refs-1"`)
+		if r.Header.Get("If-None-Match") == `"refs-1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+
+	rec := s.serve("GET", "/log.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(hits, Equals, 1)
+
+	// Restarted, GitHub confirms the refs kept.
+	refsCached = &refsCache{now: time.Now}
+	again := s.serve("GET", "/log.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(again.Code, Equals, http.StatusOK)
+	c.Assert(again.Body.String(), Equals, rec.Body.String())
+	c.Assert(hits, Equals, 2)
+	c.Assert(notModified, Equals, 1)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"expvar"
+	"path"
+	"strings"
+	"sync"
+)
+
+// repoSlots bounds the number of requests proxied to GitHub at once for
+// each repository of config.RepoConcurrency. Repositories are counted
+// apart, but reported to Metrics.RepoInFlight by the pattern they match,
+// so that the metric has no more series than there are patterns.
+type repoSlots struct {
+	mu        sync.Mutex
+	inUse     map[string]int // by lowercase "user/name", dropped at zero
+	byPattern map[string]int
+}
+
+var repoLimits = newRepoSlots()
+
+func newRepoSlots() *repoSlots {
+	return &repoSlots{inUse: make(map[string]int), byPattern: make(map[string]int)}
+}
+
+// repoLimitFor returns the pattern of config.RepoConcurrency the
+// "user/name" repository matches and its limit, the longest pattern if
+// several do, or zero if none does.
+func repoLimitFor(repo string) (string, int) {
+	repo = strings.ToLower(repo)
+	var found string
+	var max int
+	for pattern, n := range config().RepoConcurrency {
+		if ok, _ := path.Match(strings.ToLower(pattern), repo); !ok {
+			continue
+		}
+		if max == 0 || len(pattern) > len(found) || len(pattern) == len(found) && pattern < found {
+			found, max = pattern, n
+		}
+	}
+	return found, max
+}
+
+// acquire takes a slot of the "user/name" repository and reports whether
+// there was any left. Repositories without a limit always get one. Every
+// successful acquire must be followed by a call of release.
+func (rs *repoSlots) acquire(repo string) (release func(), ok bool) {
+	pattern, max := repoLimitFor(repo)
+	if max == 0 {
+		return func() {}, true
+	}
+	key := strings.ToLower(repo)
+	rs.mu.Lock()
+	if rs.inUse[key] >= max {
+		rs.mu.Unlock()
+		return nil, false
+	}
+	rs.inUse[key]++
+	rs.byPattern[pattern]++
+	n := rs.byPattern[pattern]
+	rs.mu.Unlock()
+	metrics.RepoInFlight(pattern, n)
+
+	return func() {
+		rs.mu.Lock()
+		if rs.inUse[key]--; rs.inUse[key] <= 0 {
+			delete(rs.inUse, key)
+		}
+		rs.byPattern[pattern]--
+		n := rs.byPattern[pattern]
+		rs.mu.Unlock()
+		metrics.RepoInFlight(pattern, n)
+	}, true
+}
+
+// inFlight returns the number of requests being proxied by pattern of
+// config.RepoConcurrency, for the patterns that had any.
+func (rs *repoSlots) inFlight() map[string]int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	m := make(map[string]int, len(rs.byPattern))
+	for pattern, n := range rs.byPattern {
+		m[pattern] = n
+	}
+	return m
+}
+
+func init() {
+	expvar.Publish("proxy_repo_requests_in_flight", expvar.Func(func() interface{} { return repoLimits.inFlight() }))
+}
+
+// proxiedRepo returns the "user/name" repository target is within, on
+// config.BackendBaseURL or one of config.Backends, or "" if none.
+func proxiedRepo(target string) string {
+	if repo, ok := targetRepo(target, config().BackendBaseURL); ok {
+		return repo
+	}
+	for _, b := range config().Backends {
+		if repo, ok := targetRepo(target, b.BaseURL); ok {
+			return repo
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+func (s *ConcurrencySuite) TestRepoLimitFor(c *C) {
+	defer func(limits map[string]int) { config().RepoConcurrency = limits }(config().RepoConcurrency)
+	config().RepoConcurrency = map[string]int{"go-aah/*": 4, "go-aah/Config": 1, "jeevatkm/*": 2}
+
+	pattern, max := repoLimitFor("go-aah/config")
+	c.Assert(pattern, Equals, "go-aah/Config")
+	c.Assert(max, Equals, 1)
+	pattern, max = repoLimitFor("Go-Aah/log")
+	c.Assert(pattern, Equals, "go-aah/*")
+	c.Assert(max, Equals, 4)
+	_, max = repoLimitFor("golang/go")
+	c.Assert(max, Equals, 0)
+}
+
+func (s *ConcurrencySuite) TestRepoSlots(c *C) {
+	defer func(limits map[string]int, m Metrics) { config().RepoConcurrency, metrics = limits, m }(config().RepoConcurrency, metrics)
+	m := newPromMetrics(prometheus.NewRegistry())
+	metrics = m
+	config().RepoConcurrency = map[string]int{"go-aah/*": 1}
+	rs := newRepoSlots()
+
+	release, ok := rs.acquire("go-aah/config")
+	c.Assert(ok, Equals, true)
+	_, ok = rs.acquire("go-aah/Config")
+	c.Assert(ok, Equals, false)
+	// Each repository has its own slots.
+	releaseLog, ok := rs.acquire("go-aah/log")
+	c.Assert(ok, Equals, true)
+	c.Assert(testutil.ToFloat64(m.repoInFlight.WithLabelValues("go-aah/*")), Equals, 2.0)
+	c.Assert(rs.inFlight(), DeepEquals, map[string]int{"go-aah/*": 2})
+	for i := 0; i < 10; i++ {
+		_, ok = rs.acquire("golang/go")
+		c.Assert(ok, Equals, true)
+	}
+
+	release()
+	releaseLog()
+	c.Assert(testutil.ToFloat64(m.repoInFlight.WithLabelValues("go-aah/*")), Equals, 0.0)
+	c.Assert(rs.inUse, HasLen, 0)
+	_, ok = rs.acquire("go-aah/config")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *HandlerSuite) TestRepoConcurrency(c *C) {
+	defer func(limits map[string]int) { config().RepoConcurrency = limits }(config().RepoConcurrency)
+	defer func(rs *repoSlots) { repoLimits = rs }(repoLimits)
+	repoLimits = newRepoSlots()
+	config().RepoConcurrency = map[string]int{"go-aah/config": 1}
+
+	started, done := make(chan bool), make(chan bool)
+	s.mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-done
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+	s.mux.HandleFunc("/go-aah/log/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+	uploadPack := func(repo string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/"+repo+".v1/git-upload-pack", strings.NewReader("0000"))
+		rec := httptest.NewRecorder()
+		proxyGitUploadPack(rec, req, s.github.URL+"/go-aah/"+repo+"/git-upload-pack")
+		return rec
+	}
+
+	finished := make(chan *httptest.ResponseRecorder)
+	go func() { finished <- uploadPack("config") }()
+	<-started
+
+	rec := uploadPack("config")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("Retry-After"), Equals, "5")
+	c.Assert(uploadPack("log").Code, Equals, http.StatusOK)
+
+	close(done)
+	c.Assert((<-finished).Code, Equals, http.StatusOK)
+	c.Assert(repoLimits.inUse, HasLen, 0)
+}
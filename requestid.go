@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// maxRequestIDLen bounds the length of the X-Request-ID accepted from
+// clients.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// withRequestID wraps h so that every request has an ID, the one in its
+// X-Request-ID header when valid or else a new random UUID. The ID is
+// kept in the request context, where the logger and the requests to
+// GitHub pick it up, and is echoed in the X-Request-ID of the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request with context ctx, or the empty
+// string if it has none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// setRequestID sets the ID of the request with context ctx in h, the
+// headers of a request to GitHub made on its behalf.
+func setRequestID(ctx context.Context, h http.Header) {
+	if id := requestID(ctx); id != "" {
+		h.Set("X-Request-ID", id)
+	}
+}
+
+// validRequestID reports whether id is fine to be logged and forwarded:
+// not too long, and made of printable ASCII characters with no spaces or
+// quotes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RequestIDSuite{})
+
+type RequestIDSuite struct{}
+
+const uuidPattern = `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`
+
+// serve returns the request ID seen by a handler behind withRequestID,
+// and the one sent back, for a request with the given X-Request-ID.
+func (s *RequestIDSuite) serve(header string) (seen, echoed string) {
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	if header != "" {
+		req.Header.Set("X-Request-ID", header)
+	}
+	rec := httptest.NewRecorder()
+	withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	})).ServeHTTP(rec, req)
+	return seen, rec.Header().Get("X-Request-ID")
+}
+
+func (s *RequestIDSuite) TestGenerated(c *C) {
+	seen, echoed := s.serve("")
+	c.Assert(seen, Matches, uuidPattern)
+	c.Assert(echoed, Equals, seen)
+
+	other, _ := s.serve("")
+	c.Assert(other, Not(Equals), seen)
+}
+
+func (s *RequestIDSuite) TestKept(c *C) {
+	seen, echoed := s.serve("lb-7f3a:42")
+	c.Assert(seen, Equals, "lb-7f3a:42")
+	c.Assert(echoed, Equals, "lb-7f3a:42")
+}
+
+func (s *RequestIDSuite) TestInvalidReplaced(c *C) {
+	for _, id := range []string{"with space", `quo"te`, "new\nline", strings.Repeat("x", maxRequestIDLen+1)} {
+		seen, _ := s.serve(id)
+		c.Check(seen, Matches, uuidPattern, Commentf("id %q", id))
+	}
+}
+
+func (s *RequestIDSuite) TestLogged(c *C) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+	var buf bytes.Buffer
+	cfg := newConfig()
+	cfg.LogFormat = "json"
+	c.Assert(setupLogger(&buf, cfg), IsNil)
+
+	req := httptest.NewRequest("GET", "/config.v1", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.With("component", "test").InfoContext(r.Context(), "hello")
+		logger.Info("no context")
+	})).ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Matches, `\{.*"msg":"hello","component":"test","request_id":"abc123"\}`)
+	c.Assert(lines[1], Not(Matches), `.*request_id.*`)
+}
+
+func (s *ServerSuite) TestRequestID(c *C) {
+	req, err := http.NewRequest("POST", s.server.URL+"/config.v1/git-upload-pack", strings.NewReader("0000"))
+	c.Assert(err, IsNil)
+	req.Header.Set("X-Request-ID", "clone-1")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("X-Request-ID"), Equals, "clone-1")
+	c.Assert(s.requestID, Equals, "clone-1")
+}
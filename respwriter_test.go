@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&StatusWriterSuite{})
+
+type StatusWriterSuite struct{}
+
+func (s *StatusWriterSuite) TestStatusWriter(c *C) {
+	rec := httptest.NewRecorder()
+	sw := &statusWriter{ResponseWriter: rec}
+	c.Assert(sw.status(), Equals, http.StatusOK)
+	sw.WriteHeader(http.StatusNotFound)
+	_, _ = sw.Write([]byte("not found"))
+	c.Assert(sw.status(), Equals, http.StatusNotFound)
+	c.Assert(sw.written, Equals, int64(len("not found")))
+	c.Assert(rec.Code, Equals, http.StatusNotFound)
+
+	var _ http.Flusher = sw
+	c.Assert(http.NewResponseController(sw).Flush(), IsNil)
+	c.Assert(rec.Flushed, Equals, true)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// doRetry sends req to GitHub, retrying up to config.RetryAttempts times
+// in total while GitHub answers 502 or 503, which it does transiently
+// during its deploys. Retries back off exponentially from
+// config.RetryBaseDelay, with jitter.
+//
+// GitHub throttling us with 429 Too Many Requests is retried as well when
+// its Retry-After asks to wait no longer than maxRetryAfter. Otherwise
+// the response goes back to the client, Retry-After included.
+//
+// Only requests without a body are retried, as a streamed body can't be
+// sent twice; other requests are sent once.
+//
+// Every attempt goes through the circuit breaker, and ErrCircuitOpen is
+// returned when it rejects one. The rate limit GitHub reports in its
+// responses is watched by quota.
+func doRetry(req *http.Request) (*http.Response, error) {
+	attempts := config().RetryAttempts
+	if req.Body != nil && req.Body != http.NoBody {
+		attempts = 1
+	}
+	for i := 1; ; i++ {
+		if !breaker.allow() {
+			return nil, ErrCircuitOpen
+		}
+		res, err := clientFor(req.Context()).Do(req)
+		if err != nil && req.Context().Err() == context.Canceled {
+			// Abandoned by the client, not counted either way.
+			breaker.abandon()
+		} else {
+			breaker.record(backendOK(req, res, err))
+		}
+		if err != nil {
+			return res, err
+		}
+		quota.observe(req, res)
+		delay := backoff(config().RetryBaseDelay, i)
+		if res.StatusCode == http.StatusTooManyRequests {
+			logRateLimited(req, res)
+			wait, ok := parseRetryAfter(res.Header.Get("Retry-After"))
+			if !ok || wait > maxRetryAfter {
+				return res, nil
+			}
+			delay = wait
+		} else if !isTransient(res.StatusCode) {
+			return res, nil
+		}
+		if i >= attempts {
+			return res, nil
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		_ = res.Body.Close()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+}
+
+// backendOK reports whether GitHub handled req fine, as far as the circuit
+// breaker is concerned. Requests with a body over the limit, and
+// redirects refused by checkRedirect, don't count as failures.
+func backendOK(req *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		var moved *movedError
+		return errors.As(err, &maxErr) || errors.As(err, &moved)
+	}
+	return res.StatusCode < 500
+}
+
+// maxRetryAfter is the longest Retry-After of a 429 response that is
+// waited for before retrying.
+const maxRetryAfter = 2 * time.Second
+
+// parseRetryAfter parses the value of a Retry-After header, either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// logRateLimited reports GitHub throttling req, with the details of its
+// rate limit when given.
+func logRateLimited(req *http.Request, res *http.Response) {
+	logger.WarnContext(req.Context(), "rate limited by GitHub", "method", req.Method, "path", req.URL.Path,
+		"retry_after", res.Header.Get("Retry-After"),
+		"remaining", res.Header.Get("X-RateLimit-Remaining"),
+		"reset", res.Header.Get("X-RateLimit-Reset"))
+}
+
+// backendErrorStatus returns the status answering a request whose
+// exchange with GitHub failed with err: 504 Gateway Timeout when GitHub
+// was too slow, and 502 Bad Gateway when it couldn't be reached at all,
+// so that dashboards tell the two apart. The kind returned, timeout or
+// unreachable, is for the logs.
+func backendErrorStatus(err error) (status int, kind string) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, "timeout"
+	}
+	return http.StatusBadGateway, "unreachable"
+}
+
+func isTransient(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable
+}
+
+// backoff returns the delay before retry n, counting from 1: half of
+// base doubled n-1 times, plus a random part of up to the other half.
+func backoff(base time.Duration, n int) time.Duration {
+	d := base << uint(n-1)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server is the http.Handler of the whole service: the go get pages and
+// redirects, the git and module proxies, health checks and metrics, with
+// the response headers, request ID, tracing, access log, panic recovery,
+// HSTS, maintenance, path cleaning and gzip middleware in front.
+type Server struct {
+	handler http.Handler
+	client  *http.Client
+}
+
+// NewServer returns a Server set up with cfg and talking to GitHub
+// through client. When client is nil, one is made with the connection
+// settings of cfg. The handlers read the configuration in use, which
+// callers store beforehand, as run does; NewServer leaves it alone.
+func NewServer(cfg *Config, client *http.Client) *Server {
+	if client == nil {
+		client = newHTTPClient(cfg)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	if cfg.MetricsBackend == metricsPrometheus {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	return &Server{
+		handler: withResponseHeaders(withRequestID(withTracing(withAccessLog(withRecovery(withHSTS(withMaintenance(withCleanPath(withGzip(mux))))))))),
+		client:  client,
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), clientKey{}, s.client)
+	s.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+type clientKey struct{}
+
+// clientFor returns the client for requests to GitHub made on behalf of
+// the request with context ctx: that of the Server handling it, or else
+// httpClient.
+func clientFor(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(clientKey{}).(*http.Client); ok {
+		return client
+	}
+	return httpClient
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ServerSuite{})
+
+// ServerSuite drives a Server over HTTP, in front of a fake GitHub.
+type ServerSuite struct {
+	requestID string // X-Request-ID of the last upload-pack
+	github    *httptest.Server
+	mux       *http.ServeMux
+	server    *httptest.Server
+	restore   func()
+}
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	mux := http.NewServeMux()
+	s.mux = mux
+	mux.HandleFunc("/go-aah/config.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+	mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c.Check(string(body), Equals, "0000")
+		s.requestID = r.Header.Get("X-Request-ID")
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+	s.github = httptest.NewTLSServer(mux)
+
+	cfg := config()
+	s.restore = func() { liveConfig.Store(cfg) }
+	breaker = &circuitBreaker{now: time.Now}
+	refsCached = &refsCache{now: time.Now}
+	notFoundCached = &notFoundCache{now: time.Now}
+
+	test := newConfig()
+	test.BackendBaseURL = s.github.URL
+	test.AllowPrivateBackend = true
+	liveConfig.Store(test)
+	s.server = httptest.NewServer(NewServer(test, s.github.Client()))
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	s.server.Close()
+	s.github.Close()
+	s.restore()
+}
+
+func (s *ServerSuite) get(c *C, path string) (*http.Response, string) {
+	res, err := http.Get(s.server.URL + path)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	return res, string(body)
+}
+
+func (s *ServerSuite) TestGoGet(c *C) {
+	res, body := s.get(c, "/config.v1?go-get=1")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(body, Matches, `(?s).*<meta name="go-import" content="\S+/config.v1 git https://\S+/config.v1">.*`)
+}
+
+func (s *ServerSuite) TestCleanPath(c *C) {
+	for _, path := range []string{"/config.v1/", "//config.v1", "/go-aah//config.v1///"} {
+		res, body := s.get(c, path+"?go-get=1")
+		c.Check(res.StatusCode, Equals, http.StatusOK, Commentf("path %s", path))
+		c.Check(body, Matches, `(?s).*<meta name="go-import" content="\S+/config.v1 git https://\S+/config.v1">.*`, Commentf("path %s", path))
+	}
+
+	res, err := http.Post(s.server.URL+"/config.v1//git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "0008NAK\n")
+}
+
+func (s *ServerSuite) TestUploadPack(c *C) {
+	res, err := http.Post(s.server.URL+"/config.v1/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0000"))
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "0008NAK\n")
+}
+
+func (s *ServerSuite) TestEndpoints(c *C) {
+	res, body := s.get(c, "/healthz")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(body, Equals, "ok")
+
+	res, body = s.get(c, "/metrics")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(body, Matches, "(?s).*go_goroutines.*")
+
+	res, _ = s.get(c, "/no/such/thing/here.v1/x")
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestNoMetricsEndpoint(c *C) {
+	test := newConfig()
+	test.BackendBaseURL = s.github.URL
+	test.AllowPrivateBackend = true
+	test.MetricsBackend = metricsStatsD
+	liveConfig.Store(test)
+	server := httptest.NewServer(NewServer(test, s.github.Client()))
+	defer server.Close()
+
+	// Taken for a repository named metrics instead.
+	res, err := http.Get(server.URL + "/metrics")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(string(body), Not(Matches), "(?s).*go_goroutines.*")
+}
+
+func (s *ServerSuite) TestMaintenance(c *C) {
+	config().Maintenance = true
+	res, body := s.get(c, "/config.v1?go-get=1")
+	c.Assert(res.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "300")
+	c.Assert(body, Equals, defaultMaintenanceMessage)
+
+	res, _ = s.get(c, "/healthz")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ServerSuite) TestGoGetGzip(c *C) {
+	req, err := http.NewRequest("GET", s.server.URL+"/config.v1?go-get=1", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(gunzip(c, body), Matches, `(?s).*<meta name="go-import" .*`)
+}
+
+func (s *ServerSuite) TestPackfileNotCompressed(c *C) {
+	pack := "0008NAK\n" + strings.Repeat("PACK", 1000)
+	gzipped := false
+	s.mux.HandleFunc("/go-aah/log.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, _ = w.Write([]byte(reflines(
+			"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+			"00000000000000000000000000000000000hash1 refs/heads/master",
+			"00000000000000000000000000000000000hash2 refs/heads/v1",
+		)))
+	})
+	s.mux.HandleFunc("/go-aah/log/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		if !gzipped {
+			_, _ = w.Write([]byte(pack))
+			return
+		}
+		c.Check(r.Header.Get("Accept-Encoding"), Equals, "gzip")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte(pack))
+		_ = gz.Close()
+	})
+
+	post := func() (*http.Response, []byte) {
+		req, err := http.NewRequest("POST", s.server.URL+"/log.v1/git-upload-pack", strings.NewReader("0000"))
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		return res, body
+	}
+
+	res, body := post()
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "")
+	c.Assert(string(body), Equals, pack)
+
+	// Gzipped by GitHub, and only by GitHub.
+	gzipped = true
+	res, body = post()
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(gunzip(c, body), Equals, pack)
+}
+
+func (s *ServerSuite) TestDefaultClient(c *C) {
+	srv := NewServer(config(), nil)
+	c.Assert(srv.client, NotNil)
+	c.Assert(srv.client, Not(Equals), httpClient)
+	c.Assert(srv.client.Transport.(*http.Transport).MaxIdleConnsPerHost, Equals, config().MaxIdleConnsPerHost)
+
+	c.Assert(clientFor(context.Background()), Equals, httpClient)
+}
+
+func (s *ServerSuite) TestConfigLeftAlone(c *C) {
+	live := config()
+	NewServer(newConfig(), nil)
+	c.Assert(config(), Equals, live)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMetrics sends the proxy measurements to a StatsD agent over UDP,
+// in the DogStatsD format, one packet each. They are those of
+// promMetrics, with dotted names and the labels as tags, as in
+// gopkg.proxy.requests:1|c|#service:upload-pack. Lost packets go
+// unnoticed, as StatsD intends.
+type statsdMetrics struct {
+	conn   net.Conn
+	rate   float64
+	sample func() float64 // in [0, 1), to sample against rate
+
+	mu       sync.Mutex
+	inFlight map[string]int64 // by service, sent as absolute gauges
+}
+
+// newStatsDMetrics returns Metrics sending to the agent at addr, with
+// counts and timings sampled at rate.
+func newStatsDMetrics(addr string, rate float64) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up StatsD: %v", err)
+	}
+	return &statsdMetrics{conn: conn, rate: rate, sample: rand.Float64, inFlight: make(map[string]int64)}, nil
+}
+
+// send sends the metric name, of type kind, "c", "g" or "ms", with the
+// given value and tags, as "key:value" pairs. Counts and timings are
+// sampled, gauges aren't.
+func (m *statsdMetrics) send(name, value, kind string, tags ...string) {
+	var b strings.Builder
+	b.WriteString("gopkg." + name + ":" + value + "|" + kind)
+	if kind != "g" && m.rate < 1 {
+		if m.sample() >= m.rate {
+			return
+		}
+		b.WriteString("|@" + strconv.FormatFloat(m.rate, 'g', -1, 64))
+	}
+	if len(tags) > 0 {
+		b.WriteString("|#" + strings.Join(tags, ","))
+	}
+	_, _ = m.conn.Write([]byte(b.String()))
+}
+
+// addInFlight adds delta to the requests in flight for service, and
+// sends their new count.
+func (m *statsdMetrics) addInFlight(service string, delta int64) {
+	m.mu.Lock()
+	m.inFlight[service] += delta
+	n := m.inFlight[service]
+	m.mu.Unlock()
+	m.send("proxy.requests_in_flight", strconv.FormatInt(n, 10), "g", "service:"+service)
+}
+
+func (m *statsdMetrics) ProxyStarted(service string) {
+	m.addInFlight(service, 1)
+}
+
+func (m *statsdMetrics) ProxyDone(s ProxyStats) {
+	m.addInFlight(s.Service, -1)
+	tag := "service:" + s.Service
+	m.send("proxy.requests", "1", "c", tag)
+	m.send("proxy.response_bytes", strconv.FormatInt(s.Bytes, 10), "c", tag)
+	m.send("proxy.request_duration", strconv.FormatFloat(float64(s.Duration)/float64(time.Millisecond), 'f', -1, 64), "ms", tag)
+	class := statusClass(s.Status)
+	m.send("proxy.backend_responses", "1", "c", tag, "class:"+class)
+	if class != "2xx" && class != "3xx" {
+		m.send("proxy.backend_errors", "1", "c", tag, "class:"+class)
+	}
+}
+
+func (m *statsdMetrics) CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.send("cache.lookups", "1", "c", "cache:"+cache, "result:"+result)
+}
+
+func (m *statsdMetrics) CacheSize(cache string, bytes int64) {
+	m.send("cache.size_bytes", strconv.FormatInt(bytes, 10), "g", "cache:"+cache)
+}
+
+func (m *statsdMetrics) CacheEvicted(cache string, n int) {
+	m.send("cache.evictions", strconv.Itoa(n), "c", "cache:"+cache)
+}
+
+func (m *statsdMetrics) Panicked() {
+	m.send("panics", "1", "c")
+}
+
+func (m *statsdMetrics) RateLimitRemaining(resource string, remaining int) {
+	m.send("github.rate_limit_remaining", strconv.Itoa(remaining), "g", "resource:"+resource)
+}
+
+func (m *statsdMetrics) PseudoVersion() {
+	m.send("module.pseudo_versions", "1", "c")
+}
+
+func (m *statsdMetrics) RepoInFlight(pattern string, n int) {
+	m.send("proxy.repo_requests_in_flight", strconv.Itoa(n), "g", "pattern:"+pattern)
+}
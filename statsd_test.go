@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&StatsDSuite{})
+
+// StatsDSuite sends metrics to a fake agent listening on a local UDP port.
+type StatsDSuite struct {
+	agent net.PacketConn
+}
+
+func (s *StatsDSuite) SetUpTest(c *C) {
+	var err error
+	s.agent, err = net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+}
+
+func (s *StatsDSuite) TearDownTest(c *C) {
+	s.agent.Close()
+}
+
+// packets returns the next n packets received by the agent.
+func (s *StatsDSuite) packets(c *C, n int) []string {
+	var got []string
+	buf := make([]byte, 1024)
+	for len(got) < n {
+		c.Assert(s.agent.SetReadDeadline(time.Now().Add(5*time.Second)), IsNil)
+		size, _, err := s.agent.ReadFrom(buf)
+		c.Assert(err, IsNil)
+		got = append(got, string(buf[:size]))
+	}
+	return got
+}
+
+func (s *StatsDSuite) TestProxyDone(c *C) {
+	m, err := newStatsDMetrics(s.agent.LocalAddr().String(), 1)
+	c.Assert(err, IsNil)
+
+	m.ProxyStarted(serviceUploadPack)
+	m.ProxyDone(ProxyStats{Service: serviceUploadPack, Status: http.StatusBadGateway, Bytes: 10, Duration: 1500 * time.Microsecond})
+	c.Assert(s.packets(c, 7), DeepEquals, []string{
+		"gopkg.proxy.requests_in_flight:1|g|#service:upload-pack",
+		"gopkg.proxy.requests_in_flight:0|g|#service:upload-pack",
+		"gopkg.proxy.requests:1|c|#service:upload-pack",
+		"gopkg.proxy.response_bytes:10|c|#service:upload-pack",
+		"gopkg.proxy.request_duration:1.5|ms|#service:upload-pack",
+		"gopkg.proxy.backend_responses:1|c|#service:upload-pack,class:5xx",
+		"gopkg.proxy.backend_errors:1|c|#service:upload-pack,class:5xx",
+	})
+}
+
+func (s *StatsDSuite) TestOthers(c *C) {
+	m, err := newStatsDMetrics(s.agent.LocalAddr().String(), 1)
+	c.Assert(err, IsNil)
+
+	m.CacheLookup(cacheRefs, true)
+	m.CacheLookup(cacheModuleZip, false)
+	m.CacheSize(cacheModuleZip, 1024)
+	m.CacheEvicted(cacheModuleZip, 3)
+	m.Panicked()
+	m.RateLimitRemaining("core", 4999)
+	m.PseudoVersion()
+	m.RepoInFlight("go-aah/*", 3)
+	c.Assert(s.packets(c, 8), DeepEquals, []string{
+		"gopkg.cache.lookups:1|c|#cache:refs,result:hit",
+		"gopkg.cache.lookups:1|c|#cache:module_zip,result:miss",
+		"gopkg.cache.size_bytes:1024|g|#cache:module_zip",
+		"gopkg.cache.evictions:3|c|#cache:module_zip",
+		"gopkg.panics:1|c",
+		"gopkg.github.rate_limit_remaining:4999|g|#resource:core",
+		"gopkg.module.pseudo_versions:1|c",
+		"gopkg.proxy.repo_requests_in_flight:3|g|#pattern:go-aah/*",
+	})
+}
+
+func (s *StatsDSuite) TestSampleRate(c *C) {
+	m, err := newStatsDMetrics(s.agent.LocalAddr().String(), 0.25)
+	c.Assert(err, IsNil)
+
+	m.sample = func() float64 { return 0.5 }
+	m.Panicked()
+	m.sample = func() float64 { return 0.1 }
+	m.Panicked()
+	// Gauges are never sampled.
+	m.sample = func() float64 { return 0.5 }
+	m.RateLimitRemaining("core", 10)
+	c.Assert(s.packets(c, 2), DeepEquals, []string{
+		"gopkg.panics:1|c|@0.25",
+		"gopkg.github.rate_limit_remaining:10|g|#resource:core",
+	})
+}
+
+func (s *StatsDSuite) TestSetupMetrics(c *C) {
+	cfg := newConfig()
+	cfg.MetricsBackend = metricsNone
+	m, err := setupMetrics(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, Metrics(nopMetrics{}))
+
+	cfg.MetricsBackend = metricsStatsD
+	cfg.StatsDAddr = s.agent.LocalAddr().String()
+	m, err = setupMetrics(cfg)
+	c.Assert(err, IsNil)
+	m.Panicked()
+	c.Assert(s.packets(c, 1), DeepEquals, []string{"gopkg.panics:1|c"})
+
+	cfg.StatsDAddr = "localhost:port"
+	_, err = setupMetrics(cfg)
+	c.Assert(err, ErrorMatches, "cannot set up StatsD: .*")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// validateTarget checks that target, a URL built from the path of a
+// request, points at the configured GitHub instance and nowhere else, so
+// that crafted paths can't get the proxy to reach other hosts. Target must
+// be an https URL with the host of config.BackendBaseURL, or of one of
+// config.Backends, no credentials and no dot segments in its path.
+// Loopback, private and link-local addresses are refused unless
+// config.AllowPrivateBackend is set.
+func validateTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target URL: %v", err)
+	}
+	backend, err := url.Parse(config().BackendBaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid backend base URL: %v", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("target URL %q is not https", target)
+	}
+	if u.User != nil {
+		return fmt.Errorf("target URL %q has credentials", target)
+	}
+	if !isBackendHost(u.Host) {
+		return fmt.Errorf("target host %q is not the backend host %q", u.Host, backend.Host)
+	}
+	for _, seg := range strings.Split(u.Path, "/") {
+		if seg == "." || seg == ".." {
+			return fmt.Errorf("target URL %q has dot segments", target)
+		}
+	}
+	if !config().AllowPrivateBackend && isPrivateHost(u.Hostname()) {
+		return fmt.Errorf("target host %q is a private address", u.Host)
+	}
+	return nil
+}
+
+// isPrivateHost reports whether host is localhost or an IP address that
+// is loopback, private, link-local or unspecified.
+func isPrivateHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// sendBadTarget replies 400 to a request that resolved to a target
+// refused by validateTarget.
+func sendBadTarget(resp http.ResponseWriter, req *http.Request, err error) {
+	logger.WarnContext(req.Context(), "refused proxy target", "err", err)
+	resp.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(resp, "Invalid repository path.")
+}
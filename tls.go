@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsCipherSuites are the TLS 1.2 cipher suites offered by the HTTPS
+// server, only forward secret AEAD ones. TLS 1.3 suites aren't
+// configurable and are all fine.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// newTLSConfig returns the TLS settings of the HTTPS server for cfg, TLS
+// 1.2 at least. With cfg.ACMECacheDir set, certificates for cfg.ACMEHosts
+// are requested from Let's Encrypt as needed; otherwise those in
+// cfg.TLSCertFile and cfg.TLSKeyFile are loaded by ListenAndServeTLS.
+// With cfg.PushClientCAFile set, client certificates signed by its CAs
+// are asked for, and verified when given.
+func newTLSConfig(cfg *Config) (*tls.Config, error) {
+	tc := &tls.Config{}
+	if cfg.ACMECacheDir != "" {
+		m := &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cfg.ACMECacheDir),
+			RenewBefore: 24 * 30 * time.Hour,
+			HostPolicy:  autocert.HostWhitelist(cfg.ACMEHosts...),
+			Email:       cfg.ACMEEmail,
+		}
+		// Answers the tls-alpn-01 challenges as well.
+		tc = m.TLSConfig()
+	}
+	tc.MinVersion = tls.VersionTLS12
+	tc.CipherSuites = tlsCipherSuites
+	if cfg.PushClientCAFile != "" {
+		pool, err := loadClientCAs(cfg.PushClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// loadClientCAs returns the pool of the CA certificates in the PEM file.
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read push client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in push client CA file %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TLSSuite{})
+
+type TLSSuite struct{}
+
+func (s *TLSSuite) TestNewTLSConfig(c *C) {
+	cfg := newConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = "cert.pem", "key.pem"
+	tc, err := newTLSConfig(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(tc.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(tc.CipherSuites, DeepEquals, tlsCipherSuites)
+	c.Assert(tc.ClientAuth, Equals, tls.NoClientCert)
+	c.Assert(tc.GetCertificate, IsNil)
+}
+
+func (s *TLSSuite) TestNewTLSConfigACME(c *C) {
+	cfg := newConfig()
+	cfg.ACMECacheDir = c.MkDir()
+	tc, err := newTLSConfig(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(tc.MinVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(tc.GetCertificate, NotNil)
+	c.Assert(tc.NextProtos, DeepEquals, []string{"h2", "http/1.1", acme.ALPNProto})
+
+	// Hosts not listed get no certificate requested for them.
+	_, err = tc.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	c.Assert(err, ErrorMatches, `.*host "example.com" not configured in HostWhitelist`)
+}
+
+// writeCA writes a self-signed CA certificate to a PEM file in dir, and
+// returns its path.
+func writeCA(c *C, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	path := filepath.Join(dir, "ca.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *TLSSuite) TestNewTLSConfigClientCAs(c *C) {
+	dir := c.MkDir()
+	cfg := newConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = "cert.pem", "key.pem"
+	cfg.PushClientCAFile = writeCA(c, dir)
+	tc, err := newTLSConfig(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(tc.ClientAuth, Equals, tls.VerifyClientCertIfGiven)
+	c.Assert(tc.ClientCAs, NotNil)
+
+	cfg.PushClientCAFile = filepath.Join(dir, "missing.pem")
+	_, err = newTLSConfig(cfg)
+	c.Assert(err, ErrorMatches, "cannot read push client CA file: .*")
+
+	cfg.PushClientCAFile = filepath.Join(dir, "empty.pem")
+	c.Assert(os.WriteFile(cfg.PushClientCAFile, []byte("nothing"), 0600), IsNil)
+	_, err = newTLSConfig(cfg)
+	c.Assert(err, ErrorMatches, "no certificate found in push client CA file .*")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracingNone   = ""
+	tracingStdout = "stdout"
+	tracingOTLP   = "otlp"
+)
+
+// tracer creates the spans of the proxy. It is a no-op one unless
+// setupTracing installs an exporter.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer("")
+
+// propagator carries trace context in and out of HTTP headers, W3C
+// traceparent and baggage.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// setupTracing sets tracer to export spans as configured in
+// cfg.TracingExporter, and returns the function flushing the spans left
+// on shutdown. With no exporter, tracing stays disabled.
+func setupTracing(cfg *Config) (shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.TracingExporter {
+	case tracingNone:
+		return func(context.Context) error { return nil }, nil
+	case tracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case tracingOTLP:
+		// The endpoint and headers come from the standard
+		// OTEL_EXPORTER_OTLP_* environment variables.
+		exporter, err = otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %q", cfg.TracingExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up tracing: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	tracer = tp.Tracer("gopkg")
+	return tp.Shutdown, nil
+}
+
+// withTracing wraps h so that every request gets a span, continuing the
+// trace of the client when it sends one.
+func withTracing(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" request", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status()))
+		if sw.status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status()))
+		}
+	})
+}
+
+// traceRepo records repo as the one the request traced in ctx is about,
+// for its trace and slow request log.
+func traceRepo(ctx context.Context, repo *Repo) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("gopkg.repo", repo.GitHubRoot()))
+	noteRepo(ctx, repo.GitHubRoot())
+}
+
+// injectTrace sets the trace context of ctx in h, the headers of a
+// request to GitHub, replacing any sent by the client.
+func injectTrace(ctx context.Context, h http.Header) {
+	h.Del("Traceparent")
+	h.Del("Tracestate")
+	h.Del("Baggage")
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TracingSuite{})
+
+type TracingSuite struct{}
+
+func (s *TracingSuite) TestSetupTracing(c *C) {
+	cfg := newConfig()
+	shutdown, err := setupTracing(cfg)
+	c.Assert(err, IsNil)
+	c.Assert(shutdown(context.Background()), IsNil)
+
+	cfg.TracingExporter = "zipkin"
+	_, err = setupTracing(cfg)
+	c.Assert(err, ErrorMatches, `invalid tracing exporter "zipkin"`)
+}
+
+// spanAttr returns the value of the attribute key of span.
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func (s *HandlerSuite) TestTracing(c *C) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer func(t trace.Tracer) { tracer = t }(tracer)
+	tracer = tp.Tracer("test")
+
+	var traceparent string
+	s.mux.HandleFunc("/go-aah/config/git-upload-pack", func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		_, _ = w.Write([]byte("0008NAK\n"))
+	})
+
+	const clientParent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest("POST", "/config.v1/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("Traceparent", clientParent)
+	w := httptest.NewRecorder()
+	withTracing(http.HandlerFunc(handler)).ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+
+	spans := rec.Ended()
+	c.Assert(spans, HasLen, 3)
+	copying, github, request := spans[0], spans[1], spans[2]
+	c.Assert(github.Name(), Equals, "github upload-pack")
+	c.Assert(copying.Name(), Equals, "copy response")
+	c.Assert(request.Name(), Equals, "POST request")
+
+	c.Assert(request.SpanContext().TraceID().String(), Equals, "0af7651916cd43dd8448eb211c80319c")
+	c.Assert(request.Parent().SpanID().String(), Equals, "b7ad6b7169203331")
+	c.Assert(github.Parent().SpanID(), Equals, request.SpanContext().SpanID())
+	c.Assert(copying.Parent().SpanID(), Equals, github.SpanContext().SpanID())
+
+	c.Assert(spanAttr(request, "gopkg.repo").AsString(), Equals, "github.com/go-aah/config")
+	c.Assert(spanAttr(request, "gopkg.service").AsString(), Equals, serviceUploadPack)
+	c.Assert(spanAttr(request, "http.response.status_code").AsInt64(), Equals, int64(200))
+	c.Assert(spanAttr(github, "http.response.status_code").AsInt64(), Equals, int64(200))
+	c.Assert(spanAttr(copying, "gopkg.bytes").AsInt64(), Equals, int64(8))
+
+	// GitHub sees the proxy span as the parent, not the client one.
+	c.Assert(traceparent, Equals, "00-0af7651916cd43dd8448eb211c80319c-"+github.SpanContext().SpanID().String()+"-01")
+}
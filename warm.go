@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warming is set while the refs of config.WarmRepos are being fetched
+// on startup, for /readyz to fail meanwhile.
+var warming atomic.Bool
+
+// warmCaches fetches the refs of cfg.WarmRepos, cfg.WarmWorkers at once,
+// giving up on those not done after cfg.WarmTimeout. warming is set
+// until then; callers set it beforehand, so that readiness probes
+// answered before this runs fail already.
+func warmCaches(cfg *Config) {
+	defer warming.Store(false)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WarmTimeout)
+	defer cancel()
+
+	repos := make(chan string)
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < cfg.WarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for full := range repos {
+				user, name, _ := strings.Cut(full, "/")
+				repo := &Repo{User: user, Name: name}
+				if _, err := fetchRefs(ctx, repo); err != nil {
+					failed.Add(1)
+					logger.Warn("cannot warm refs", "repo", repo.GitHubRoot(), "err", err)
+				}
+			}
+		}()
+	}
+feed:
+	for _, name := range cfg.WarmRepos {
+		select {
+		case repos <- name:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(repos)
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Info("refs warmed", "repos", len(cfg.WarmRepos), "failed", failed.Load(), "took", time.Since(start))
+	case <-ctx.Done():
+		// The fetches left go on, to be cached when done.
+		logger.Warn("refs warm-up timed out, ready anyway", "repos", len(cfg.WarmRepos), "timeout", cfg.WarmTimeout)
+	}
+}
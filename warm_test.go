@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *HandlerSuite) TestWarmCaches(c *C) {
+	cfg := newConfig()
+	cfg.WarmRepos = []string{"go-aah/config", "go-aah/missing"}
+	cfg.WarmWorkers = 2
+	warming.Store(true)
+	warmCaches(cfg)
+	c.Assert(warming.Load(), Equals, false)
+	c.Assert(s.refsHits, Equals, 1)
+
+	// Clones find them cached.
+	rec := s.serve("GET", "/config.v1/info/refs?service=git-upload-pack", "")
+	c.Assert(rec.Code, Equals, http.StatusOK)
+	c.Assert(s.refsHits, Equals, 1)
+}
+
+func (s *HandlerSuite) TestWarmCachesTimeout(c *C) {
+	release := make(chan bool)
+	s.mux.HandleFunc("/go-aah/slow.git/info/refs", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	cfg := newConfig()
+	cfg.WarmRepos = []string{"go-aah/slow"}
+	cfg.WarmTimeout = 50 * time.Millisecond
+	warming.Store(true)
+	start := time.Now()
+	warmCaches(cfg)
+	c.Assert(warming.Load(), Equals, false)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+
+	// The fetch goes on, and is cached once done.
+	close(release)
+	repo := &Repo{User: "go-aah", Name: "slow"}
+	for i := 0; i < 100; i++ {
+		if _, ok := refsCached.get(repo.BackendRoot() + refsSuffix); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("refs not cached after the warm-up timed out")
+}
+
+func (s *HealthSuite) TestReadyzWarming(c *C) {
+	defer warming.Store(false)
+	warming.Store(true)
+	rec := s.serve("/readyz")
+	c.Assert(rec.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Body.String(), Equals, "warming caches")
+	c.Assert(s.pings, Equals, 0)
+
+	warming.Store(false)
+	c.Assert(s.serve("/readyz").Code, Equals, http.StatusOK)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zipCache keeps track of the module zips in config.ModuleCacheDir. Once
+// their total size goes over config.ModuleCacheMaxSize, the sweeper
+// removes the least recently used ones in the background, down to
+// config.ModuleCacheTargetSize. Zips never change once built, as module
+// versions are immutable, so they don't expire otherwise.
+//
+// Zips are opened with the cache locked, so they are never removed in
+// between being looked up and opened; once open, they can be read through
+// even if removed.
+//
+// Their modification time stays the time they were built, served as the
+// Last-Modified of the zip for If-Range and If-Modified-Since. Using a
+// zip only bumps its access time, and its place in the LRU kept in
+// memory.
+type zipCache struct {
+	mu     sync.Mutex
+	lru    *list.List // of *cachedZip, most recently used first
+	files  map[string]*list.Element
+	size   int64
+	loaded bool
+
+	sweepc chan struct{} // wakes the sweeper up, when started
+}
+
+type cachedZip struct {
+	path string
+	size int64
+}
+
+var zipCached = &zipCache{}
+
+// load registers the zips left in the cache directory by previous runs,
+// the most recently built first.
+func (zc *zipCache) load() {
+	if zc.loaded {
+		return
+	}
+	zc.loaded = true
+	zc.lru = list.New()
+	zc.files = make(map[string]*list.Element)
+
+	type found struct {
+		cachedZip
+		mtime time.Time
+	}
+	var zips []found
+	_ = filepath.WalkDir(config().ModuleCacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".zip") {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			// Left by a build that was cut short.
+			_ = os.Remove(path)
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			zips = append(zips, found{cachedZip{path, info.Size()}, info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(zips, func(i, j int) bool { return zips[i].mtime.After(zips[j].mtime) })
+	for i := range zips {
+		zc.files[zips[i].path] = zc.lru.PushBack(&zips[i].cachedZip)
+		zc.size += zips[i].size
+	}
+	zc.changed()
+}
+
+// open returns the zip at path opened, if cached, marking it as the most
+// recently used.
+func (zc *zipCache) open(path string) (*os.File, bool) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	zc.load()
+	e, ok := zc.files[path]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed behind our back.
+		zc.remove(e)
+		zc.changed()
+		return nil, false
+	}
+	zc.lru.MoveToFront(e)
+	if info, err := f.Stat(); err == nil {
+		_ = os.Chtimes(path, time.Now(), info.ModTime())
+	}
+	return f, true
+}
+
+// add registers the zip just written at path, evicting older ones as
+// needed to make room for it.
+func (zc *zipCache) add(path string, size int64) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	zc.load()
+	if e, ok := zc.files[path]; ok {
+		z := e.Value.(*cachedZip)
+		zc.size += size - z.size
+		z.size = size
+		zc.lru.MoveToFront(e)
+	} else {
+		zc.files[path] = zc.lru.PushFront(&cachedZip{path, size})
+		zc.size += size
+	}
+	zc.changed()
+}
+
+// remove forgets the zip of e.
+func (zc *zipCache) remove(e *list.Element) {
+	z := zc.lru.Remove(e).(*cachedZip)
+	delete(zc.files, z.path)
+	zc.size -= z.size
+}
+
+// changed reports the size of the cache, and wakes the sweeper up when
+// over the size limit.
+func (zc *zipCache) changed() {
+	metrics.CacheSize(cacheModuleZip, zc.size)
+	if max := config().ModuleCacheMaxSize; max > 0 && zc.size > max && zc.sweepc != nil {
+		select {
+		case zc.sweepc <- struct{}{}:
+		default:
+			// Already awake.
+		}
+	}
+}
+
+// startSweeper starts the goroutine sweeping the cache whenever it goes
+// over the size limit, for good.
+func (zc *zipCache) startSweeper() {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	if zc.sweepc != nil {
+		return
+	}
+	zc.sweepc = make(chan struct{}, 1)
+	go func() {
+		for range zc.sweepc {
+			zc.sweep()
+		}
+	}()
+	// For the zips of previous runs.
+	zc.load()
+	zc.changed()
+}
+
+// sweep removes the least recently used zips when over the size limit,
+// until down to config.ModuleCacheTargetSize, always keeping the most
+// recent one.
+func (zc *zipCache) sweep() {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	zc.load()
+	max := config().ModuleCacheMaxSize
+	if max <= 0 || zc.size <= max {
+		return
+	}
+	target := moduleCacheTarget(config())
+	evicted := 0
+	for zc.size > target && zc.lru.Len() > 1 {
+		e := zc.lru.Back()
+		path := e.Value.(*cachedZip).path
+		zc.remove(e)
+		evicted++
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("cannot remove cached module zip", "path", path, "err", err)
+		}
+	}
+	metrics.CacheEvicted(cacheModuleZip, evicted)
+	metrics.CacheSize(cacheModuleZip, zc.size)
+}
+
+// moduleCacheTarget returns the size the module cache of cfg is swept
+// down to: cfg.ModuleCacheTargetSize, or else 80% of the size limit.
+func moduleCacheTarget(cfg *Config) int64 {
+	if cfg.ModuleCacheTargetSize > 0 {
+		return cfg.ModuleCacheTargetSize
+	}
+	return cfg.ModuleCacheMaxSize / 10 * 8
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ZipCacheSuite{})
+
+type ZipCacheSuite struct {
+	zc      *zipCache
+	restore func()
+}
+
+func (s *ZipCacheSuite) SetUpTest(c *C) {
+	dir, max, target := config().ModuleCacheDir, config().ModuleCacheMaxSize, config().ModuleCacheTargetSize
+	s.restore = func() {
+		config().ModuleCacheDir, config().ModuleCacheMaxSize, config().ModuleCacheTargetSize = dir, max, target
+	}
+	config().ModuleCacheDir = c.MkDir()
+	config().ModuleCacheMaxSize = 25
+	config().ModuleCacheTargetSize = 20
+	s.zc = &zipCache{}
+}
+
+func (s *ZipCacheSuite) TearDownTest(c *C) {
+	s.restore()
+}
+
+// cacheMetrics counts the cache lookups and evictions reported.
+type cacheMetrics struct {
+	nopMetrics
+	hits, misses int
+	size         int64
+	evicted      int
+}
+
+func (m *cacheMetrics) CacheLookup(cache string, hit bool) {
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *cacheMetrics) CacheSize(cache string, bytes int64) {
+	m.size = bytes
+}
+
+func (m *cacheMetrics) CacheEvicted(cache string, n int) {
+	m.evicted += n
+}
+
+func (s *ZipCacheSuite) write(c *C, name string, size int, mtime time.Time) string {
+	path := filepath.Join(config().ModuleCacheDir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(os.WriteFile(path, make([]byte, size), 0644), IsNil)
+	c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// lookup tells whether the zip at path is cached, marking it used.
+func (s *ZipCacheSuite) lookup(path string) bool {
+	f, ok := s.zc.open(path)
+	if ok {
+		f.Close()
+	}
+	return ok
+}
+
+func (s *ZipCacheSuite) TestEvictLeastRecentlyUsed(c *C) {
+	now := time.Now()
+	a := s.write(c, "a/@v/v1.0.0.zip", 10, now)
+	s.zc.add(a, 10)
+	b := s.write(c, "b/@v/v1.0.0.zip", 10, now)
+	s.zc.add(b, 10)
+
+	// Using a makes b the least recently used one.
+	c.Assert(s.lookup(a), Equals, true)
+	d := s.write(c, "d/@v/v1.0.0.zip", 10, now)
+	s.zc.add(d, 10)
+	s.zc.sweep()
+
+	c.Assert(exists(a), Equals, true)
+	c.Assert(exists(b), Equals, false)
+	c.Assert(exists(d), Equals, true)
+	c.Assert(s.lookup(b), Equals, false)
+	c.Assert(s.zc.size, Equals, int64(20))
+}
+
+func (s *ZipCacheSuite) TestKeepLargeZip(c *C) {
+	a := s.write(c, "a/@v/v1.0.0.zip", 10, time.Now())
+	s.zc.add(a, 10)
+	b := s.write(c, "b/@v/v1.0.0.zip", 30, time.Now())
+	s.zc.add(b, 30)
+	s.zc.sweep()
+	c.Assert(exists(a), Equals, false)
+	c.Assert(exists(b), Equals, true)
+}
+
+func (s *ZipCacheSuite) TestNoLimit(c *C) {
+	config().ModuleCacheMaxSize = 0
+	for _, name := range []string{"a", "b", "d"} {
+		path := s.write(c, name+"/@v/v1.0.0.zip", 20, time.Now())
+		s.zc.add(path, 20)
+	}
+	s.zc.sweep()
+	c.Assert(s.zc.lru.Len(), Equals, 3)
+}
+
+func (s *ZipCacheSuite) TestLoad(c *C) {
+	now := time.Now()
+	old := s.write(c, "old/@v/v1.0.0.zip", 10, now.Add(-2*time.Hour))
+	recent := s.write(c, "recent/@v/v1.0.0.zip", 10, now.Add(-time.Hour))
+	tmp := s.write(c, "recent/@v/.tmp-123.zip", 5, now)
+
+	c.Assert(s.lookup(recent), Equals, true)
+	c.Assert(exists(tmp), Equals, false)
+
+	// The zip built longest ago goes first.
+	d := s.write(c, "d/@v/v1.0.0.zip", 10, now)
+	s.zc.add(d, 10)
+	s.zc.sweep()
+	c.Assert(exists(old), Equals, false)
+	c.Assert(exists(recent), Equals, true)
+}
+
+func (s *ZipCacheSuite) TestOpenKeepsModTime(c *C) {
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	a := s.write(c, "a/@v/v1.0.0.zip", 10, mtime)
+	s.zc.add(a, 10)
+	c.Assert(s.lookup(a), Equals, true)
+	info, err := os.Stat(a)
+	c.Assert(err, IsNil)
+	c.Assert(info.ModTime().Equal(mtime), Equals, true)
+}
+
+func (s *ZipCacheSuite) TestSweepDownToTarget(c *C) {
+	defer func(m Metrics) { metrics = m }(metrics)
+	rec := &cacheMetrics{}
+	metrics = rec
+	config().ModuleCacheTargetSize = 10
+
+	var paths []string
+	for _, name := range []string{"a", "b", "d"} {
+		path := s.write(c, name+"/@v/v1.0.0.zip", 10, time.Now())
+		s.zc.add(path, 10)
+		paths = append(paths, path)
+	}
+	c.Assert(rec.size, Equals, int64(30))
+
+	// Under the limit, nothing goes.
+	config().ModuleCacheMaxSize = 30
+	s.zc.sweep()
+	c.Assert(s.zc.lru.Len(), Equals, 3)
+
+	config().ModuleCacheMaxSize = 25
+	s.zc.sweep()
+	c.Assert(exists(paths[0]), Equals, false)
+	c.Assert(exists(paths[1]), Equals, false)
+	c.Assert(exists(paths[2]), Equals, true)
+	c.Assert(rec.evicted, Equals, 2)
+	c.Assert(rec.size, Equals, int64(10))
+}
+
+func (s *ZipCacheSuite) TestSweeper(c *C) {
+	s.zc.startSweeper()
+	a := s.write(c, "a/@v/v1.0.0.zip", 10, time.Now())
+	s.zc.add(a, 10)
+	b := s.write(c, "b/@v/v1.0.0.zip", 20, time.Now())
+	s.zc.add(b, 20)
+
+	for i := 0; exists(a) && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(exists(a), Equals, false)
+	c.Assert(exists(b), Equals, true)
+}
+
+func (s *ZipCacheSuite) TestModuleCacheTarget(c *C) {
+	cfg := newConfig()
+	cfg.ModuleCacheMaxSize = 100
+	c.Assert(moduleCacheTarget(cfg), Equals, int64(80))
+	cfg.ModuleCacheTargetSize = 50
+	c.Assert(moduleCacheTarget(cfg), Equals, int64(50))
+}